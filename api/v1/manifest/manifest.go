@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"gopkg.in/yaml.v2"
@@ -13,15 +15,30 @@ import (
 const (
 	DefaultRestart    = "on-failure"
 	DefaultRestartSec = 5
+
+	DefaultHealthCheckActiveSec  = 5
+	DefaultHealthCheckTimeoutSec = 30
 )
 
 type Manifest struct {
 	// Name is used for the systemd unit file. TODO: add validation for spaces, strings, etc
-	Name       string        `yaml:"name"`
-	Executable string        `yame:"exectutable"`
-	Heroku     Heroku        `yaml:"heroku"`
-	Systemd    SystemdConfig `yaml:"systemd"`
-	Env        []string      `yaml:"env"`
+	Name        string        `yaml:"name"`
+	Executable  string        `yame:"exectutable"`
+	Heroku      Heroku        `yaml:"heroku"`
+	Systemd     SystemdConfig `yaml:"systemd"`
+	Env         []string      `yaml:"env"`
+	HealthCheck HealthCheck   `yaml:"healthCheck"`
+	// Platforms override the artifact or executable used on
+	// hosts of a platform such as linux/arm/v6 or linux/arm64
+	Platforms map[string]Platform `yaml:"platforms"`
+}
+
+// Platform selects what is installed on hosts of a platform.
+type Platform struct {
+	// Artifact is the name of the artifact built for the platform,
+	// downloaded in place of the artifact containing the manifest
+	Artifact   string `yaml:"artifact"`
+	Executable string `yaml:"executable"`
 }
 
 type Heroku struct {
@@ -29,6 +46,20 @@ type Heroku struct {
 	Env []string `yaml:"env"`
 }
 
+// HealthCheck is run after an update and must pass before the
+// update is reported as successful. The systemd unit is always
+// required to be active, HTTP and Command are optional.
+type HealthCheck struct {
+	// ActiveSec is how long the unit must stay active, a unit
+	// crashing right after it started is active at first
+	ActiveSec int `yaml:"activeSec"`
+	// HTTP is a URL that must return a 2xx status code
+	HTTP string `yaml:"http"`
+	// Command is run with sh -c and must exit 0
+	Command    string `yaml:"command"`
+	TimeoutSec int    `yaml:"timeoutSec"`
+}
+
 // SystemdConfig https://www.freedesktop.org/software/systemd/man/systemd.unit.html
 type SystemdConfig struct {
 	Unit    SystemdUnit    `yaml:"Unit"`
@@ -122,6 +153,24 @@ func (m *Manifest) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		m.Env = []string{}
 	}
 
+	if m.HealthCheck.ActiveSec < 0 {
+		result = multierror.Append(result, fmt.Errorf("healthCheck.activeSec must not be negative"))
+	}
+
+	if m.HealthCheck.TimeoutSec < 0 {
+		result = multierror.Append(result, fmt.Errorf("healthCheck.timeoutSec must not be negative"))
+	}
+
+	for _, name := range sortedPlatforms(m.Platforms) {
+		if !validPlatform(name) {
+			result = multierror.Append(result, fmt.Errorf("platforms.%s must be written as os/arch or os/arch/variant", name))
+		}
+		p := m.Platforms[name]
+		if p.Artifact == "" && p.Executable == "" {
+			result = multierror.Append(result, fmt.Errorf("platforms.%s requires an artifact or executable", name))
+		}
+	}
+
 	if result != nil {
 		return result
 	}
@@ -146,9 +195,50 @@ func (m *Manifest) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		m.Systemd.Unit.Description = m.Name
 	}
 
+	if m.HealthCheck.ActiveSec == 0 {
+		m.HealthCheck.ActiveSec = DefaultHealthCheckActiveSec
+	}
+
+	if m.HealthCheck.TimeoutSec == 0 {
+		m.HealthCheck.TimeoutSec = DefaultHealthCheckTimeoutSec
+	}
+
 	return nil
 }
 
+// ForPlatform returns the name and override of the first platform
+// matching the candidates, ordered from most to least specific.
+func (m Manifest) ForPlatform(candidates []string) (string, Platform, bool) {
+	for _, c := range candidates {
+		if p, ok := m.Platforms[c]; ok {
+			return c, p, true
+		}
+	}
+	return "", Platform{}, false
+}
+
+func validPlatform(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return false
+	}
+	for _, p := range parts {
+		if p == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedPlatforms(platforms map[string]Platform) []string {
+	names := make([]string, 0, len(platforms))
+	for name := range platforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func checkDuplicateManifests(manifests []Manifest) error {
 	keys := make(map[string]bool)
 	for _, entry := range manifests {
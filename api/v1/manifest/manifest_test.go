@@ -22,6 +22,22 @@ func Test_FullyDefinedManifest(t *testing.T) {
 	assert.Equal(t, "always", m.Systemd.Service.Restart)
 	assert.Equal(t, 23, m.Systemd.Service.RestartSec)
 	assert.Equal(t, []string{"MY_CONFIG"}, m.Env)
+	assert.Equal(t, 10, m.HealthCheck.ActiveSec)
+	assert.Equal(t, "http://localhost:8080/health", m.HealthCheck.HTTP)
+	assert.Equal(t, "/usr/local/bin/check-sample-app", m.HealthCheck.Command)
+	assert.Equal(t, 15, m.HealthCheck.TimeoutSec)
+	assert.Equal(t, map[string]Platform{
+		"linux/arm/v6": {Executable: "sample-app-agent-armv6"},
+		"linux/arm64":  {Artifact: "sample-app-arm64", Executable: "sample-app-agent-arm64"},
+	}, m.Platforms)
+
+	name, p, ok := m.ForPlatform([]string{"linux/arm/v7", "linux/arm/v6", "linux/arm/v5", "linux/arm"})
+	assert.True(t, ok)
+	assert.Equal(t, "linux/arm/v6", name)
+	assert.Equal(t, "sample-app-agent-armv6", p.Executable)
+
+	_, _, ok = m.ForPlatform([]string{"linux/amd64"})
+	assert.False(t, ok)
 }
 
 func Test_Defaults(t *testing.T) {
@@ -40,6 +56,7 @@ func Test_Defaults(t *testing.T) {
 	assert.Equal(t, "on-failure", m.Systemd.Service.Restart)
 	assert.Equal(t, 5, m.Systemd.Service.RestartSec)
 	assert.Equal(t, []string{}, m.Env)
+	assert.Equal(t, HealthCheck{ActiveSec: 5, TimeoutSec: 30}, m.HealthCheck)
 }
 
 func Test_IncorrectType(t *testing.T) {
@@ -56,3 +73,9 @@ func Test_MissingField(t *testing.T) {
 	assert.NotNil(t, err, "getting manifest should return err")
 	assert.EqualError(t, err, "3 errors occurred:\n\t* name field is required\n\t* executable field is required\n\t* heroku.app field is required\n\n")
 }
+
+func Test_InvalidPlatform(t *testing.T) {
+	_, err := GetManifest("../../../test/templates/invalid-platform-manifest.yaml", "sample-app")
+
+	assert.EqualError(t, err, "2 errors occurred:\n\t* platforms.arm64 must be written as os/arch or os/arch/variant\n\t* platforms.linux/amd64 requires an artifact or executable\n\n")
+}
@@ -6,4 +6,68 @@ type UpdateCondition struct {
 	ManifestName string `json:"manifestName"`
 	Error        string `json:"error"`
 	Host         string `json:"host"`
+	// SHA and ArtifactName identify the version being deployed
+	SHA          string `json:"sha"`
+	ArtifactName string `json:"artifactName"`
+	// RolledBack is set when a failed update was reverted
+	// and RunningSHA is the version that is now running.
+	RolledBack bool   `json:"rolledBack"`
+	RunningSHA string `json:"runningSHA"`
+}
+
+// DeploymentRecord is a single deployment attempt on a host,
+// kept in the deployment history.
+type DeploymentRecord struct {
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+	Host         string `json:"host"`
+	SHA          string `json:"sha"`
+	ArtifactName string `json:"artifactName"`
+	StartedAt    int64  `json:"startedAt"`
+	FinishedAt   int64  `json:"finishedAt"`
+	DurationSec  int64  `json:"durationSec"`
+	Status       string `json:"status"`
+	Error        string `json:"error"`
+	RolledBack   bool   `json:"rolledBack"`
+	RunningSHA   string `json:"runningSHA"`
+}
+
+// RolloutStatus is the progress of a staged rollout of
+// an artifact across hosts.
+type RolloutStatus struct {
+	RepoName     string     `json:"repoName"`
+	ManifestName string     `json:"manifestName"`
+	SHA          string     `json:"sha"`
+	Strategy     string     `json:"strategy"`
+	Status       string     `json:"status"`
+	Waves        [][]string `json:"waves"`
+	CurrentWave  int        `json:"currentWave"`
+	Error        string     `json:"error"`
+}
+
+// Agent is a host running the agent as last
+// reported by the inventory it publishes.
+type Agent struct {
+	Host string `json:"host"`
+	// LastSeen is the unix time of the latest inventory
+	LastSeen int64 `json:"lastSeen"`
+	// Stale is set when no inventory was received
+	// within the inventory timeout
+	Stale        bool              `json:"stale"`
+	AgentVersion string            `json:"agentVersion"`
+	Platform     string            `json:"platform"`
+	Labels       map[string]string `json:"labels"`
+	Apps         []AgentApp        `json:"apps"`
+}
+
+// AgentApp is an app installed on an agent host.
+type AgentApp struct {
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+	SHA          string `json:"sha"`
+	LastSeen     int64  `json:"lastSeen"`
+	// Status and Error are from the last update condition of
+	// the app on the host, Status is UNKNOWN when there is none
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
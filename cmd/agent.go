@@ -1,86 +1,117 @@
 package cmd
 
 import (
+	"context"
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	mqttC "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/manifest"
 	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/artifacts"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
-	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/github"
-	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/heroku"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/health"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/mqtt"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/platform"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
 )
 
 type Agent struct {
-	MqttClient   mqtt.MqttClient
-	GHApiToken   string
-	HerokuAPIKey string
-	HerokuApp    string
+	Transport mqtt.Transport
+	// ArtifactCredentials are the secrets used to download artifacts
+	ArtifactCredentials map[string]string
+	Platform            platform.Platform
+
+	// mu guards the state below, which changes
+	// when the deployer config is reloaded
+	mu          *sync.RWMutex
+	trustedKeys []crypto.PublicKey
+	forwarders  map[string]logForwarder
+	Secrets     secrets.Provider
+	HerokuApp   string
+	// Host is where apps are installed
+	Host file.Host
+	// GithubAPIURL defaults to github.DefaultAPIURL
+	GithubAPIURL string
 }
 
-func newAgent(herokuAPIKey, herokuApp string) (Agent, error) {
-	c := heroku.NewHerokuClient(herokuAPIKey)
-	envVars, err := c.GetEnvVars(herokuApp)
+// newAgent creates an agent, its MQTT session is kept by the broker
+// when clientID is set. Only the update command must pass one, a
+// command connecting with the same ID would take over its session.
+func newAgent(provider secrets.Provider, herokuApp, clientID string) (Agent, error) {
+	envVars, err := provider.GetSecrets(herokuApp)
 	if err != nil {
-		return Agent{}, fmt.Errorf("Error getting env vars from Heroku: %s", err)
+		return Agent{}, fmt.Errorf("Error getting env vars from %s: %s", provider.Name(), err)
 	}
 
-	ghApiToken := envVars["GH_API_TOKEN"]
-	if ghApiToken == "" {
-		return Agent{}, fmt.Errorf("GH_API_TOKEN environment variable not found from Heroku")
+	if envVars[artifacts.GHApiTokenKey] == "" {
+		return Agent{}, fmt.Errorf("GH_API_TOKEN environment variable not found from secret provider")
 	}
 
 	user := envVars["CLOUDMQTT_AGENT_USER"]
 	if user == "" {
-		return Agent{}, fmt.Errorf("CLOUDMQTT_AGENT_USER environment variable not found from Heroku")
+		return Agent{}, fmt.Errorf("CLOUDMQTT_AGENT_USER environment variable not found from secret provider")
 	}
 
 	password := envVars["CLOUDMQTT_AGENT_PASSWORD"]
 	if password == "" {
-		return Agent{}, fmt.Errorf("CLOUDMQTT_AGENT_PASSWORD environment variable not found from Heroku")
+		return Agent{}, fmt.Errorf("CLOUDMQTT_AGENT_PASSWORD environment variable not found from secret provider")
 	}
 
 	mqttURL := envVars["CLOUDMQTT_URL"]
 	if mqttURL == "" {
-		return Agent{}, fmt.Errorf("CLOUDMQTT_URL environment variable not found from heroku")
+		return Agent{}, fmt.Errorf("CLOUDMQTT_URL environment variable not found from secret provider")
 	}
-	urlSplit := strings.Split(mqttURL, "@")
-	if len(urlSplit) != 2 {
-		logger.Fatal("unexpected CLOUDMQTT_URL parsing error")
+	// the URL is a wss:// URL ending with /mqtt when the
+	// server runs the broker
+	mqttAddr, err := mqtt.BrokerURL(mqttURL, user, password)
+	if err != nil {
+		return Agent{}, fmt.Errorf("CLOUDMQTT_URL: %s", err)
 	}
-	domain := urlSplit[1]
 
-	mqttAddr := fmt.Sprintf("mqtt://%s:%s@%s", user, password, domain)
+	qos, err := mqtt.ParseQoS(envVars["MQTT_QOS"])
+	if err != nil {
+		return Agent{}, fmt.Errorf("parsing MQTT_QOS: %s", err)
+	}
 
-	client := mqtt.NewMQTTClient(mqttAddr, func(client mqttC.Client) {
+	client := mqtt.NewMQTTClient(mqttAddr, mqtt.Options{ClientID: clientID, QoS: qos}, func(client mqttC.Client) {
 		logger.Info("Connected to MQTT server")
 	}, func(client mqttC.Client, err error) {
-		logger.Fatalf("Connection to MQTT server lost: %s", err)
+		logger.Errorf("Connection to MQTT server lost, reconnecting: %s", err)
 	})
 
 	return Agent{
-		MqttClient:   client,
-		GHApiToken:   ghApiToken,
-		HerokuAPIKey: herokuAPIKey,
-		HerokuApp:    herokuApp,
+		Transport:           client,
+		ArtifactCredentials: artifacts.Credentials(envVars),
+		Platform:            platform.Detect(),
+		mu:                  &sync.RWMutex{},
+		forwarders:          map[string]logForwarder{},
+		Secrets:             provider,
+		HerokuApp:           herokuApp,
 	}, nil
 }
 
+// agentClientID is the MQTT client ID of the update command of a host.
+func agentClientID(host string) string {
+	return fmt.Sprintf("pi-app-deployer-agent-%s", host)
+}
+
 func (a *Agent) handleRepoUpdate(artifact config.Artifact, cfg config.Config) error {
 	logger.Infof("updating manifest %s for repository %s", artifact.ManifestName, artifact.RepoName)
 
-	url, err := github.GetDownloadURLWithRetries(artifact, false)
+	artifact, err := a.resolveArtifact(artifact, cfg, false)
 	if err != nil {
 		return err
 	}
-	artifact.ArchiveDownloadURL = url
 	_, err = a.installOrUpdateApp(artifact, cfg)
 	if err != nil {
 		return err
@@ -90,15 +121,18 @@ func (a *Agent) handleRepoUpdate(artifact config.Artifact, cfg config.Config) er
 }
 
 func (a *Agent) handleDeployerAgentUpdate(artifact config.Artifact) error {
-	url, err := github.GetDownloadURLWithRetries(artifact, false)
+	// the agent itself is always published as a workflow artifact
+	src := artifacts.ActionsSource{APIURL: a.GithubAPIURL, GHApiToken: a.ArtifactCredentials[artifacts.GHApiTokenKey]}
+	artifact, err := src.Resolve(artifact, false)
 	if err != nil {
 		return fmt.Errorf("getting download url: %s", err)
 	}
-	artifact.ArchiveDownloadURL = url
 
-	dlDir := "/tmp/pi-app-deployer"
+	dlDir := a.Host.Path("/tmp/pi-app-deployer")
 
-	err = file.DownloadExtract(artifact.ArchiveDownloadURL, dlDir, a.GHApiToken)
+	err = src.Download(artifact, dlDir, file.DownloadOptions{
+		Verify: artifacts.Verifier(artifact.Integrity, nil),
+	})
 	if err != nil {
 		return fmt.Errorf("downloading and extracting pi-app-deployer-agent artifact: %s", err)
 	}
@@ -108,14 +142,14 @@ func (a *Agent) handleDeployerAgentUpdate(artifact config.Artifact) error {
 		return fmt.Errorf("rendering deployer template: %s", err)
 	}
 
-	deployerServiceFileOutputPath := "/tmp/pi-app-deployer-agent.service"
+	deployerServiceFileOutputPath := a.Host.Path("/tmp/pi-app-deployer-agent.service")
 	err = os.WriteFile(deployerServiceFileOutputPath, []byte(deployerFile), 0644)
 	if err != nil {
 		return fmt.Errorf("writing deployer service file: %s", err)
 	}
 
-	err = file.CopyWithOwnership(map[string]string{
-		deployerServiceFileOutputPath: "/etc/systemd/system/pi-app-deployer-agent.service",
+	err = a.Host.CopyWithOwnership(map[string]string{
+		deployerServiceFileOutputPath: a.Host.UnitFile("pi-app-deployer-agent"),
 	})
 	if err != nil {
 		return fmt.Errorf("copying deployer systemd unit file: %s", err)
@@ -125,11 +159,11 @@ func (a *Agent) handleDeployerAgentUpdate(artifact config.Artifact) error {
 		return fmt.Errorf("making pi-app-deployer-agent executable: %s", err)
 	}
 
-	if err := file.MoveFile(fmt.Sprintf("%s/pi-app-deployer-agent", dlDir), fmt.Sprintf("%s/pi-app-deployer-agent", config.PiAppDeployerDir)); err != nil {
+	if err := file.MoveFile(fmt.Sprintf("%s/pi-app-deployer-agent", dlDir), fmt.Sprintf("%s/pi-app-deployer-agent", a.Host.AppDir())); err != nil {
 		return fmt.Errorf("moving pi-app-deployer-agent: %s", err)
 	}
 
-	err = file.DaemonReload()
+	err = a.Host.DaemonReload()
 	if err != nil {
 		return fmt.Errorf("running daemon-reload: %s", err)
 	}
@@ -139,14 +173,18 @@ func (a *Agent) handleDeployerAgentUpdate(artifact config.Artifact) error {
 		return fmt.Errorf("removing tmp download directory: %s", err)
 	}
 
-	if err := os.WriteFile(fmt.Sprintf("%s/%s", config.PiAppDeployerDir, ".update-in-progress"), []byte("true"), 0644); err != nil {
+	// the push is not acknowledged before the restart, the command ID
+	// lets the next process ignore it when the broker delivers it again
+	// and the SHA is reported as the version it succeeded with
+	progress := fmt.Sprintf("%s %s", artifact.CommandID, artifact.SHA)
+	if err := os.WriteFile(fmt.Sprintf("%s/%s", a.Host.AppDir(), ".update-in-progress"), []byte(progress), 0644); err != nil {
 		return fmt.Errorf("writing in progress file: %s", err)
 	}
 
 	// this restarts the currently running process. no code
 	// will execute after this is run.
 	logger.Info("Restarting systemd unit now")
-	err = file.RestartSystemdUnit("pi-app-deployer-agent")
+	err = a.Host.RestartSystemdUnit("pi-app-deployer-agent")
 	if err != nil {
 		return fmt.Errorf("restarting pi-app-deployer-agent systemd unit: %s", err)
 	}
@@ -155,18 +193,16 @@ func (a *Agent) handleDeployerAgentUpdate(artifact config.Artifact) error {
 }
 
 func (a *Agent) handleInstall(artifact config.Artifact, cfg config.Config) (config.Config, error) {
-	err := file.WriteDeployerEnvFile(a.HerokuAPIKey)
+	err := a.Host.WriteDeployerEnvFile(a.Secrets.Env())
 	if err != nil {
 		return cfg, fmt.Errorf("writing deployer env file: %s", err)
 	}
-	url, err := github.GetDownloadURLWithRetries(artifact, true)
+	// install the latest artifact unless a release version was requested
+	artifact, err = a.resolveArtifact(artifact, cfg, artifact.Version == "")
 	if err != nil {
 		return cfg, fmt.Errorf("getting download url for latest release: %s", err)
 	}
 
-	artifact.SHA = "HEAD"
-	artifact.ArchiveDownloadURL = url
-
 	cfg, err = a.installOrUpdateApp(artifact, cfg)
 	if err != nil {
 		return cfg, err
@@ -175,18 +211,117 @@ func (a *Agent) handleInstall(artifact config.Artifact, cfg config.Config) (conf
 	return cfg, nil
 }
 
+// pinTrustedKeys parses the public keys from the
+// deployer config that app artifacts must be signed with.
+func (a *Agent) pinTrustedKeys(keys []string) error {
+	parsed, err := artifacts.ParsePublicKeys(keys)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.trustedKeys = parsed
+	return nil
+}
+
+// verifier checks artifacts against the keys currently trusted
+func (a *Agent) verifier(i config.Integrity) func(string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return artifacts.Verifier(i, a.trustedKeys)
+}
+
+// resolveArtifact sets the download URL of an artifact
+// using the artifact source configured for the app.
+func (a *Agent) resolveArtifact(artifact config.Artifact, cfg config.Config, latest bool) (config.Artifact, error) {
+	src, err := artifacts.NewSource(cfg.Source, a.ArtifactCredentials, a.Platform, a.GithubAPIURL)
+	if err != nil {
+		return artifact, err
+	}
+	return src.Resolve(artifact, latest)
+}
+
+// getManifest reads a manifest, using the executable
+// built for the platform of this host when one is listed.
+func (a *Agent) getManifest(path, manifestName string) (manifest.Manifest, error) {
+	m, err := manifest.GetManifest(path, manifestName)
+	if err != nil {
+		return m, fmt.Errorf("getting manifest %s: %s", path, err)
+	}
+	_, p, ok := m.ForPlatform(a.Platform.Candidates())
+	if ok && p.Executable != "" {
+		m.Executable = p.Executable
+	}
+	return m, nil
+}
+
+// downloadPlatformArtifact replaces the downloaded artifact with the
+// artifact the manifest lists for the platform of this host.
+func (a *Agent) downloadPlatformArtifact(src artifacts.Source, artifact config.Artifact, platformName, artifactName, dlDir, binaryName string) (config.Artifact, error) {
+	logger.Infof("downloading artifact %s built for platform %s", artifactName, platformName)
+	artifact.Name = artifactName
+	artifact.ArchiveDownloadURL = ""
+	artifact.Integrity = artifact.Platforms[platformName]
+
+	artifact, err := src.Resolve(artifact, false)
+	if err != nil {
+		return artifact, fmt.Errorf("getting download url for platform artifact: %s", err)
+	}
+
+	err = src.Download(artifact, dlDir, file.DownloadOptions{
+		BinaryName: binaryName,
+		Verify:     a.verifier(artifact.Integrity),
+	})
+	if err != nil {
+		return artifact, fmt.Errorf("downloading and extracting platform artifact: %s", err)
+	}
+	return artifact, nil
+}
+
 func (a *Agent) installOrUpdateApp(artifact config.Artifact, cfg config.Config) (config.Config, error) {
-	dlDir := getDownloadDir(artifact)
-	err := file.DownloadExtract(artifact.ArchiveDownloadURL, dlDir, a.GHApiToken)
+	src, err := artifacts.NewSource(cfg.Source, a.ArtifactCredentials, a.Platform, a.GithubAPIURL)
+	if err != nil {
+		return cfg, err
+	}
+
+	dlDir := getDownloadDir(a.Host, artifact)
+	// the download is not needed once the app is replaced or
+	// rolled back, nor when it fails
+	defer os.RemoveAll(dlDir)
+	manifestFile := fmt.Sprintf("%s/.pi-app-deployer.yaml", dlDir)
+	binaryName := ""
+	if cfg.Source.ManifestFile != "" {
+		// single binary artifacts are described by a manifest kept on the host
+		manifestFile = cfg.Source.ManifestFile
+		m, err := a.getManifest(manifestFile, artifact.ManifestName)
+		if err != nil {
+			return cfg, err
+		}
+		binaryName = m.Executable
+	}
+
+	err = src.Download(artifact, dlDir, file.DownloadOptions{
+		BinaryName: binaryName,
+		Verify:     a.verifier(artifact.Integrity),
+	})
 	if err != nil {
 		return cfg, fmt.Errorf("downloading and extracting artifact: %s", err)
 	}
 
-	m, err := manifest.GetManifest(fmt.Sprintf("%s/.pi-app-deployer.yaml", dlDir), artifact.ManifestName)
+	m, err := a.getManifest(manifestFile, artifact.ManifestName)
 	if err != nil {
-		return cfg, fmt.Errorf("getting manifest from directory %s: %s", dlDir, err)
+		return cfg, err
+	}
+
+	platformName, p, ok := m.ForPlatform(a.Platform.Candidates())
+	if ok && p.Artifact != "" && p.Artifact != artifact.Name {
+		artifact, err = a.downloadPlatformArtifact(src, artifact, platformName, p.Artifact, dlDir, m.Executable)
+		if err != nil {
+			return cfg, err
+		}
 	}
 
+	previousExecutable := cfg.Executable
 	cfg.Executable = m.Executable
 
 	err = config.ValidateEnvVars(m, cfg)
@@ -194,29 +329,47 @@ func (a *Agent) installOrUpdateApp(artifact config.Artifact, cfg config.Config)
 		return cfg, fmt.Errorf("validating manifest and config env vars: %s", err)
 	}
 
-	err = file.WriteServiceEnvFile(m, a.HerokuAPIKey, artifact.SHA, cfg, "")
+	snapshot, err := a.Host.CreateSnapshot(m.Name, previousExecutable)
 	if err != nil {
-		return cfg, fmt.Errorf("writing service file environment file: %s", err)
+		return cfg, fmt.Errorf("creating snapshot of installed app: %s", err)
 	}
 
-	serviceUnit, err := file.EvalServiceTemplate(m, cfg.AppUser)
+	err = a.replaceApp(m, manifestFile, artifact, cfg, dlDir)
+	if err == nil {
+		err = verifyHealth(a.Host, m)
+	}
 	if err != nil {
-		return cfg, fmt.Errorf("rendering service template: %s", err)
+		if snapshot.Empty() {
+			return cfg, err
+		}
+		cfg.Executable = previousExecutable
+		return cfg, rollbackApp(a.Host, snapshot, err)
 	}
+	return cfg, nil
+}
 
-	runScript, err := file.EvalRunScriptTemplate(m, artifact.SHA)
+// replaceApp renders the app files and swaps them in place of
+// the installed ones. Any error leaves the app in an unknown
+// state and should be followed by a rollback.
+func (a *Agent) replaceApp(m manifest.Manifest, manifestFile string, artifact config.Artifact, cfg config.Config, dlDir string) error {
+	err := a.Host.WriteServiceEnvFile(m, a.Secrets.Env(), artifact.SHA, cfg, "")
 	if err != nil {
-		return cfg, fmt.Errorf("rendering runscript template: %s", err)
+		return fmt.Errorf("writing service file environment file: %s", err)
+	}
+
+	serviceUnit, err := file.EvalServiceTemplate(m, cfg.AppUser)
+	if err != nil {
+		return fmt.Errorf("rendering service template: %s", err)
 	}
 
 	deployerFile, err := file.EvalDeployerTemplate(a.HerokuApp)
 	if err != nil {
-		return cfg, fmt.Errorf("rendering deployer template: %s", err)
+		return fmt.Errorf("rendering deployer template: %s", err)
 	}
 
-	for _, t := range []string{serviceUnit, runScript, deployerFile} {
+	for _, t := range []string{serviceUnit, deployerFile} {
 		if t == "" {
-			return cfg, fmt.Errorf("one of the templates rendered was empty")
+			return fmt.Errorf("one of the templates rendered was empty")
 		}
 	}
 
@@ -224,128 +377,272 @@ func (a *Agent) installOrUpdateApp(artifact config.Artifact, cfg config.Config)
 	serviceFileOutputPath := fmt.Sprintf("%s/%s", dlDir, serviceFile)
 	err = os.WriteFile(serviceFileOutputPath, []byte(serviceUnit), 0644)
 	if err != nil {
-		return cfg, fmt.Errorf("writing service file: %s", err)
-	}
-
-	runScriptFile := fmt.Sprintf("run-%s.sh", m.Name)
-	runScriptOutputPath := fmt.Sprintf("%s/%s", dlDir, runScriptFile)
-	err = os.WriteFile(runScriptOutputPath, []byte(runScript), 0644)
-	if err != nil {
-		return cfg, fmt.Errorf("writing run script: %s", err)
+		return fmt.Errorf("writing service file: %s", err)
 	}
 
 	deployerServiceFileOutputPath := fmt.Sprintf("%s/%s", dlDir, "pi-app-deployer-agent.service")
 	err = os.WriteFile(deployerServiceFileOutputPath, []byte(deployerFile), 0644)
 	if err != nil {
-		return cfg, fmt.Errorf("writing deployer service file: %s", err)
+		return fmt.Errorf("writing deployer service file: %s", err)
 	}
 
-	err = file.StopSystemdUnit(m.Name)
+	err = a.Host.StopSystemdUnit(m.Name)
 	if err != nil {
-		return cfg, err
+		return err
 	}
 
 	// Don't overwrite agent systemd unit if already exists
-	if _, err := os.Stat("/etc/systemd/system/pi-app-deployer-agent.service"); errors.Is(err, os.ErrNotExist) {
-		err = file.CopyWithOwnership(map[string]string{
-			deployerServiceFileOutputPath: "/etc/systemd/system/pi-app-deployer-agent.service",
+	if _, err := os.Stat(a.Host.UnitFile("pi-app-deployer-agent")); errors.Is(err, os.ErrNotExist) {
+		err = a.Host.CopyWithOwnership(map[string]string{
+			deployerServiceFileOutputPath: a.Host.UnitFile("pi-app-deployer-agent"),
 		})
 		if err != nil {
-			return cfg, err
+			return err
 		}
 	}
 
 	tmpBinarypath := fmt.Sprintf("%s/%s", dlDir, m.Executable)
-	packageBinaryOutputPath := fmt.Sprintf("%s/%s", config.PiAppDeployerDir, m.Executable)
+	packageBinaryOutputPath := fmt.Sprintf("%s/%s", a.Host.AppDir(), m.Executable)
 
 	var srcDestMap = map[string]string{
-		serviceFileOutputPath: fmt.Sprintf("/etc/systemd/system/%s.service", m.Name),
-		runScriptOutputPath:   fmt.Sprintf("%s/%s", config.PiAppDeployerDir, runScriptFile),
+		serviceFileOutputPath: a.Host.UnitFile(m.Name),
 		tmpBinarypath:         packageBinaryOutputPath,
 	}
+	// a manifest kept on the host may already be the installed copy
+	if manifestFile != a.Host.InstalledManifestFile(m.Name) {
+		srcDestMap[manifestFile] = a.Host.InstalledManifestFile(m.Name)
+	}
 
-	err = file.CopyWithOwnership(srcDestMap)
+	err = a.Host.CopyWithOwnership(srcDestMap)
 	if err != nil {
-		return cfg, err
+		return err
 	}
 
-	err = file.MakeExecutable([]string{fmt.Sprintf("%s/%s", config.PiAppDeployerDir, runScriptFile), packageBinaryOutputPath})
+	err = file.MakeExecutable([]string{packageBinaryOutputPath})
 	if err != nil {
-		return cfg, err
+		return err
 	}
 
-	err = file.SetupSystemdUnits(m.Name)
+	// the unit runs the agent exec command instead of the run
+	// script written by previous versions of the agent
+	runScript := fmt.Sprintf("%s/run-%s.sh", a.Host.AppDir(), m.Name)
+	if err := os.Remove(runScript); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing run script: %s", err)
+	}
+
+	err = a.Host.MakeOwnedDir(secrets.CacheDir(a.Host.AppDir(), m.Name), cfg.AppUser)
 	if err != nil {
-		return cfg, err
+		return err
 	}
 
-	err = os.RemoveAll(dlDir)
+	return a.Host.SetupSystemdUnits(m.Name)
+}
+
+// HealthCheckError is returned when an app was updated
+// but did not pass the health check declared in its manifest.
+type HealthCheckError struct {
+	Err error
+}
+
+func (e *HealthCheckError) Error() string {
+	return fmt.Sprintf("health check failed: %s", e.Err)
+}
+
+func (e *HealthCheckError) Unwrap() error {
+	return e.Err
+}
+
+func verifyHealth(h file.Host, m manifest.Manifest) error {
+	logger.Infof("verifying health of %s", m.Name)
+	err := health.Verify(h, m.Name, m.HealthCheck)
 	if err != nil {
-		return cfg, fmt.Errorf("%s", err)
+		return &HealthCheckError{Err: err}
 	}
-	return cfg, nil
+	return nil
 }
 
-func unInstall(c map[string]config.Config, repoName, manifestName string) error {
-	for _, v := range c {
-		if v.RepoName == repoName && v.ManifestName == manifestName {
-			err := file.StopSystemdUnit(v.ManifestName)
-			if err != nil {
-				return fmt.Errorf("stopping systemd unit %s: %s", v.ManifestName, err)
-			}
+// RollbackError is returned when an update failed and the
+// previously installed version of the app was restored.
+type RollbackError struct {
+	Err error
+	SHA string
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%s, rolled back to previous version %s", e.Err, e.SHA)
+}
 
-			svcFile := fmt.Sprintf("/etc/systemd/system/%s.service", v.ManifestName)
-			err = os.Remove(svcFile)
-			if err != nil {
-				return fmt.Errorf("removing systemd unit file %s: %s", svcFile, err)
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+func rollbackApp(h file.Host, snapshot file.Snapshot, updateErr error) error {
+	logger.Errorf("update of %s failed, rolling back to %s: %s", snapshot.ManifestName, snapshot.SHA, updateErr)
+
+	err := restoreSnapshot(h, snapshot)
+	if err != nil {
+		return fmt.Errorf("%s, rollback to previous version %s also failed: %s", updateErr, snapshot.SHA, err)
+	}
+
+	return &RollbackError{
+		Err: updateErr,
+		SHA: snapshot.SHA,
+	}
+}
+
+func restoreSnapshot(h file.Host, snapshot file.Snapshot) error {
+	err := h.StopSystemdUnit(snapshot.ManifestName)
+	if err != nil {
+		return err
+	}
+
+	err = h.RestoreSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = h.DaemonReload()
+	if err != nil {
+		return err
+	}
+
+	return h.StartSystemdUnit(snapshot.ManifestName)
+}
+
+// handleRollback reinstalls a previous version of an app, returning
+// the SHA that is now running. A version kept in a local snapshot
+// is preferred, otherwise the artifact is downloaded again.
+func (a *Agent) handleRollback(p config.RollbackPayload, cfg config.Config) (config.Config, string, error) {
+	installedSHA, err := a.Host.ReadAppVersion(cfg.ManifestName)
+	if err != nil {
+		return cfg, "", fmt.Errorf("reading installed app version: %s", err)
+	}
+
+	sha := p.SHA
+	if sha == "" {
+		snapshots, err := a.Host.ListSnapshots(cfg.ManifestName)
+		if err != nil {
+			return cfg, "", fmt.Errorf("listing snapshots: %s", err)
+		}
+		for _, s := range snapshots {
+			if s.SHA != installedSHA {
+				sha = s.SHA
+				break
 			}
 		}
+		if sha == "" {
+			return cfg, "", fmt.Errorf("no previous version of %s is kept on this host, a SHA is required", cfg.ManifestName)
+		}
+	}
+
+	if sha == installedSHA {
+		return cfg, "", fmt.Errorf("%s is already running version %s", cfg.ManifestName, sha)
+	}
+
+	snapshot, err := a.Host.FindSnapshot(cfg.ManifestName, sha)
+	if err == nil {
+		// keep the version being replaced so it can be restored again
+		_, err = a.Host.CreateSnapshot(cfg.ManifestName, cfg.Executable)
+		if err != nil {
+			return cfg, "", fmt.Errorf("creating snapshot of installed app: %s", err)
+		}
+
+		logger.Infof("restoring %s to version %s kept on this host", cfg.ManifestName, sha)
+		err = restoreSnapshot(a.Host, snapshot)
+		if err != nil {
+			return cfg, "", fmt.Errorf("restoring snapshot %s: %s", sha, err)
+		}
+		return cfg, sha, nil
+	}
+
+	logger.Infof("version %s of %s not kept on this host, downloading artifact", sha, cfg.ManifestName)
+	artifact := config.Artifact{
+		RepoName:     cfg.RepoName,
+		ManifestName: cfg.ManifestName,
+		SHA:          sha,
+		Name:         p.ArtifactName,
+		Integrity:    p.Integrity,
+	}
+	artifact, err = a.resolveArtifact(artifact, cfg, false)
+	if err != nil {
+		return cfg, "", err
+	}
+
+	cfg, err = a.installOrUpdateApp(artifact, cfg)
+	if err != nil {
+		return cfg, "", err
+	}
+	return cfg, sha, nil
+}
+
+func unInstall(h file.Host, c map[string]config.Config, repoName, manifestName string) error {
+	for _, v := range c {
+		if v.RepoName != repoName || v.ManifestName != manifestName {
+			continue
+		}
+
+		err := h.StopSystemdUnit(v.ManifestName)
+		if err != nil {
+			return fmt.Errorf("stopping systemd unit %s: %s", v.ManifestName, err)
+		}
+
+		svcFile := h.UnitFile(v.ManifestName)
+		err = os.Remove(svcFile)
+		if err != nil {
+			return fmt.Errorf("removing systemd unit file %s: %s", svcFile, err)
+		}
 
 		toDelete := []string{
-			fmt.Sprintf("%s/%s", config.PiAppDeployerDir, v.Executable),
-			fmt.Sprintf("%s/.%s.env", config.PiAppDeployerDir, v.ManifestName),
-			fmt.Sprintf("%s/run-%s.sh", config.PiAppDeployerDir, v.ManifestName),
+			fmt.Sprintf("%s/%s", h.AppDir(), v.Executable),
+			fmt.Sprintf("%s/.%s.env", h.AppDir(), v.ManifestName),
+			fmt.Sprintf("%s/run-%s.sh", h.AppDir(), v.ManifestName),
+			h.InstalledManifestFile(v.ManifestName),
 		}
 		for _, f := range toDelete {
 			err := os.Remove(f)
-			if err != nil {
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
 				return fmt.Errorf("removing file %s: %s", f, err)
 			}
 		}
+
+		err = os.RemoveAll(secrets.CacheDir(h.AppDir(), v.ManifestName))
+		if err != nil {
+			return fmt.Errorf("removing secrets cache: %s", err)
+		}
 	}
 
-	err := file.DaemonReload()
+	// the running agent reloads the deployer config once the
+	// app is removed from it, there is no need to restart it
+	err := h.DaemonReload()
 	if err != nil {
 		return fmt.Errorf("running daemon-reload: %s", err)
 	}
+	return nil
+}
 
-	err = file.RestartSystemdUnit("pi-app-deployer-agent")
+// unInstallAll removes every app and the files of the agent. The
+// agent is stopped first, it would otherwise reload the deployer
+// config and reinstall apps while their files are deleted.
+func unInstallAll(h file.Host, c map[string]config.Config) error {
+	err := h.StopSystemdUnit("pi-app-deployer-agent")
 	if err != nil {
-		return fmt.Errorf("restarting pi-app-deployer-agent systemd unit: %s", err)
+		return fmt.Errorf("stopping pi-app-deployer-agent systemd unit: %s", err)
 	}
-	return nil
-}
 
-func unInstallAll(c map[string]config.Config) error {
 	for _, v := range c {
-		err := file.StopSystemdUnit(v.ManifestName)
+		err := h.StopSystemdUnit(v.ManifestName)
 		if err != nil {
 			return fmt.Errorf("stopping systemd unit %s: %s", v.ManifestName, err)
 		}
 
-		svcFile := fmt.Sprintf("/etc/systemd/system/%s.service", v.ManifestName)
+		svcFile := h.UnitFile(v.ManifestName)
 		err = os.Remove(svcFile)
 		if err != nil {
 			return fmt.Errorf("removing systemd unit file %s: %s", svcFile, err)
 		}
 	}
 
-	err := file.StopSystemdUnit("pi-app-deployer")
-	if err != nil {
-		return fmt.Errorf("stopping pi-app-deployer systemd unit: %s", err)
-	}
-
-	err = os.RemoveAll(config.PiAppDeployerDir)
+	err = os.RemoveAll(h.AppDir())
 	if err != nil {
 		return fmt.Errorf("removing all pi-app-deployer files: %s", err)
 	}
@@ -353,25 +650,84 @@ func unInstallAll(c map[string]config.Config) error {
 	return nil
 }
 
-func (a *Agent) startLogForwarder(deplerConfig config.DeployerConfig, host string, f func(config.Log)) {
-	for _, cfg := range deplerConfig.AppConfigs {
+// maxLogForwarderBackoff caps the wait before tailing
+// the logs of an app again after journalctl failed.
+const maxLogForwarderBackoff = time.Minute
+
+type logForwarder struct {
+	cfg    config.Config
+	cancel context.CancelFunc
+}
+
+// syncLogForwarders starts forwarding the logs of apps with log
+// forwarding enabled and stops forwarders no longer configured.
+// Forwarders of apps whose config changed are restarted.
+func (a *Agent) syncLogForwarders(deployerConfig config.DeployerConfig, host string, f func(config.Log)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	wanted := map[string]config.Config{}
+	for k, cfg := range deployerConfig.AppConfigs {
 		if cfg.LogForwarding {
-			go func(n config.Config) {
-				logChannel := make(chan file.Syslog)
-				go file.TailSystemdLogs(n.ManifestName, logChannel)
-				for log := range logChannel {
-					if log.Error != nil {
-						logger.Errorw(fmt.Sprintf("error receiving logs from journalctl channel: %s", log.Error))
-						break
-					}
-
-					f(config.Log{
-						Message: log.Message,
-						Config:  n,
-						Host:    host,
-					})
-				}
-			}(cfg)
+			wanted[k] = cfg
+		}
+	}
+
+	for k, fw := range a.forwarders {
+		if cfg, ok := wanted[k]; !ok || !reflect.DeepEqual(cfg, fw.cfg) {
+			logger.Infof("stopping log forwarder for %s", k)
+			fw.cancel()
+			delete(a.forwarders, k)
+		}
+	}
+
+	for k, cfg := range wanted {
+		if _, ok := a.forwarders[k]; ok {
+			continue
+		}
+		logger.Infof("starting log forwarder for %s", k)
+		ctx, cancel := context.WithCancel(context.Background())
+		a.forwarders[k] = logForwarder{cfg: cfg, cancel: cancel}
+		go forwardLogs(ctx, cfg, host, f)
+	}
+}
+
+// forwardLogs tails the logs of an app until ctx is done, the
+// forwarder stays in the agent so it is restarted when it fails.
+func forwardLogs(ctx context.Context, cfg config.Config, host string, f func(config.Log)) {
+	backoff := time.Second
+	for {
+		tailCtx, cancel := context.WithCancel(ctx)
+		logChannel := make(chan file.Syslog)
+		go file.TailSystemdLogs(tailCtx, cfg.ManifestName, logChannel)
+		received := false
+		for log := range logChannel {
+			if log.Error != nil {
+				logger.Errorw(fmt.Sprintf("error receiving logs from journalctl channel: %s", log.Error))
+				break
+			}
+			received = true
+
+			f(config.Log{
+				Message: log.Message,
+				Config:  cfg,
+				Host:    host,
+			})
+		}
+		cancel()
+
+		if received {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		logger.Infof("restarting log forwarder for %s", appKey(cfg.RepoName, cfg.ManifestName))
+		backoff *= 2
+		if backoff > maxLogForwarderBackoff {
+			backoff = maxLogForwarderBackoff
 		}
 	}
 }
@@ -382,21 +738,27 @@ func (a *Agent) publishUpdateCondition(c status.UpdateCondition) error {
 		return fmt.Errorf("marshalling update condition message: %s", err)
 	}
 
-	err = a.MqttClient.Publish(config.RepoPushStatusTopic, string(json))
+	err = a.Transport.Publish(config.RepoPushStatusTopic, string(json))
 	if err != nil {
 		return fmt.Errorf("publishing update condition message: %s", err)
 	}
 	return nil
 }
 
-func (a *Agent) publishAgentInventory(m map[string]config.Config, host string, timestamp int64, transient bool) error {
+func (a *Agent) publishAgentInventory(m map[string]config.Config, labels map[string]string, host string, timestamp int64, transient bool) error {
 	for _, v := range m {
+		// an app being installed has no version yet
+		sha, _ := a.Host.ReadAppVersion(v.ManifestName)
 		p := config.AgentInventoryPayload{
 			RepoName:     v.RepoName,
 			ManifestName: v.ManifestName,
 			Host:         host,
 			Timestamp:    timestamp,
 			Transient:    transient,
+			Labels:       labels,
+			Platform:     a.Platform.String(),
+			SHA:          sha,
+			AgentVersion: version,
 		}
 
 		j, err := json.Marshal(p)
@@ -404,7 +766,7 @@ func (a *Agent) publishAgentInventory(m map[string]config.Config, host string, t
 			return fmt.Errorf("marshalling agent inventory payload: %s", err)
 		}
 
-		err = a.MqttClient.Publish(config.AgentInventoryTopic, string(j))
+		err = a.Transport.Publish(config.AgentInventoryTopic, string(j))
 		if err != nil {
 			return fmt.Errorf("publishing agent inventory message: %s", err)
 		}
@@ -416,6 +778,10 @@ func (a *Agent) publishAgentInventory(m map[string]config.Config, host string, t
 		Host:         host,
 		Timestamp:    timestamp,
 		Transient:    transient,
+		Labels:       labels,
+		Platform:     a.Platform.String(),
+		SHA:          version,
+		AgentVersion: version,
 	}
 
 	j, err := json.Marshal(p)
@@ -423,7 +789,7 @@ func (a *Agent) publishAgentInventory(m map[string]config.Config, host string, t
 		return fmt.Errorf("marshalling agent inventory payload: %s", err)
 	}
 
-	err = a.MqttClient.Publish(config.AgentInventoryTopic, string(j))
+	err = a.Transport.Publish(config.AgentInventoryTopic, string(j))
 	if err != nil {
 		return fmt.Errorf("publishing agent inventory message: %s", err)
 	}
@@ -431,6 +797,6 @@ func (a *Agent) publishAgentInventory(m map[string]config.Config, host string, t
 	return nil
 }
 
-func getDownloadDir(a config.Artifact) string {
-	return fmt.Sprintf("/tmp/%s", strings.ReplaceAll(a.RepoName, "/", "_"))
+func getDownloadDir(h file.Host, a config.Artifact) string {
+	return h.Path(fmt.Sprintf("/tmp/%s", strings.ReplaceAll(a.RepoName, "/", "_")))
 }
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
+)
+
+// installedFiles returns the files kept on the host for an app.
+func installedFiles(h file.Host, cfg config.Config) []string {
+	return []string{
+		h.UnitFile(cfg.ManifestName),
+		filepath.Join(h.AppDir(), cfg.Executable),
+		filepath.Join(h.AppDir(), fmt.Sprintf(".%s.env", cfg.ManifestName)),
+		h.InstalledManifestFile(cfg.ManifestName),
+		filepath.Join(secrets.CacheDir(h.AppDir(), cfg.ManifestName), "secrets.json"),
+	}
+}
+
+func Test_UnInstallKeepsOtherApps(t *testing.T) {
+	h := file.Host{
+		Root:      t.TempDir(),
+		Systemctl: func(args ...string) (string, error) { return "", nil },
+	}
+
+	apps := map[string]config.Config{}
+	for _, name := range []string{"app-a", "app-b"} {
+		cfg := config.Config{RepoName: "andrewmarklloyd/" + name, ManifestName: name, Executable: name}
+		apps[name] = cfg
+		for _, f := range installedFiles(h, cfg) {
+			assert.NoError(t, os.MkdirAll(filepath.Dir(f), 0755))
+			assert.NoError(t, os.WriteFile(f, []byte(name), 0644))
+		}
+	}
+
+	err := unInstall(h, apps, "andrewmarklloyd/app-a", "app-a")
+	assert.NoError(t, err)
+
+	for _, f := range installedFiles(h, apps["app-a"]) {
+		assert.NoFileExists(t, f)
+	}
+	for _, f := range installedFiles(h, apps["app-b"]) {
+		assert.FileExists(t, f)
+	}
+}
+
+func Test_ForwardLogsRestartsJournalctl(t *testing.T) {
+	// journalctl exits after each line, like when it is killed
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho '{\"SYSLOG_IDENTIFIER\":\"app-a\",\"MESSAGE\":\"started\"}'\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(bin, "journalctl"), []byte(script), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logs := make(chan config.Log, 10)
+	cfg := config.Config{RepoName: "andrewmarklloyd/app-a", ManifestName: "app-a"}
+	go forwardLogs(ctx, cfg, "pi-1", func(l config.Log) { logs <- l })
+
+	for i := 0; i < 2; i++ {
+		select {
+		case l := <-logs:
+			assert.Equal(t, "started", l.Message)
+		case <-time.After(5 * time.Second):
+			t.Fatal("logs were not forwarded again")
+		}
+	}
+}
+
+func Test_UnInstallAllStopsAgentFirst(t *testing.T) {
+	calls := []string{}
+	h := file.Host{
+		Root: t.TempDir(),
+		Systemctl: func(args ...string) (string, error) {
+			calls = append(calls, strings.Join(args, " "))
+			return "", nil
+		},
+	}
+
+	cfg := config.Config{RepoName: "andrewmarklloyd/app-a", ManifestName: "app-a", Executable: "app-a"}
+	for _, f := range installedFiles(h, cfg) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(f), 0755))
+		assert.NoError(t, os.WriteFile(f, []byte("app-a"), 0644))
+	}
+
+	err := unInstallAll(h, map[string]config.Config{"app-a": cfg})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stop pi-app-deployer-agent", "stop app-a"}, calls)
+	assert.NoDirExists(t, h.AppDir())
+	assert.NoFileExists(t, h.UnitFile("app-a"))
+}
+
+func Test_InstallOrUpdateAppRemovesDownload(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	h := file.Host{Root: t.TempDir()}
+	assert.NoError(t, os.MkdirAll(h.Path("/tmp"), 0755))
+	a := Agent{Host: h, mu: &sync.RWMutex{}}
+	artifact := config.Artifact{RepoName: "andrewmarklloyd/app-a", ManifestName: "app-a", ArchiveDownloadURL: ts.URL}
+	cfg := config.Config{
+		RepoName:     "andrewmarklloyd/app-a",
+		ManifestName: "app-a",
+		Source:       config.ArtifactSource{Type: config.ArtifactSourceHTTP, URL: ts.URL},
+	}
+
+	_, err := a.installOrUpdateApp(artifact, cfg)
+	assert.Error(t, err)
+	assert.NoDirExists(t, getDownloadDir(h, artifact))
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/manifest"
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
+	"github.com/spf13/cobra"
+)
+
+var configureVarFlags config.EnvVarFlags
+
+// configureCmd represents the configure command
+var configureCmd = &cobra.Command{
+	Use:   "configure",
+	Short: "Use the configure command to change the configuration of an installed application.",
+	Long: `The configure command asks the running update command to
+change the env vars, app user or log forwarding of an installed
+application. The env file and Systemd unit are written again and
+the application is restarted with the same version.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runConfigure(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configureCmd)
+
+	configureCmd.PersistentFlags().String("repoName", "", "Name of the Github repo including the owner")
+	configureCmd.PersistentFlags().String("manifestName", "", "Name of the pi-app-deployer manifest")
+	configureCmd.PersistentFlags().Bool("logForwarding", false, "Send application logs to server")
+	configureCmd.PersistentFlags().String("appUser", "", "Name of user that will run the app service")
+	configureCmd.PersistentFlags().Var(&configureVarFlags, "envVar", "List of non-secret environment variable configuration to change, separated by =, can pass multiple values. Example: --envVar foo=bar --envVar hello=world")
+}
+
+func runConfigure(cmd *cobra.Command, args []string) {
+	req := getAppRequest(cmd)
+	p := config.ConfigurePayload{
+		RepoName:     req.RepoName,
+		ManifestName: req.ManifestName,
+		EnvVars:      configureVarFlags.Map,
+	}
+
+	var err error
+	p.AppUser, err = cmd.Flags().GetString("appUser")
+	if err != nil {
+		logger.Fatalf("error getting appUser flag: %s", err)
+	}
+
+	// only change log forwarding when the flag is passed
+	if cmd.Flags().Changed("logForwarding") {
+		logForwarding, err := cmd.Flags().GetBool("logForwarding")
+		if err != nil {
+			logger.Fatalf("error getting logForwarding flag: %s", err)
+		}
+		p.LogForwarding = &logForwarding
+	}
+
+	if err := p.Validate(); err != nil {
+		logger.Fatalf("error validating flags: %s", err)
+	}
+
+	_, err = control.NewClient(control.SocketPath).Configure(p)
+	if err != nil {
+		logger.Fatalf("Error configuring %s/%s: %s", p.RepoName, p.ManifestName, err)
+	}
+	logger.Infof("Successfully configured %s/%s", p.RepoName, p.ManifestName)
+}
+
+// configureAndReport configures an app and publishes the
+// progress as update conditions.
+func (a *Agent) configureAndReport(p config.ConfigurePayload, cfg config.Config, host string) (config.Config, error) {
+	logger.Infof("configuring repo %s with manifest name %s", cfg.RepoName, cfg.ManifestName)
+	updateCondition := status.UpdateCondition{
+		RepoName:     cfg.RepoName,
+		ManifestName: cfg.ManifestName,
+		Status:       config.StatusInProgress,
+		Host:         host,
+	}
+
+	err := a.publishUpdateCondition(updateCondition)
+	if err != nil {
+		// log but don't block configure from proceeding
+		logger.Errorf("publishing update condition: %s", err)
+	}
+
+	cfg, sha, configureErr := a.configureApp(p, cfg)
+	updateCondition.SHA = sha
+	updateCondition.RunningSHA = sha
+	if configureErr != nil {
+		updateCondition.Status = config.StatusErr
+		updateCondition.Error = configureErr.Error()
+		var healthCheckErr *HealthCheckError
+		if errors.As(configureErr, &healthCheckErr) {
+			updateCondition.Status = config.StatusHealthCheckFailed
+		}
+		var rollbackErr *RollbackError
+		if errors.As(configureErr, &rollbackErr) {
+			updateCondition.RolledBack = true
+		}
+	} else {
+		updateCondition.Status = config.StatusSuccess
+	}
+
+	err = a.publishUpdateCondition(updateCondition)
+	if err != nil {
+		logger.Errorf("publishing update condition: %s", err)
+	}
+
+	return cfg, configureErr
+}
+
+// configureApp writes the env file and unit of an installed app
+// with a changed config and restarts it. The previous files are
+// restored when the app does not pass its health check.
+func (a *Agent) configureApp(p config.ConfigurePayload, cfg config.Config) (config.Config, string, error) {
+	next := p.Apply(cfg)
+
+	manifestFile := a.Host.InstalledManifestFile(cfg.ManifestName)
+	if _, err := os.Stat(manifestFile); errors.Is(err, os.ErrNotExist) {
+		return cfg, "", fmt.Errorf("manifest of %s is not kept on this host, update the app once before configuring it", cfg.ManifestName)
+	}
+	m, err := a.getManifest(manifestFile, cfg.ManifestName)
+	if err != nil {
+		return cfg, "", err
+	}
+
+	err = config.ValidateEnvVars(m, next)
+	if err != nil {
+		return cfg, "", fmt.Errorf("validating manifest and config env vars: %s", err)
+	}
+
+	sha, err := a.Host.ReadAppVersion(m.Name)
+	if err != nil {
+		return cfg, "", fmt.Errorf("reading installed app version: %s", err)
+	}
+
+	snapshot, err := a.Host.CreateSnapshot(m.Name, cfg.Executable)
+	if err != nil {
+		return cfg, sha, fmt.Errorf("creating snapshot of installed app: %s", err)
+	}
+
+	err = a.rewriteApp(m, sha, next)
+	if err == nil {
+		err = verifyHealth(a.Host, m)
+	}
+	if err != nil {
+		return cfg, sha, rollbackApp(a.Host, snapshot, err)
+	}
+	return next, sha, nil
+}
+
+// rewriteApp renders the env file and unit of the installed
+// version of an app and restarts it.
+func (a *Agent) rewriteApp(m manifest.Manifest, sha string, cfg config.Config) error {
+	err := a.Host.WriteServiceEnvFile(m, a.Secrets.Env(), sha, cfg, "")
+	if err != nil {
+		return fmt.Errorf("writing service file environment file: %s", err)
+	}
+
+	serviceUnit, err := file.EvalServiceTemplate(m, cfg.AppUser)
+	if err != nil {
+		return fmt.Errorf("rendering service template: %s", err)
+	}
+	if serviceUnit == "" {
+		return fmt.Errorf("the service template rendered was empty")
+	}
+
+	err = os.WriteFile(a.Host.UnitFile(m.Name), []byte(serviceUnit), 0644)
+	if err != nil {
+		return fmt.Errorf("writing service file: %s", err)
+	}
+
+	err = a.Host.MakeOwnedDir(secrets.CacheDir(a.Host.AppDir(), m.Name), cfg.AppUser)
+	if err != nil {
+		return err
+	}
+
+	err = a.Host.DaemonReload()
+	if err != nil {
+		return err
+	}
+
+	return a.Host.RestartSystemdUnit(m.Name)
+}
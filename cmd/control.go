@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+)
+
+// controller runs the requests received on the control socket
+// by the update daemon, which owns the deployer config.
+type controller struct {
+	agent      *Agent
+	live       *liveConfig
+	configFile string
+	herokuApp  string
+	host       string
+	forwardLog func(config.Log)
+	rc         *reconciler
+}
+
+func (c *controller) Install(req control.InstallRequest) (config.Config, error) {
+	deployerConfig, err := config.NewDeployerConfig(c.configFile, c.herokuApp)
+	if err != nil {
+		return req.Config, fmt.Errorf("getting deployer config: %s", err)
+	}
+
+	logger.Infof("installing repo %s with manifest name %s", req.Config.RepoName, req.Config.ManifestName)
+	cfg, err := c.agent.installApp(&deployerConfig, req)
+	if err != nil {
+		return cfg, err
+	}
+	c.apply(deployerConfig)
+	return cfg, nil
+}
+
+func (c *controller) Uninstall(req control.AppRequest) error {
+	deployerConfig, err := config.NewDeployerConfig(c.configFile, c.herokuApp)
+	if err != nil {
+		return fmt.Errorf("getting deployer config: %s", err)
+	}
+
+	logger.Infof("uninstalling repo %s with manifest name %s", req.RepoName, req.ManifestName)
+	err = uninstallApp(c.agent.Host, &deployerConfig, req)
+	if err != nil {
+		return err
+	}
+	c.apply(deployerConfig)
+	return nil
+}
+
+func (c *controller) Restart(req control.AppRequest) error {
+	cfg, err := c.getAppConfig(req)
+	if err != nil {
+		return err
+	}
+	logger.Infof("restarting repo %s with manifest name %s", cfg.RepoName, cfg.ManifestName)
+	return c.agent.Host.RestartSystemdUnit(cfg.ManifestName)
+}
+
+func (c *controller) Configure(p config.ConfigurePayload) (config.Config, error) {
+	deployerConfig, err := config.NewDeployerConfig(c.configFile, c.herokuApp)
+	if err != nil {
+		return config.Config{}, fmt.Errorf("getting deployer config: %s", err)
+	}
+
+	cfg, ok := deployerConfig.GetAppConfig(config.Config{
+		RepoName:     p.RepoName,
+		ManifestName: p.ManifestName,
+	})
+	if !ok {
+		return cfg, fmt.Errorf("app %s/%s is not installed", p.RepoName, p.ManifestName)
+	}
+
+	cfg, err = c.agent.configureAndReport(p, cfg, c.host)
+	if err != nil {
+		return cfg, err
+	}
+
+	deployerConfig.SetAppConfig(cfg)
+	err = deployerConfig.WriteDeployerConfig()
+	if err != nil {
+		return cfg, fmt.Errorf("writing deployer config: %s", err)
+	}
+	c.apply(deployerConfig)
+	return cfg, nil
+}
+
+func (c *controller) Status() ([]control.AppStatus, error) {
+	return appStatuses(c.agent.Host, c.live.Get().AppConfigs)
+}
+
+func (c *controller) Logs(ctx context.Context, req control.LogsRequest, w io.Writer) error {
+	cfg, err := c.getAppConfig(req.AppRequest)
+	if err != nil {
+		return err
+	}
+	return file.WriteSystemdLogs(ctx, cfg.ManifestName, req.Lines, req.Follow, w)
+}
+
+// handleAppCommand runs an install or uninstall sent by the
+// server and publishes the progress as update conditions.
+func (c *controller) handleAppCommand(p config.AppCommandPayload) error {
+	updateCondition := status.UpdateCondition{
+		RepoName:     p.RepoName,
+		ManifestName: p.ManifestName,
+		Status:       config.StatusInProgress,
+		Host:         c.host,
+		SHA:          p.Version,
+	}
+
+	err := c.agent.publishUpdateCondition(updateCondition)
+	if err != nil {
+		// log but don't block the command from proceeding
+		logger.Errorf("publishing update condition: %s", err)
+	}
+
+	var commandErr error
+	switch p.Action {
+	case config.AppCommandInstall:
+		_, commandErr = c.Install(control.InstallRequest{
+			Config:    p.Config(),
+			Version:   p.Version,
+			Integrity: p.Integrity,
+		})
+		if commandErr == nil {
+			sha, err := c.agent.Host.ReadAppVersion(p.ManifestName)
+			if err != nil {
+				logger.Errorf("reading installed app version: %s", err)
+			}
+			updateCondition.SHA = sha
+			updateCondition.RunningSHA = sha
+		}
+	case config.AppCommandUninstall:
+		commandErr = c.Uninstall(control.AppRequest{
+			RepoName:     p.RepoName,
+			ManifestName: p.ManifestName,
+		})
+	default:
+		commandErr = fmt.Errorf("Action %s is not valid", p.Action)
+	}
+
+	if commandErr != nil {
+		updateCondition.Status = config.StatusErr
+		updateCondition.Error = commandErr.Error()
+	} else {
+		updateCondition.Status = config.StatusSuccess
+	}
+
+	err = c.agent.publishUpdateCondition(updateCondition)
+	if err != nil {
+		logger.Errorf("publishing update condition: %s", err)
+	}
+	return commandErr
+}
+
+// Rollback runs a rollback and keeps the config of the
+// version rolled back to, like Configure.
+func (c *controller) Rollback(p config.RollbackPayload) error {
+	deployerConfig, err := config.NewDeployerConfig(c.configFile, c.herokuApp)
+	if err != nil {
+		return fmt.Errorf("getting deployer config: %s", err)
+	}
+
+	cfg, ok := deployerConfig.GetAppConfig(config.Config{
+		RepoName:     p.RepoName,
+		ManifestName: p.ManifestName,
+	})
+	if !ok {
+		return fmt.Errorf("app %s/%s is not installed", p.RepoName, p.ManifestName)
+	}
+
+	// answers requested before the rollback still hold the
+	// version rolled back from
+	c.rc.changed(cfg)
+	cfg, err = c.agent.rollbackAndReport(p, cfg, c.host)
+	if err != nil {
+		return err
+	}
+
+	deployerConfig.SetAppConfig(cfg)
+	err = deployerConfig.WriteDeployerConfig()
+	if err != nil {
+		return fmt.Errorf("writing deployer config: %s", err)
+	}
+	c.apply(deployerConfig)
+	return nil
+}
+
+func (c *controller) getAppConfig(req control.AppRequest) (config.Config, error) {
+	deployerConfig := c.live.Get()
+	cfg, ok := deployerConfig.GetAppConfig(config.Config{
+		RepoName:     req.RepoName,
+		ManifestName: req.ManifestName,
+	})
+	if !ok {
+		return cfg, fmt.Errorf("app %s/%s is not installed", req.RepoName, req.ManifestName)
+	}
+	return cfg, nil
+}
+
+// apply makes the daemon use the deployer config written by a request
+// without waiting for the config file watcher, which also picks up
+// what was written by failed requests.
+func (c *controller) apply(deployerConfig config.DeployerConfig) {
+	c.live.Set(deployerConfig)
+	c.agent.syncLogForwarders(deployerConfig, c.host, c.forwardLog)
+}
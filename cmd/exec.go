@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
+	"github.com/spf13/cobra"
+)
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec --manifestName NAME --scope SCOPE [--key KEY]... -- BINARY [ARGS]...",
+	Short: "Use the exec command to start an app with its secrets.",
+	Long: `The exec command is run by the systemd unit of an app. It
+resolves the secrets declared in the manifest through the
+configured secret provider, falling back to the last resolved
+values when the provider can't be reached, removes the secret
+provider configuration from the environment and replaces
+itself with the app binary.`,
+	Annotations: map[string]string{nonRootAnnotation: "true"},
+	Args:        cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runExec(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	execCmd.Flags().String("manifestName", "", "Name of the pi-app-deployer manifest")
+	execCmd.Flags().String("scope", "", "Scope of the secrets, the heroku.app field of the manifest")
+	execCmd.Flags().StringArray("key", []string{}, "Key of a secret declared in the manifest, can pass multiple values")
+}
+
+func runExec(cmd *cobra.Command, args []string) {
+	manifestName, err := cmd.Flags().GetString("manifestName")
+	if err != nil {
+		logger.Fatalf("error getting manifestName flag: %s", err)
+	}
+	if manifestName == "" {
+		logger.Fatal("manifestName flag is required")
+	}
+
+	scope, err := cmd.Flags().GetString("scope")
+	if err != nil {
+		logger.Fatalf("error getting scope flag: %s", err)
+	}
+
+	keys, err := cmd.Flags().GetStringArray("key")
+	if err != nil {
+		logger.Fatalf("error getting key flag: %s", err)
+	}
+
+	values := map[string]string{}
+	if len(keys) > 0 {
+		if scope == "" {
+			logger.Fatal("scope flag is required when passing keys")
+		}
+
+		provider, err := secrets.NewProviderFromEnv(os.Getenv)
+		if err != nil {
+			logger.Fatalf("error configuring secret provider: %s", err)
+		}
+
+		cacheFile := filepath.Join(secrets.CacheDir(file.Host{}.AppDir(), manifestName), "secrets.json")
+		var cached bool
+		values, cached, err = secrets.ResolveWithCache(provider, scope, keys, cacheFile)
+		if err != nil {
+			logger.Fatalf("error resolving secrets: %s", err)
+		}
+		if cached {
+			logger.Warnf("secret provider %s unavailable, starting %s with cached secrets", provider.Name(), manifestName)
+		}
+	}
+
+	env := secrets.ExecEnv(os.Environ(), values)
+	logger.Sync()
+	err = syscall.Exec(args[0], args, env)
+	logger.Fatalf("error executing %s: %s", args[0], err)
+}
@@ -1,13 +1,19 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
 	"github.com/spf13/cobra"
 )
 
 var varFlags config.EnvVarFlags
+var labelFlags config.EnvVarFlags
+var assetPatternFlags config.EnvVarFlags
 
 func NewInstallCmd() *cobra.Command {
 	return &cobra.Command{
@@ -31,15 +37,28 @@ func init() {
 	installCmd.PersistentFlags().String("manifestName", "", "Name of the pi-app-deployer manifest")
 	installCmd.PersistentFlags().Bool("logForwarding", false, "Send application logs to server")
 	installCmd.PersistentFlags().String("appUser", "pi", "Name of user that will run the app service")
+	installCmd.PersistentFlags().String("artifactSource", config.ArtifactSourceActions, "Where artifacts are downloaded from, one of: actions, release, http or s3")
+	installCmd.PersistentFlags().String("version", "", "Version to install when not using the actions artifact source, defaults to the latest version")
+	installCmd.PersistentFlags().String("artifactURL", "", "URL template of the http artifact source. Example: https://artifacts.example.com/app/{{.SHA}}/app_{{.Arch}}.tar.gz")
+	installCmd.PersistentFlags().String("s3Endpoint", "", "Endpoint of the s3 artifact source, defaults to AWS S3")
+	installCmd.PersistentFlags().String("s3Region", "", "Region of the s3 artifact source, defaults to us-east-1")
+	installCmd.PersistentFlags().String("s3Bucket", "", "Bucket of the s3 artifact source")
+	installCmd.PersistentFlags().String("s3Key", "", "Object key template of the s3 artifact source. Example: app/{{.SHA}}/app.tar.gz")
+	installCmd.PersistentFlags().StringArray("trustedKey", []string{}, "Path of a PEM encoded ed25519 or ECDSA P-256 public key app artifacts must be signed with, can pass multiple values")
+	installCmd.PersistentFlags().String("digest", "", "Expected SHA-256 digest of the artifact installed")
+	installCmd.PersistentFlags().String("signature", "", "Base64 encoded signature of the artifact installed, required when trusted keys are configured")
+	installCmd.PersistentFlags().String("manifestFile", "", "Path of the manifest on this host, required when artifacts are single binaries")
 
 	installCmd.PersistentFlags().Var(&varFlags, "envVar", "List of non-secret environment variable configuration, separated by =, can pass multiple values. Example: --env-var foo=bar --env-var hello=world")
+	installCmd.PersistentFlags().StringArray("removeLabel", []string{}, "Key of a label removed from this agent, can pass multiple values. Example: --removeLabel location")
+	installCmd.PersistentFlags().Var(&labelFlags, "label", "List of labels describing this agent, separated by =, can pass multiple values. Example: --label model=pi4 --label location=garage")
+	installCmd.PersistentFlags().Var(&assetPatternFlags, "assetPattern", "List of release asset name patterns by platform, separated by =, can pass multiple values. Example: --assetPattern linux/arm/v6=app_*_armv6.zip --assetPattern default=app_*_arm64.zip")
 }
 
 func runInstall(cmd *cobra.Command, args []string) {
-	cfg := getConfig(cmd)
-	herokuAPIKey := os.Getenv("HEROKU_API_KEY")
-	if herokuAPIKey == "" {
-		logger.Fatal("HEROKU_API_TOKEN environment variable is required")
+	req := control.InstallRequest{
+		Config: getConfig(cmd),
+		Labels: labelFlags.Map,
 	}
 
 	herokuApp, err := cmd.Flags().GetString("herokuApp")
@@ -50,43 +69,128 @@ func runInstall(cmd *cobra.Command, args []string) {
 		logger.Fatal("herokuApp flag is required")
 	}
 
-	agent, err := newAgent(herokuAPIKey, herokuApp)
+	req.RemoveLabels, err = cmd.Flags().GetStringArray("removeLabel")
 	if err != nil {
-		logger.Fatalf("error creating agent: %s", err)
+		logger.Fatalf("error getting removeLabel flag: %s", err)
+	}
+
+	req.Version, err = cmd.Flags().GetString("version")
+	if err != nil {
+		logger.Fatalf("error getting version flag: %s", err)
+	}
+
+	trustedKeys, err := cmd.Flags().GetStringArray("trustedKey")
+	if err != nil {
+		logger.Fatalf("error getting trustedKey flag: %s", err)
+	}
+	for _, path := range trustedKeys {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			logger.Fatalf("error reading trusted key: %s", err)
+		}
+		req.TrustedKeys = append(req.TrustedKeys, string(key))
+	}
+
+	req.Integrity.Digest, err = cmd.Flags().GetString("digest")
+	if err != nil {
+		logger.Fatalf("error getting digest flag: %s", err)
+	}
+	req.Integrity.Signature, err = cmd.Flags().GetString("signature")
+	if err != nil {
+		logger.Fatalf("error getting signature flag: %s", err)
+	}
+
+	logger.Info("Installing application")
+	_, err = control.NewClient(control.SocketPath).Install(req)
+	if errors.Is(err, control.ErrNotRunning) {
+		// the first install sets up the agent, there
+		// is no running agent to send the request to
+		logger.Info("Agent is not running, installing from this process")
+		_, err = installLocally(herokuApp, req)
+	}
+	if err != nil {
+		logger.Fatalf("failed installation: %s", err)
+	}
+
+	logger.Info("Successfully installed app")
+}
+
+func installLocally(herokuApp string, req control.InstallRequest) (config.Config, error) {
+	provider, err := secrets.NewProviderFromEnv(os.Getenv)
+	if err != nil {
+		return req.Config, fmt.Errorf("configuring secret provider: %s", err)
+	}
+
+	agent, err := newAgent(provider, herokuApp, "")
+	if err != nil {
+		return req.Config, fmt.Errorf("creating agent: %s", err)
 	}
 
 	deployerConfig, err := config.NewDeployerConfig(config.DeployerConfigFile, herokuApp)
 	if err != nil {
-		logger.Fatalf("error getting deployer config: %s", err)
+		return req.Config, fmt.Errorf("getting deployer config: %s", err)
 	}
 
-	// TODO: support updating a config?
+	return agent.installApp(&deployerConfig, req)
+}
+
+// installApp adds an app to the deployer config and installs it.
+func (a *Agent) installApp(deployerConfig *config.DeployerConfig, req control.InstallRequest) (config.Config, error) {
+	cfg := req.Config
+
 	if deployerConfig.ConfigExists(cfg) {
-		logger.Fatalf("App already exists in app configs file %s", config.DeployerConfigFile)
+		return cfg, fmt.Errorf("App already exists in app configs file %s, use the configure command to change it", deployerConfig.Path)
+	}
+
+	if err := config.ValidateLabels(req.Labels); err != nil {
+		return cfg, fmt.Errorf("validating labels: %s", err)
+	}
+
+	if err := cfg.Source.Validate(); err != nil {
+		return cfg, fmt.Errorf("validating artifact source: %s", err)
+	}
+
+	if req.Version != "" && cfg.Source.SourceType() == config.ArtifactSourceActions {
+		return cfg, fmt.Errorf("version flag is not supported by the %s artifact source", config.ArtifactSourceActions)
+	}
+
+	for _, key := range req.TrustedKeys {
+		deployerConfig.AddTrustedKey(key)
+	}
+	err := a.pinTrustedKeys(deployerConfig.TrustedKeys)
+	if err != nil {
+		return cfg, fmt.Errorf("parsing trusted keys: %s", err)
 	}
 
-	logger.Info("Installing application")
 	// writing deployer config here is required since the install
 	// starts the pi-app-deployer-agent systemd unit
+	deployerConfig.SetLabels(req.Labels, req.RemoveLabels)
 	deployerConfig.SetAppConfig(cfg)
-	deployerConfig.WriteDeployerConfig()
+	err = deployerConfig.WriteDeployerConfig()
+	if err != nil {
+		return cfg, fmt.Errorf("writing deployer config: %s", err)
+	}
 
-	a := config.Artifact{
+	artifact := config.Artifact{
 		RepoName:     cfg.RepoName,
 		ManifestName: cfg.ManifestName,
+		Version:      req.Version,
+		Integrity:    req.Integrity,
 	}
-	cfg, err = agent.handleInstall(a, cfg)
+	cfg, err = a.handleInstall(artifact, cfg)
 	if err != nil {
-		logger.Fatalf("failed installation: %s", err)
+		return cfg, err
 	}
 
 	// writing deployer config here is required to
 	// get executable field written which is only found
 	// during the install via the manifest
 	deployerConfig.SetAppConfig(cfg)
-	deployerConfig.WriteDeployerConfig()
-
-	logger.Info("Successfully installed app")
+	err = deployerConfig.WriteDeployerConfig()
+	if err != nil {
+		return cfg, fmt.Errorf("writing deployer config: %s", err)
+	}
+	return cfg, nil
 }
 
 func getConfig(cmd *cobra.Command) config.Config {
@@ -108,6 +212,13 @@ func getConfig(cmd *cobra.Command) config.Config {
 
 	appUser, err := cmd.Flags().GetString("appUser")
 	logForwarding, err := cmd.Flags().GetBool("logForwarding")
+	artifactSource, err := cmd.Flags().GetString("artifactSource")
+	artifactURL, err := cmd.Flags().GetString("artifactURL")
+	s3Endpoint, err := cmd.Flags().GetString("s3Endpoint")
+	s3Region, err := cmd.Flags().GetString("s3Region")
+	s3Bucket, err := cmd.Flags().GetString("s3Bucket")
+	s3Key, err := cmd.Flags().GetString("s3Key")
+	manifestFile, err := cmd.Flags().GetString("manifestFile")
 
 	return config.Config{
 		RepoName:      repoName,
@@ -115,5 +226,15 @@ func getConfig(cmd *cobra.Command) config.Config {
 		AppUser:       appUser,
 		LogForwarding: logForwarding,
 		EnvVars:       varFlags.Map,
+		Source: config.ArtifactSource{
+			Type:          artifactSource,
+			AssetPatterns: assetPatternFlags.Map,
+			URL:           artifactURL,
+			Endpoint:      s3Endpoint,
+			Region:        s3Region,
+			Bucket:        s3Bucket,
+			Key:           s3Key,
+			ManifestFile:  manifestFile,
+		},
 	}
 }
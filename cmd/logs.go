@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Use the logs command to print the logs of an installed application.",
+	Long: `The logs command asks the running update command for
+the Systemd logs of an application.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runLogs(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+
+	logsCmd.PersistentFlags().String("repoName", "", "Name of the Github repo including the owner")
+	logsCmd.PersistentFlags().String("manifestName", "", "Name of the pi-app-deployer manifest")
+	logsCmd.PersistentFlags().Int("lines", 50, "Number of past log lines to print")
+	logsCmd.PersistentFlags().BoolP("follow", "f", false, "Keep printing new log lines until interrupted")
+}
+
+func runLogs(cmd *cobra.Command, args []string) {
+	req := control.LogsRequest{AppRequest: getAppRequest(cmd)}
+
+	var err error
+	req.Lines, err = cmd.Flags().GetInt("lines")
+	if err != nil {
+		logger.Fatalf("error getting lines flag: %s", err)
+	}
+	req.Follow, err = cmd.Flags().GetBool("follow")
+	if err != nil {
+		logger.Fatalf("error getting follow flag: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = control.NewClient(control.SocketPath).Logs(ctx, req, os.Stdout)
+	if err != nil {
+		logger.Fatalf("Error reading logs of %s/%s: %s", req.RepoName, req.ManifestName, err)
+	}
+}
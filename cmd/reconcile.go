@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+)
+
+// reconciler updates the apps which missed a push to the artifact
+// the server recorded for them. It is only used with the control
+// server locked, like every change to the apps. The server leaves
+// out the artifact a host was rolled back from, so an update that
+// failed and was rolled back is not tried again, even after the
+// agent restarts.
+type reconciler struct {
+	agent *Agent
+	host  string
+	// updated is the unix time in nanoseconds an app was last
+	// updated at, answers to older requests are out of date
+	updated map[string]int64
+}
+
+func newReconciler(agent *Agent, host string) *reconciler {
+	return &reconciler{
+		agent:   agent,
+		host:    host,
+		updated: map[string]int64{},
+	}
+}
+
+// request asks the server for the artifacts last pushed for apps.
+func (r *reconciler) request(appConfigs map[string]config.Config, t time.Time) error {
+	req := config.DesiredStateRequest{
+		Host:        r.host,
+		Apps:        []config.AppID{},
+		RequestedAt: t.UnixNano(),
+	}
+	for _, cfg := range appConfigs {
+		req.Apps = append(req.Apps, config.AppID{RepoName: cfg.RepoName, ManifestName: cfg.ManifestName})
+	}
+	if len(req.Apps) == 0 {
+		return nil
+	}
+
+	j, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshalling desired state request: %s", err)
+	}
+	return r.agent.Transport.Publish(config.DesiredStateRequestTopic, string(j))
+}
+
+// reconcile updates the apps not running the artifact last pushed.
+func (r *reconciler) reconcile(p config.DesiredStatePayload, deployerConfig config.DeployerConfig) {
+	for _, artifact := range p.Artifacts {
+		cfg, ok := deployerConfig.GetAppConfig(config.Config{
+			RepoName:     artifact.RepoName,
+			ManifestName: artifact.ManifestName,
+		})
+		if !ok || !artifact.Matches(r.host, deployerConfig.Labels) || !pushMatchesSource(artifact, cfg) {
+			continue
+		}
+
+		key := appKey(cfg.RepoName, cfg.ManifestName)
+		if r.updated[key] > p.RequestedAt {
+			continue
+		}
+
+		sha, err := r.agent.Host.ReadAppVersion(cfg.ManifestName)
+		if err != nil {
+			logger.Errorf("reading installed version of %s: %s", key, err)
+			continue
+		}
+		if sha == artifact.SHA {
+			continue
+		}
+
+		logger.Infof("%s is running %s instead of the pushed version %s, updating now", key, sha, artifact.SHA)
+		err = r.update(artifact, cfg)
+		if err != nil {
+			logger.Errorf("reconciling %s: %s", key, err)
+		}
+	}
+}
+
+// update updates an app and reports the progress.
+func (r *reconciler) update(artifact config.Artifact, cfg config.Config) error {
+	r.changed(cfg)
+	return r.agent.updateAndReport(artifact, cfg, r.host)
+}
+
+// changed records an app was just changed, the desired state
+// requested before is out of date.
+func (r *reconciler) changed(cfg config.Config) {
+	r.updated[appKey(cfg.RepoName, cfg.ManifestName)] = time.Now().UnixNano()
+}
+
+func appKey(repoName, manifestName string) string {
+	return fmt.Sprintf("%s/%s", repoName, manifestName)
+}
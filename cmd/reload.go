@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce groups the events of a single write
+// of the deployer config into one reload.
+const reloadDebounce = 500 * time.Millisecond
+
+// liveConfig holds the deployer config currently
+// used by the update daemon.
+type liveConfig struct {
+	mu  sync.RWMutex
+	cfg config.DeployerConfig
+}
+
+func (l *liveConfig) Get() config.DeployerConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+func (l *liveConfig) Set(cfg config.DeployerConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+}
+
+// watchDeployerConfig calls onChange when the deployer config at path
+// is written, replaced or removed, or when the process receives SIGHUP,
+// until ctx is done.
+// The parent directory is watched so that editors replacing the file
+// and the first install creating it are both noticed. SIGHUP is still
+// handled when the returned error reports the watch could not be set up.
+func watchDeployerConfig(ctx context.Context, path string, onChange func()) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(path))
+		if err != nil {
+			watcher.Close()
+		} else {
+			events = watcher.Events
+			errs = watcher.Errors
+		}
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if events != nil {
+			defer watcher.Close()
+		}
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				if filepath.Clean(event.Name) != filepath.Clean(path) {
+					continue
+				}
+				debounce = time.After(reloadDebounce)
+			case err := <-errs:
+				logger.Errorf("watching deployer config: %s", err)
+			case <-hup:
+				logger.Info("received SIGHUP, reloading deployer config")
+				onChange()
+			case <-debounce:
+				debounce = nil
+				logger.Info("deployer config changed, reloading")
+				onChange()
+			}
+		}
+	}()
+	return err
+}
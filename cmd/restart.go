@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+// restartCmd represents the restart command
+var restartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Use the restart command to restart an installed application.",
+	Long: `The restart command asks the running update command
+to restart the Systemd unit of an application.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runRestart(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restartCmd)
+
+	restartCmd.PersistentFlags().String("repoName", "", "Name of the Github repo including the owner")
+	restartCmd.PersistentFlags().String("manifestName", "", "Name of the pi-app-deployer manifest")
+}
+
+func runRestart(cmd *cobra.Command, args []string) {
+	req := getAppRequest(cmd)
+	err := control.NewClient(control.SocketPath).Restart(req)
+	if err != nil {
+		logger.Fatalf("Error restarting %s/%s: %s", req.RepoName, req.ManifestName, err)
+	}
+	logger.Infof("Successfully restarted %s/%s", req.RepoName, req.ManifestName)
+}
+
+func getAppRequest(cmd *cobra.Command) control.AppRequest {
+	repoName, err := cmd.Flags().GetString("repoName")
+	if err != nil {
+		logger.Fatalf("error getting repoName flag: %s", err)
+	}
+	if repoName == "" {
+		logger.Fatal("repoName flag is required")
+	}
+
+	manifestName, err := cmd.Flags().GetString("manifestName")
+	if err != nil {
+		logger.Fatalf("error getting manifestName flag: %s", err)
+	}
+	if manifestName == "" {
+		logger.Fatal("manifestName flag is required")
+	}
+
+	return control.AppRequest{
+		RepoName:     repoName,
+		ManifestName: manifestName,
+	}
+}
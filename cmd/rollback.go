@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Use the rollback command to return an app to a previous version.",
+	Long: `The rollback command asks the running update command to
+reinstall a previous version of an application. Without the --sha flag the last version kept on
+this host is restored, otherwise the given SHA is restored
+from the local copy or downloaded from Github.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runRollback(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+
+	rollbackCmd.PersistentFlags().String("repoName", "", "Name of the Github repo including the owner")
+	rollbackCmd.PersistentFlags().String("manifestName", "", "Name of the pi-app-deployer manifest")
+	rollbackCmd.PersistentFlags().String("sha", "", "SHA of the version to roll back to, defaults to the previously installed version")
+	rollbackCmd.PersistentFlags().String("artifactName", "", "Name of the Github artifact, only used when the SHA is not kept on this host")
+}
+
+func runRollback(cmd *cobra.Command, args []string) {
+	repoName, err := cmd.Flags().GetString("repoName")
+	if err != nil {
+		logger.Fatalf("error getting repoName flag: %s", err)
+	}
+
+	manifestName, err := cmd.Flags().GetString("manifestName")
+	if err != nil {
+		logger.Fatalf("error getting manifestName flag: %s", err)
+	}
+
+	sha, err := cmd.Flags().GetString("sha")
+	if err != nil {
+		logger.Fatalf("error getting sha flag: %s", err)
+	}
+
+	artifactName, err := cmd.Flags().GetString("artifactName")
+	if err != nil {
+		logger.Fatalf("error getting artifactName flag: %s", err)
+	}
+
+	p := config.RollbackPayload{
+		RepoName:     repoName,
+		ManifestName: manifestName,
+		SHA:          sha,
+		ArtifactName: artifactName,
+	}
+	if err := p.Validate(); err != nil {
+		logger.Fatalf("error validating flags: %s", err)
+	}
+
+	err = control.NewClient(control.SocketPath).Rollback(p)
+	if err != nil {
+		logger.Fatalf("failed rollback: %s", err)
+	}
+
+	logger.Infof("Successfully rolled back %s/%s", repoName, manifestName)
+}
+
+// rollbackAndReport rolls back an app and publishes the
+// progress as update conditions.
+func (a *Agent) rollbackAndReport(p config.RollbackPayload, cfg config.Config, host string) (config.Config, error) {
+	logger.Infof("rolling back repo %s with manifest name %s", cfg.RepoName, cfg.ManifestName)
+	updateCondition := status.UpdateCondition{
+		RepoName:     cfg.RepoName,
+		ManifestName: cfg.ManifestName,
+		Status:       config.StatusInProgress,
+		Host:         host,
+		SHA:          p.SHA,
+		ArtifactName: p.ArtifactName,
+	}
+
+	err := a.publishUpdateCondition(updateCondition)
+	if err != nil {
+		// log but don't block rollback from proceeding
+		logger.Errorf("publishing update condition: %s", err)
+	}
+
+	cfg, sha, rollbackErr := a.handleRollback(p, cfg)
+	updateCondition.SHA = sha
+	if rollbackErr != nil {
+		updateCondition.Status = config.StatusErr
+		updateCondition.Error = rollbackErr.Error()
+	} else {
+		updateCondition.Status = config.StatusSuccess
+		updateCondition.RolledBack = true
+		updateCondition.RunningSHA = sha
+	}
+
+	err = a.publishUpdateCondition(updateCondition)
+	if err != nil {
+		logger.Errorf("publishing update condition: %s", err)
+	}
+
+	return cfg, rollbackErr
+}
@@ -8,11 +8,27 @@ import (
 	"go.uber.org/zap"
 )
 
+// nonRootAnnotation marks commands that are run by
+// app services and do not require root.
+const nonRootAnnotation = "nonRoot"
+
 var logger *zap.SugaredLogger
 var rootCmd = &cobra.Command{
 	Use:   "pi-app-deployer-agent",
 	Short: "",
 	Long:  ``,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if _, ok := cmd.Annotations[nonRootAnnotation]; ok {
+			return
+		}
+		u, err := user.Current()
+		if err != nil {
+			logger.Fatalf("error getting current user: %s", err)
+		}
+		if u.Username != "root" {
+			logger.Fatalf("agent must be run as root, user found was %s", u.Username)
+		}
+	},
 }
 
 var version string
@@ -29,14 +45,6 @@ func init() {
 	logger = l.Sugar().Named("pi-app-deployer-agent")
 	defer logger.Sync()
 
-	u, err := user.Current()
-	if err != nil {
-		logger.Fatalf("error getting current user: %s", err)
-	}
-	if u.Username != "root" {
-		logger.Fatalf("agent must be run as root, user found was %s", u.Username)
-	}
-
 	logger.Infof("Version: %s", version)
 
 	rootCmd.PersistentFlags().String("herokuApp", "", "Name of the Heroku app")
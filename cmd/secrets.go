@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
+	"github.com/spf13/cobra"
+)
+
+var secretValueFlags config.EnvVarFlags
+
+// secretsCmd represents the secrets command
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Use the secrets command to read and write secrets of the configured secret provider.",
+	Long: `The secrets command resolves secrets through the provider
+selected by the SECRET_PROVIDER environment variable, one of
+heroku (default), file or vault.`,
+}
+
+var secretsGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Print secrets of a scope as shell export statements.",
+	Long: `The secrets get command prints the secrets resolved for
+an app so they can be checked or sourced in a shell. Every
+key must be found or the command fails.`,
+	Annotations: map[string]string{nonRootAnnotation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		runSecretsGet(cmd, args)
+	},
+}
+
+var secretsSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Write secrets of a scope to the local encrypted secrets file.",
+	Long: `The secrets set command adds secrets to the file used by
+the file secret provider, it is not supported by other providers.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runSecretsSet(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretsCmd)
+	secretsCmd.AddCommand(secretsGetCmd)
+	secretsCmd.AddCommand(secretsSetCmd)
+
+	secretsCmd.PersistentFlags().String("scope", "", "Scope of the secrets, the heroku.app field of a manifest or the herokuApp of the agent")
+	secretsGetCmd.Flags().StringArray("key", []string{}, "Key of a secret to print, can pass multiple values")
+	secretsSetCmd.Flags().Var(&secretValueFlags, "value", "Secret to write, separated by =, can pass multiple values. Example: --value foo=bar --value hello=world")
+}
+
+func runSecretsGet(cmd *cobra.Command, args []string) {
+	scope := getScope(cmd)
+
+	keys, err := cmd.Flags().GetStringArray("key")
+	if err != nil {
+		logger.Fatalf("error getting key flag: %s", err)
+	}
+
+	provider, err := secrets.NewProviderFromEnv(os.Getenv)
+	if err != nil {
+		logger.Fatalf("error configuring secret provider: %s", err)
+	}
+
+	values, err := secrets.GetRequired(provider, scope, keys)
+	if err != nil {
+		logger.Fatalf("error getting secrets: %s", err)
+	}
+
+	fmt.Print(file.ToShellExports(values))
+}
+
+func runSecretsSet(cmd *cobra.Command, args []string) {
+	scope := getScope(cmd)
+
+	if len(secretValueFlags.Map) == 0 {
+		logger.Fatal("at least one value flag is required")
+	}
+
+	provider, err := secrets.NewProviderFromEnv(os.Getenv)
+	if err != nil {
+		logger.Fatalf("error configuring secret provider: %s", err)
+	}
+
+	fileProvider, ok := provider.(*secrets.FileProvider)
+	if !ok {
+		logger.Fatalf("secrets set is only supported by the %s provider, configured provider is %s", secrets.ProviderFile, provider.Name())
+	}
+
+	err = fileProvider.SetSecrets(scope, secretValueFlags.Map)
+	if err != nil {
+		logger.Fatalf("error writing secrets: %s", err)
+	}
+	logger.Infof("Successfully wrote %d secrets for %s", len(secretValueFlags.Map), scope)
+}
+
+func getScope(cmd *cobra.Command) string {
+	scope, err := cmd.Flags().GetString("scope")
+	if err != nil {
+		logger.Fatalf("error getting scope flag: %s", err)
+	}
+	if scope == "" {
+		logger.Fatal("scope flag is required")
+	}
+	return scope
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Use the status command to list installed applications.",
+	Long: `The status command lists the applications managed by the
+agent with the installed version and the state of their Systemd
+units. The running update command is asked first, the deployer
+config is read directly when it is not running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runStatus(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.PersistentFlags().StringP("output", "o", outputText, "Output format, one of: text or json")
+}
+
+func runStatus(cmd *cobra.Command, args []string) {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		logger.Fatalf("error getting output flag: %s", err)
+	}
+	if output != outputText && output != outputJSON {
+		logger.Fatalf("output flag must be one of: %s or %s", outputText, outputJSON)
+	}
+
+	apps, err := control.NewClient(control.SocketPath).Status()
+	if errors.Is(err, control.ErrNotRunning) {
+		apps, err = readAppStatuses()
+	}
+	if err != nil {
+		logger.Fatalf("Error getting status: %s", err)
+	}
+
+	if output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(apps); err != nil {
+			logger.Fatalf("Error writing status: %s", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tMANIFEST\tSHA\tEXECUTABLE\tSTATE\tENABLED\tUPTIME\tRESTARTS\tLOG FORWARDING")
+	for _, app := range apps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s (%s)\t%t\t%s\t%d\t%t\n",
+			app.RepoName,
+			app.ManifestName,
+			app.SHA,
+			app.Executable,
+			app.ActiveState,
+			app.SubState,
+			app.Enabled,
+			time.Duration(app.UptimeSeconds)*time.Second,
+			app.Restarts,
+			app.LogForwarding,
+		)
+	}
+	w.Flush()
+}
+
+// readAppStatuses reads the deployer config
+// directly when the agent is not running.
+func readAppStatuses() ([]control.AppStatus, error) {
+	// the heroku app is not needed to read app configs
+	deployerConfig, err := config.NewDeployerConfig(config.DeployerConfigFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("getting deployer config: %s", err)
+	}
+	return appStatuses(file.Host{}, deployerConfig.AppConfigs)
+}
+
+// appStatuses returns the state of apps sorted by key.
+func appStatuses(h file.Host, appConfigs map[string]config.Config) ([]control.AppStatus, error) {
+	keys := make([]string, 0, len(appConfigs))
+	for k := range appConfigs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	apps := []control.AppStatus{}
+	for _, k := range keys {
+		cfg := appConfigs[k]
+		state, err := h.GetSystemdUnitState(cfg.ManifestName)
+		if err != nil {
+			return nil, err
+		}
+
+		sha, err := h.ReadAppVersion(cfg.ManifestName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("reading installed version of %s: %s", cfg.ManifestName, err)
+		}
+
+		apps = append(apps, control.AppStatus{
+			RepoName:      cfg.RepoName,
+			ManifestName:  cfg.ManifestName,
+			SHA:           sha,
+			Executable:    cfg.Executable,
+			ActiveState:   state.ActiveState,
+			SubState:      state.SubState,
+			Enabled:       state.Enabled(),
+			UptimeSeconds: int64(state.Uptime.Seconds()),
+			Restarts:      state.Restarts,
+			LogForwarding: cfg.LogForwarding,
+		})
+	}
+	return apps, nil
+}
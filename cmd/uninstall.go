@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
 	"github.com/spf13/cobra"
 )
 
@@ -55,9 +59,11 @@ func runUninstall(cmd *cobra.Command, args []string) {
 		logger.Fatalf("error getting deployer config: %s", err)
 	}
 
+	// removing everything also removes the agent, it is stopped
+	// instead of being asked through the control socket
 	if all {
 		logger.Info("Uninstalling all apps")
-		err := unInstallAll(deployerConfig.AppConfigs)
+		err := unInstallAll(file.Host{}, deployerConfig.AppConfigs)
 		if err != nil {
 			logger.Fatalf("Error uninstalling all apps: %s", err)
 		}
@@ -69,10 +75,36 @@ func runUninstall(cmd *cobra.Command, args []string) {
 		logger.Fatal("repoName and manifestName cannot be empty if not using the --all flag")
 	}
 
+	req := control.AppRequest{
+		RepoName:     repoName,
+		ManifestName: manifestName,
+	}
 	logger.Infof("Uninstalling %s/%s", repoName, manifestName)
-	err = unInstall(deployerConfig.AppConfigs, repoName, manifestName)
+	err = control.NewClient(control.SocketPath).Uninstall(req)
+	if errors.Is(err, control.ErrNotRunning) {
+		logger.Info("Agent is not running, uninstalling from this process")
+		err = uninstallApp(file.Host{}, &deployerConfig, req)
+	}
 	if err != nil {
 		logger.Fatalf("Error uninstalling %s/%s: %s", repoName, manifestName, err)
 	}
 	logger.Infof("Successfully uninstalled %s/%s", repoName, manifestName)
 }
+
+// uninstallApp removes an app and its entry in the deployer config.
+func uninstallApp(h file.Host, deployerConfig *config.DeployerConfig, req control.AppRequest) error {
+	err := unInstall(h, deployerConfig.AppConfigs, req.RepoName, req.ManifestName)
+	if err != nil {
+		return err
+	}
+
+	deployerConfig.RemoveAppConfig(config.Config{
+		RepoName:     req.RepoName,
+		ManifestName: req.ManifestName,
+	})
+	err = deployerConfig.WriteDeployerConfig()
+	if err != nil {
+		return fmt.Errorf("removing app from the deployer config: %s", err)
+	}
+	return nil
+}
@@ -1,14 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/control"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/mqtt"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
 	"github.com/spf13/cobra"
 )
 
@@ -28,15 +34,19 @@ func init() {
 	rootCmd.AddCommand(updateCmd)
 }
 
+// commandHistorySize is the number of command IDs remembered
+// to ignore the commands delivered more than once.
+const commandHistorySize = 1000
+
 func runUpdate(cmd *cobra.Command, args []string) {
 	host, err := os.Hostname()
 	if err != nil {
 		logger.Fatalf("error getting hostname: %s", err)
 	}
 
-	herokuAPIKey := os.Getenv("HEROKU_API_KEY")
-	if herokuAPIKey == "" {
-		logger.Fatal("HEROKU_API_TOKEN environment variable is required")
+	provider, err := secrets.NewProviderFromEnv(os.Getenv)
+	if err != nil {
+		logger.Fatalf("error configuring secret provider: %s", err)
 	}
 
 	herokuApp, err := cmd.Flags().GetString("herokuApp")
@@ -47,31 +57,87 @@ func runUpdate(cmd *cobra.Command, args []string) {
 		logger.Fatal("herokuApp flag is required")
 	}
 
-	agent, err := newAgent(herokuAPIKey, herokuApp)
+	err = RunAgent(context.Background(), AgentOptions{
+		Host:      host,
+		HerokuApp: herokuApp,
+		Secrets:   provider,
+	})
+	if err != nil {
+		logger.Fatalf("error running agent: %s", err)
+	}
+}
+
+// AgentOptions configure the update daemon. The optional
+// fields let tests run agents in process.
+type AgentOptions struct {
+	Host      string
+	HerokuApp string
+	Secrets   secrets.Provider
+	// ConfigFile defaults to config.DeployerConfigFile
+	ConfigFile string
+	// SocketPath defaults to control.SocketPath
+	SocketPath string
+	// Transport replaces the MQTT client configured by the secrets
+	Transport mqtt.Transport
+	// FileHost defaults to the host the agent runs on
+	FileHost file.Host
+	// GithubAPIURL defaults to github.DefaultAPIURL
+	GithubAPIURL string
+}
+
+// RunAgent runs the update daemon until ctx is done.
+func RunAgent(ctx context.Context, opts AgentOptions) error {
+	host := opts.Host
+	herokuApp := opts.HerokuApp
+	configFile := opts.ConfigFile
+	if configFile == "" {
+		configFile = config.DeployerConfigFile
+	}
+	socketPath := opts.SocketPath
+	if socketPath == "" {
+		socketPath = control.SocketPath
+	}
+
+	agent, err := newAgent(opts.Secrets, herokuApp, agentClientID(host))
 	if err != nil {
-		logger.Fatalf("error creating agent: %s", err)
+		return fmt.Errorf("creating agent: %s", err)
 	}
+	if opts.Transport != nil {
+		agent.Transport = opts.Transport
+	}
+	agent.Host = opts.FileHost
+	agent.GithubAPIURL = opts.GithubAPIURL
 
-	deployerConfig, err := config.NewDeployerConfig(config.DeployerConfigFile, herokuApp)
+	deployerConfig, err := config.NewDeployerConfig(configFile, herokuApp)
 	if err != nil {
-		logger.Fatalf("error getting app configs: %s", err)
+		return fmt.Errorf("getting app configs: %s", err)
 	}
 
-	err = agent.MqttClient.Connect()
+	err = agent.pinTrustedKeys(deployerConfig.TrustedKeys)
 	if err != nil {
-		logger.Fatalf("connecting to mqtt: %s", err)
+		return fmt.Errorf("parsing trusted keys: %s", err)
 	}
 
-	updateProgressFile := fmt.Sprintf("%s/%s", config.PiAppDeployerDir, ".update-in-progress")
+	commands := mqtt.NewDeduper(commandHistorySize)
+
+	updateProgressFile := fmt.Sprintf("%s/%s", agent.Host.AppDir(), ".update-in-progress")
 	// TODO: need to clean this up instead of hard coding
-	if _, err := os.Stat(updateProgressFile); err == nil {
+	if progress, err := os.ReadFile(updateProgressFile); err == nil {
 		logger.Info("Previous update was in progress, publishing success now")
+		// older agents only wrote the command ID
+		fields := strings.Fields(string(progress))
 		updateCondition := status.UpdateCondition{
 			RepoName:     "andrewmarklloyd/pi-app-deployer",
 			ManifestName: "pi-app-deployer-agent",
 			Status:       config.StatusSuccess,
 			Host:         host,
 		}
+		if len(fields) > 0 {
+			commands.Seen(fields[0])
+		}
+		if len(fields) > 1 {
+			updateCondition.SHA = fields[1]
+		}
 
 		err = agent.publishUpdateCondition(updateCondition)
 		if err != nil {
@@ -89,35 +155,115 @@ func runUpdate(cmd *cobra.Command, args []string) {
 	if os.Getenv("INVENTORY_TRANSIENT") != "" {
 		transientInventory = true
 	}
+	live := &liveConfig{cfg: deployerConfig}
+	rc := newReconciler(&agent, host)
+	// the desired state is requested with every inventory so apps
+	// which missed a push catch up
+	publishInventory := func(t time.Time) {
+		cfg := live.Get()
+		err := agent.publishAgentInventory(cfg.AppConfigs, cfg.Labels, host, t.Unix(), transientInventory)
+		if err != nil {
+			logger.Errorf("error publishing agent inventory: %s", err)
+		}
+		err = rc.request(cfg.AppConfigs, t)
+		if err != nil {
+			logger.Errorf("error requesting desired state: %s", err)
+		}
+	}
 	inventoryTicker := time.NewTicker(config.InventoryTickerSchedule)
+	defer inventoryTicker.Stop()
 	go func() {
-		for t := range inventoryTicker.C {
-			err := agent.publishAgentInventory(deployerConfig.AppConfigs, host, t.Unix(), transientInventory)
-			if err != nil {
-				logger.Errorf("error publishing agent inventory: %s", err)
+		for {
+			select {
+			case t := <-inventoryTicker.C:
+				publishInventory(t)
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 
-	agent.startLogForwarder(deployerConfig, host, func(l config.Log) {
+	forwardLog := func(l config.Log) {
 		json, err := json.Marshal(l)
 		if err != nil {
 			logger.Errorf("marshalling log forwarder message: %s", err)
 			return
 		}
-		err = agent.MqttClient.Publish(config.LogForwarderTopic, string(json))
+		err = agent.Transport.Publish(config.LogForwarderTopic, string(json))
 		if err != nil {
 			logger.Errorf("error publishing log forwarding message: %s", err)
 		}
-	})
+	}
+	agent.syncLogForwarders(deployerConfig, host, forwardLog)
+
+	// reloading keeps the MQTT connection open, only the state
+	// derived from the deployer config is refreshed
+	reload := func() {
+		next, err := config.NewDeployerConfig(configFile, herokuApp)
+		if err != nil {
+			logger.Errorf("error reloading deployer config, keeping the previous one: %s", err)
+			return
+		}
+		err = agent.pinTrustedKeys(next.TrustedKeys)
+		if err != nil {
+			logger.Errorf("error parsing trusted keys, keeping the previous deployer config: %s", err)
+			return
+		}
+
+		added, removed, changed := config.DiffAppConfigs(live.Get().AppConfigs, next.AppConfigs)
+		logger.Infof("deployer config reloaded, added: %v, removed: %v, changed: %v", added, removed, changed)
+
+		live.Set(next)
+		agent.syncLogForwarders(next, host, forwardLog)
+		publishInventory(time.Now())
+	}
+	err = watchDeployerConfig(ctx, configFile, reload)
+	if err != nil {
+		logger.Errorf("error watching deployer config, send SIGHUP to reload it: %s", err)
+	}
+
+	ctrl := &controller{
+		agent:      &agent,
+		live:       live,
+		configFile: configFile,
+		herokuApp:  herokuApp,
+		host:       host,
+		forwardLog: forwardLog,
+		rc:         rc,
+	}
+	controlServer := control.NewServer(ctrl)
+	err = controlServer.Listen(socketPath)
+	if err != nil {
+		return fmt.Errorf("opening control socket: %s", err)
+	}
+	defer controlServer.Close()
+	go func() {
+		err := controlServer.Serve()
+		if err != nil {
+			logger.Fatalf("error serving control socket: %s", err)
+		}
+	}()
 
-	agent.MqttClient.Subscribe(config.RepoPushTopic, func(message string) {
+	agent.Transport.Subscribe(config.RepoPushTopic, func(message string) {
 		var artifact config.Artifact
 		err := json.Unmarshal([]byte(message), &artifact)
 		if err != nil {
 			logger.Errorf("unmarshalling payload from topic %s: %s", config.RepoPushTopic, err)
 			return
 		}
+		if commands.Seen(artifact.CommandID) {
+			logger.Infof("ignoring command %s delivered again on topic %s", artifact.CommandID, config.RepoPushTopic)
+			return
+		}
+
+		// updates are serialized with the requests of the control socket
+		controlServer.Lock()
+		defer controlServer.Unlock()
+
+		deployerConfig := live.Get()
+		if !artifact.Matches(host, deployerConfig.Labels) {
+			return
+		}
 
 		if artifact.RepoName == "andrewmarklloyd/pi-app-deployer" && artifact.ManifestName == "pi-app-deployer-agent" {
 			logger.Infof("New pi-app-deployer-agent version published, updating now: %s", artifact.Name)
@@ -126,6 +272,8 @@ func runUpdate(cmd *cobra.Command, args []string) {
 				ManifestName: artifact.ManifestName,
 				Status:       config.StatusInProgress,
 				Host:         host,
+				SHA:          artifact.SHA,
+				ArtifactName: artifact.Name,
 			}
 
 			err = agent.publishUpdateCondition(updateCondition)
@@ -151,60 +299,84 @@ func runUpdate(cmd *cobra.Command, args []string) {
 
 		for _, cfg := range deployerConfig.AppConfigs {
 			if artifact.RepoName == cfg.RepoName && artifact.ManifestName == cfg.ManifestName {
-				logger.Infof("updating repo %s with manifest name %s", cfg.RepoName, cfg.ManifestName)
-				updateCondition := status.UpdateCondition{
-					RepoName:     cfg.RepoName,
-					ManifestName: cfg.ManifestName,
-					Status:       config.StatusInProgress,
-					Host:         host,
+				if !pushMatchesSource(artifact, cfg) {
+					logger.Infof("ignoring push for %s, it was not published by the %s artifact source", cfg.ManifestName, cfg.Source.SourceType())
+					continue
 				}
-
-				err = agent.publishUpdateCondition(updateCondition)
-				if err != nil {
-					// log but don't block update from proceeding
-					logger.Errorf("publishing update condition: %s", err)
-				}
-				err := agent.handleRepoUpdate(artifact, cfg)
+				err := rc.update(artifact, cfg)
 				if err != nil {
 					logger.Errorf("handling repo update: %s", err)
-					updateCondition.Error = err.Error()
-					updateCondition.Status = config.StatusErr
-					err = agent.publishUpdateCondition(updateCondition)
-					if err != nil {
-						logger.Errorf("publishing update condition: %s", err)
-					}
 					return
 				}
-				// TODO: should check systemctl status before sending success?
-				updateCondition.Status = config.StatusSuccess
-				err = agent.publishUpdateCondition(updateCondition)
-				if err != nil {
-					logger.Errorf("publishing update condition: %s", err)
-				}
 			}
 		}
 	})
 
-	agent.MqttClient.Subscribe(config.ServiceActionTopic, func(message string) {
+	agent.Transport.Subscribe(config.RollbackTopic, func(message string) {
+		var payload config.RollbackPayload
+		err := json.Unmarshal([]byte(message), &payload)
+		if err != nil {
+			logger.Errorf("unmarshalling payload from topic %s: %s", config.RollbackTopic, err)
+			return
+		}
+		if commands.Seen(payload.CommandID) {
+			logger.Infof("ignoring command %s delivered again on topic %s", payload.CommandID, config.RollbackTopic)
+			return
+		}
+
+		controlServer.Lock()
+		defer controlServer.Unlock()
+
+		deployerConfig := live.Get()
+		if !payload.Matches(host, deployerConfig.Labels) {
+			return
+		}
+		_, ok := deployerConfig.GetAppConfig(config.Config{
+			RepoName:     payload.RepoName,
+			ManifestName: payload.ManifestName,
+		})
+		if !ok {
+			return
+		}
+
+		err = ctrl.Rollback(payload)
+		if err != nil {
+			logger.Errorf("handling rollback: %s", err)
+		}
+	})
+
+	agent.Transport.Subscribe(config.ServiceActionTopic, func(message string) {
 		var payload config.ServiceActionPayload
 		err := json.Unmarshal([]byte(message), &payload)
 		if err != nil {
 			logger.Errorf("unmarshalling payload from topic %s: %s", config.ServiceActionTopic, err)
 			return
 		}
+		if commands.Seen(payload.CommandID) {
+			logger.Infof("ignoring command %s delivered again on topic %s", payload.CommandID, config.ServiceActionTopic)
+			return
+		}
+
+		controlServer.Lock()
+		defer controlServer.Unlock()
+
+		deployerConfig := live.Get()
+		if !payload.Matches(host, deployerConfig.Labels) {
+			return
+		}
 		for _, cfg := range deployerConfig.AppConfigs {
 			if payload.RepoName == cfg.RepoName && payload.ManifestName == cfg.ManifestName {
 				logger.Infof("Running service action %s on %s/%s", payload.Action, payload.RepoName, payload.ManifestName)
 				var err error
 				switch payload.Action {
 				case config.ServiceActionStart:
-					err = file.StartSystemdUnit(payload.ManifestName)
+					err = agent.Host.StartSystemdUnit(payload.ManifestName)
 					break
 				case config.ServiceActionStop:
-					err = file.StopSystemdUnit(payload.ManifestName)
+					err = agent.Host.StopSystemdUnit(payload.ManifestName)
 					break
 				case config.ServiceActionRestart:
-					err = file.RestartSystemdUnit(payload.ManifestName)
+					err = agent.Host.RestartSystemdUnit(payload.ManifestName)
 					break
 				default:
 					err = fmt.Errorf("Action %s is not valid", payload.Action)
@@ -217,13 +389,138 @@ func runUpdate(cmd *cobra.Command, args []string) {
 		}
 	})
 
-	go forever()
-	select {} // block forever
+	agent.Transport.Subscribe(config.ConfigureTopic, func(message string) {
+		var payload config.ConfigurePayload
+		err := json.Unmarshal([]byte(message), &payload)
+		if err != nil {
+			logger.Errorf("unmarshalling payload from topic %s: %s", config.ConfigureTopic, err)
+			return
+		}
+		if commands.Seen(payload.CommandID) {
+			logger.Infof("ignoring command %s delivered again on topic %s", payload.CommandID, config.ConfigureTopic)
+			return
+		}
+
+		controlServer.Lock()
+		defer controlServer.Unlock()
 
+		deployerConfig := live.Get()
+		if !payload.Matches(host, deployerConfig.Labels) {
+			return
+		}
+		if !deployerConfig.ConfigExists(config.Config{RepoName: payload.RepoName, ManifestName: payload.ManifestName}) {
+			return
+		}
+
+		_, err = ctrl.Configure(payload)
+		if err != nil {
+			logger.Errorf("handling configure: %s", err)
+		}
+	})
+
+	agent.Transport.Subscribe(config.AppCommandTopic, func(message string) {
+		var payload config.AppCommandPayload
+		err := json.Unmarshal([]byte(message), &payload)
+		if err != nil {
+			logger.Errorf("unmarshalling payload from topic %s: %s", config.AppCommandTopic, err)
+			return
+		}
+		if commands.Seen(payload.CommandID) {
+			logger.Infof("ignoring command %s delivered again on topic %s", payload.CommandID, config.AppCommandTopic)
+			return
+		}
+
+		controlServer.Lock()
+		defer controlServer.Unlock()
+
+		if !payload.Matches(host, live.Get().Labels) {
+			return
+		}
+
+		logger.Infof("Running app command %s on %s/%s", payload.Action, payload.RepoName, payload.ManifestName)
+		err = ctrl.handleAppCommand(payload)
+		if err != nil {
+			logger.Errorf("handling app command: %s", err)
+		}
+	})
+
+	agent.Transport.Subscribe(config.DesiredStateTopic(host), func(message string) {
+		var payload config.DesiredStatePayload
+		err := json.Unmarshal([]byte(message), &payload)
+		if err != nil {
+			logger.Errorf("unmarshalling payload from topic %s: %s", config.DesiredStateTopic(host), err)
+			return
+		}
+		if payload.Host != host {
+			return
+		}
+
+		controlServer.Lock()
+		defer controlServer.Unlock()
+
+		rc.reconcile(payload, live.Get())
+	})
+
+	// handlers are registered before connecting so commands queued
+	// in the session of the agent are not dropped
+	err = agent.Transport.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to mqtt: %s", err)
+	}
+	defer agent.Transport.Close()
+	publishInventory(time.Now())
+
+	<-ctx.Done()
+	agent.syncLogForwarders(config.DeployerConfig{}, host, forwardLog)
+	return nil
 }
 
-func forever() {
-	for {
-		time.Sleep(5 * time.Minute)
+// updateAndReport updates an app and publishes the progress as
+// update conditions.
+func (a *Agent) updateAndReport(artifact config.Artifact, cfg config.Config, host string) error {
+	logger.Infof("updating repo %s with manifest name %s", cfg.RepoName, cfg.ManifestName)
+	updateCondition := status.UpdateCondition{
+		RepoName:     cfg.RepoName,
+		ManifestName: cfg.ManifestName,
+		Status:       config.StatusInProgress,
+		Host:         host,
+		SHA:          artifact.SHA,
+		ArtifactName: artifact.Name,
 	}
+
+	err := a.publishUpdateCondition(updateCondition)
+	if err != nil {
+		// log but don't block update from proceeding
+		logger.Errorf("publishing update condition: %s", err)
+	}
+
+	updateErr := a.handleRepoUpdate(artifact, cfg)
+	if updateErr != nil {
+		updateCondition.Error = updateErr.Error()
+		updateCondition.Status = config.StatusErr
+		var healthCheckErr *HealthCheckError
+		if errors.As(updateErr, &healthCheckErr) {
+			updateCondition.Status = config.StatusHealthCheckFailed
+		}
+		var rollbackErr *RollbackError
+		if errors.As(updateErr, &rollbackErr) {
+			updateCondition.RolledBack = true
+			updateCondition.RunningSHA = rollbackErr.SHA
+		}
+	} else {
+		updateCondition.Status = config.StatusSuccess
+		updateCondition.RunningSHA = artifact.SHA
+	}
+
+	err = a.publishUpdateCondition(updateCondition)
+	if err != nil {
+		logger.Errorf("publishing update condition: %s", err)
+	}
+	return updateErr
+}
+
+// pushMatchesSource returns true when a pushed artifact can be
+// resolved by the artifact source configured for the app.
+func pushMatchesSource(artifact config.Artifact, cfg config.Config) bool {
+	return artifact.SourceType() == cfg.Source.SourceType()
 }
@@ -4,15 +4,29 @@ set -euo pipefail
 
 deployerDir="/usr/local/src/pi-app-deployer"
 
-osRelease=$(cat /etc/os-release)
-if [[ "${osRelease}" == *"Raspbian"* ]]; then
-  arch="arm"
-elif [[ "${osRelease}" == *"Ubuntu"* ]]; then
-  arch="amd64"
-else
-  echo "OS not supported"
-  exit 1
-fi
+# 32 bit userlands on 64 bit ARM kernels report
+# aarch64 but can only run arm binaries
+machine=$(uname -m)
+userland=$(getconf LONG_BIT)
+case "${machine}" in
+  armv6*|armv7*)
+    arch="arm"
+    ;;
+  aarch64|arm64)
+    if [[ "${userland}" == "32" ]]; then
+      arch="arm"
+    else
+      arch="arm64"
+    fi
+    ;;
+  x86_64)
+    arch="amd64"
+    ;;
+  *)
+    echo "Architecture ${machine} not supported"
+    exit 1
+    ;;
+esac
 
 get_latest_release() {
   curl --silent "https://api.github.com/repos/andrewmarklloyd/pi-app-deployer/releases/latest" | grep '"tag_name":' | sed -E 's/.*"([^"]+)".*/\1/'
@@ -23,7 +37,8 @@ if [[ $(whoami) != "root" ]]; then
   exit 1
 fi
 
-if [[ -z ${HEROKU_API_KEY} ]]; then
+secretProvider=${SECRET_PROVIDER:-heroku}
+if [[ ${secretProvider} == "heroku" && -z ${HEROKU_API_KEY:-} ]]; then
   echo "HEROKU_API_KEY env var not set, exiting now"
   exit 1
 fi
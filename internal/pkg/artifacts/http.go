@@ -0,0 +1,69 @@
+package artifacts
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/platform"
+)
+
+// HTTPSource resolves artifacts served from a templated URL.
+// A bearer token is preferred over basic auth when both are set.
+type HTTPSource struct {
+	URL      string
+	Token    string
+	Username string
+	Password string
+	Platform platform.Platform
+}
+
+// Resolve renders the URL template, or uses the URL resolved by the
+// server when it was pushed. Credentials are only ever sent to the
+// host of the configured URL.
+func (s HTTPSource) Resolve(a config.Artifact, latest bool) (config.Artifact, error) {
+	a = resolveVersion(a, latest)
+	rendered, err := renderTemplate(s.URL, a, s.Platform)
+	if err != nil {
+		return a, fmt.Errorf("rendering url template: %s", err)
+	}
+
+	if latest || a.ArchiveDownloadURL == "" {
+		a.ArchiveDownloadURL = rendered
+		return a, nil
+	}
+
+	err = sameHost(rendered, a.ArchiveDownloadURL)
+	if err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+func (s HTTPSource) Download(a config.Artifact, dlDir string, opts file.DownloadOptions) error {
+	opts.Headers = map[string]string{}
+	if s.Token != "" {
+		opts.Headers["Authorization"] = fmt.Sprintf("Bearer %s", s.Token)
+	} else if s.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", s.Username, s.Password)))
+		opts.Headers["Authorization"] = fmt.Sprintf("Basic %s", creds)
+	}
+	return file.DownloadExtract(a.ArchiveDownloadURL, dlDir, opts)
+}
+
+func sameHost(configured, pushed string) error {
+	c, err := url.Parse(configured)
+	if err != nil {
+		return fmt.Errorf("parsing configured url: %s", err)
+	}
+	p, err := url.Parse(pushed)
+	if err != nil {
+		return fmt.Errorf("parsing pushed url: %s", err)
+	}
+	if c.Scheme != p.Scheme || c.Host != p.Host {
+		return fmt.Errorf("pushed url host %s://%s does not match the configured url host %s://%s", p.Scheme, p.Host, c.Scheme, c.Host)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package artifacts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/platform"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HTTPResolve(t *testing.T) {
+	s := HTTPSource{
+		URL:      "https://artifacts.example.com/{{.ManifestName}}/{{.SHA}}/{{.ManifestName}}_{{.OS}}_{{.Arch}}{{.Variant}}.tar.gz",
+		Platform: platform.Platform{OS: "linux", Arch: "arm", Variant: "v6"},
+	}
+	a := config.Artifact{
+		RepoName:     "andrewmarklloyd/pi-test",
+		ManifestName: "pi-test",
+		SHA:          "35341f3",
+	}
+
+	resolved, err := s.Resolve(a, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://artifacts.example.com/pi-test/35341f3/pi-test_linux_armv6.tar.gz", resolved.ArchiveDownloadURL)
+
+	a.SHA = ""
+	a.Version = "v1.2.3"
+	resolved, err = s.Resolve(a, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", resolved.SHA)
+	assert.Equal(t, "https://artifacts.example.com/pi-test/v1.2.3/pi-test_linux_armv6.tar.gz", resolved.ArchiveDownloadURL)
+
+	a.ArchiveDownloadURL = "https://artifacts.example.com/pi-test/builds/35341f3.zip"
+	resolved, err = s.Resolve(a, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://artifacts.example.com/pi-test/builds/35341f3.zip", resolved.ArchiveDownloadURL)
+
+	a.ArchiveDownloadURL = "https://attacker.example.com/pi-test.zip"
+	_, err = s.Resolve(a, false)
+	assert.Equal(t, "pushed url host https://attacker.example.com does not match the configured url host https://artifacts.example.com", err.Error())
+}
+
+func Test_HTTPDownload(t *testing.T) {
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte("binary"))
+	}))
+	defer ts.Close()
+
+	a := config.Artifact{ArchiveDownloadURL: ts.URL + "/pi-test"}
+	dlDir := filepath.Join(t.TempDir(), "dl")
+
+	err := HTTPSource{Token: "secret"}.Download(a, dlDir, file.DownloadOptions{BinaryName: "pi-test"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer secret", auth)
+
+	err = HTTPSource{Username: "pi", Password: "raspberry"}.Download(a, dlDir, file.DownloadOptions{BinaryName: "pi-test"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Basic cGk6cmFzcGJlcnJ5", auth)
+
+	content, err := os.ReadFile(filepath.Join(dlDir, "pi-test"))
+	assert.NoError(t, err)
+	assert.Equal(t, "binary", string(content))
+}
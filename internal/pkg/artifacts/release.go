@@ -0,0 +1,141 @@
+package artifacts
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/github"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/platform"
+	gh "github.com/google/go-github/v42/github"
+)
+
+// ReleaseSource resolves assets attached to tagged Github Releases.
+type ReleaseSource struct {
+	// APIURL defaults to github.DefaultAPIURL
+	APIURL        string
+	AssetPatterns map[string]string
+	GHApiToken    string
+	Platform      platform.Platform
+}
+
+// Resolve selects the release tagged with the artifact version, or
+// the highest semantic version when latest is true. The tag is used
+// as the SHA so it is reported as the running version of the app.
+// The asset is downloaded through the API, the browser download URL
+// is not found for private repositories.
+func (s ReleaseSource) Resolve(a config.Artifact, latest bool) (config.Artifact, error) {
+	releases, err := github.GetReleases(githubAPIURL(s.APIURL), a.RepoName, s.GHApiToken)
+	if err != nil {
+		return a, fmt.Errorf("getting releases: %s", err)
+	}
+
+	tag := a.Version
+	if tag == "" {
+		tag = a.SHA
+	}
+	if latest {
+		tag = ""
+	}
+
+	release, err := selectRelease(releases, tag)
+	if err != nil {
+		return a, err
+	}
+
+	asset, err := selectAsset(release, s.AssetPatterns, a.Name, s.Platform)
+	if err != nil {
+		return a, err
+	}
+
+	a.Version = release.GetTagName()
+	a.SHA = release.GetTagName()
+	a.Name = asset.GetName()
+	a.ArchiveDownloadURL = asset.GetURL()
+	return a, nil
+}
+
+func (s ReleaseSource) Download(a config.Artifact, dlDir string, opts file.DownloadOptions) error {
+	opts.Headers = map[string]string{
+		// the API redirects to the content of the asset
+		"Accept": "application/octet-stream",
+	}
+	if s.GHApiToken != "" {
+		opts.Headers["Authorization"] = fmt.Sprintf("token %s", s.GHApiToken)
+	}
+	return file.DownloadExtract(a.ArchiveDownloadURL, dlDir, opts)
+}
+
+// selectRelease returns the release with the given tag, or the
+// published release with the highest semantic version when the
+// tag is empty. Drafts, pre-releases and non semver tags are
+// never selected as latest.
+func selectRelease(releases []*gh.RepositoryRelease, tag string) (*gh.RepositoryRelease, error) {
+	if tag != "" {
+		for _, r := range releases {
+			if r.GetTagName() == tag && !r.GetDraft() {
+				return r, nil
+			}
+		}
+		return nil, fmt.Errorf("no release found with tag %s", tag)
+	}
+
+	var latest *gh.RepositoryRelease
+	var latestVersion version
+	for _, r := range releases {
+		if r.GetDraft() || r.GetPrerelease() {
+			continue
+		}
+		v, ok := parseVersion(r.GetTagName())
+		if !ok || v.Prerelease != "" {
+			continue
+		}
+		if latest == nil || v.Compare(latestVersion) > 0 {
+			latest = r
+			latestVersion = v
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no published release with a semantic version tag found")
+	}
+	return latest, nil
+}
+
+// selectAsset returns the asset with the given name, or the asset
+// matching the pattern of the most specific platform the host can
+// run, falling back to the default pattern.
+func selectAsset(release *gh.RepositoryRelease, patterns map[string]string, name string, p platform.Platform) (*gh.ReleaseAsset, error) {
+	if name != "" {
+		for _, asset := range release.Assets {
+			if asset.GetName() == name {
+				return asset, nil
+			}
+		}
+		return nil, fmt.Errorf("no asset in release %s named %s", release.GetTagName(), name)
+	}
+
+	pattern, ok := "", false
+	for _, c := range p.Candidates() {
+		if pattern, ok = patterns[c]; ok {
+			break
+		}
+	}
+	if !ok {
+		pattern, ok = patterns[config.DefaultAssetPattern]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no asset pattern configured for platform %s", p)
+	}
+
+	for _, asset := range release.Assets {
+		match, err := path.Match(pattern, asset.GetName())
+		if err != nil {
+			return nil, fmt.Errorf("matching asset pattern %s: %s", pattern, err)
+		}
+		if match {
+			return asset, nil
+		}
+	}
+	return nil, fmt.Errorf("no asset in release %s matches pattern %s", release.GetTagName(), pattern)
+}
@@ -0,0 +1,145 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/platform"
+	gh "github.com/google/go-github/v42/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRelease(tag string, draft, prerelease bool, assets ...string) *gh.RepositoryRelease {
+	r := &gh.RepositoryRelease{
+		TagName:    gh.String(tag),
+		Draft:      gh.Bool(draft),
+		Prerelease: gh.Bool(prerelease),
+	}
+	for _, a := range assets {
+		r.Assets = append(r.Assets, &gh.ReleaseAsset{
+			Name: gh.String(a),
+			URL:  gh.String("https://api.github.com/repos/andrewmarklloyd/pi-test/releases/assets/" + a),
+		})
+	}
+	return r
+}
+
+func Test_SelectRelease(t *testing.T) {
+	releases := []*gh.RepositoryRelease{
+		newRelease("v2.0.0", true, false),
+		newRelease("v1.10.0-rc.1", false, true),
+		newRelease("v1.9.0", false, false),
+		newRelease("nightly", false, false),
+		newRelease("v1.10.0", false, false),
+		newRelease("v1.2.0", false, false),
+	}
+
+	r, err := selectRelease(releases, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.10.0", r.GetTagName())
+
+	r, err = selectRelease(releases, "v1.2.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.0", r.GetTagName())
+
+	r, err = selectRelease(releases, "nightly")
+	assert.NoError(t, err)
+	assert.Equal(t, "nightly", r.GetTagName())
+
+	_, err = selectRelease(releases, "v2.0.0")
+	assert.Equal(t, "no release found with tag v2.0.0", err.Error())
+
+	_, err = selectRelease([]*gh.RepositoryRelease{newRelease("nightly", false, false)}, "")
+	assert.Equal(t, "no published release with a semantic version tag found", err.Error())
+}
+
+func Test_SelectAsset(t *testing.T) {
+	r := newRelease("v1.2.3", false, false,
+		"pi-test_v1.2.3_checksums.txt",
+		"pi-test_v1.2.3_linux_armv6.zip",
+		"pi-test_v1.2.3_linux_arm64.zip",
+	)
+	patterns := map[string]string{
+		"linux/arm/v6":             "pi-test_*_linux_armv6.zip",
+		config.DefaultAssetPattern: "pi-test_*_linux_arm64.zip",
+	}
+	armv7 := platform.Platform{OS: "linux", Arch: "arm", Variant: "v7"}
+	arm64 := platform.Platform{OS: "linux", Arch: "arm64"}
+	amd64 := platform.Platform{OS: "linux", Arch: "amd64"}
+
+	a, err := selectAsset(r, patterns, "", armv7)
+	assert.NoError(t, err)
+	assert.Equal(t, "pi-test_v1.2.3_linux_armv6.zip", a.GetName())
+
+	a, err = selectAsset(r, patterns, "", arm64)
+	assert.NoError(t, err)
+	assert.Equal(t, "pi-test_v1.2.3_linux_arm64.zip", a.GetName())
+
+	a, err = selectAsset(r, patterns, "pi-test_v1.2.3_linux_arm64.zip", armv7)
+	assert.NoError(t, err)
+	assert.Equal(t, "pi-test_v1.2.3_linux_arm64.zip", a.GetName())
+
+	_, err = selectAsset(r, patterns, "pi-test_v1.2.3_linux_amd64.zip", amd64)
+	assert.Equal(t, "no asset in release v1.2.3 named pi-test_v1.2.3_linux_amd64.zip", err.Error())
+
+	_, err = selectAsset(r, map[string]string{"linux/arm/v6": "pi-test_*_linux_armv6.zip"}, "", amd64)
+	assert.Equal(t, "no asset pattern configured for platform linux/amd64", err.Error())
+
+	_, err = selectAsset(r, map[string]string{"linux/amd64": "pi-test_*_linux_amd64.zip"}, "", amd64)
+	assert.Equal(t, "no asset in release v1.2.3 matches pattern pi-test_*_linux_amd64.zip", err.Error())
+}
+
+func Test_ReleaseResolveDownload(t *testing.T) {
+	// the release is on the second page and its asset is
+	// only served to authenticated API requests
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	mux.HandleFunc("/repos/andrewmarklloyd/pi-test/releases", func(w http.ResponseWriter, r *http.Request) {
+		releases := []*gh.RepositoryRelease{}
+		switch r.URL.Query().Get("page") {
+		case "1":
+			for i := 0; i < 100; i++ {
+				releases = append(releases, newRelease(fmt.Sprintf("v1.0.%d", i), false, false))
+			}
+		case "2":
+			release := newRelease("v0.9.0", false, false)
+			release.Assets = []*gh.ReleaseAsset{{
+				Name: gh.String("pi-test"),
+				URL:  gh.String(ts.URL + "/repos/andrewmarklloyd/pi-test/releases/assets/1"),
+			}}
+			releases = append(releases, release)
+		}
+		json.NewEncoder(w).Encode(releases)
+	})
+	mux.HandleFunc("/repos/andrewmarklloyd/pi-test/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" || r.Header.Get("Accept") != "application/octet-stream" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("binary"))
+	})
+
+	s := ReleaseSource{
+		APIURL:        ts.URL,
+		AssetPatterns: map[string]string{config.DefaultAssetPattern: "pi-test"},
+		GHApiToken:    "secret",
+	}
+	a, err := s.Resolve(config.Artifact{RepoName: "andrewmarklloyd/pi-test", Version: "v0.9.0"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "v0.9.0", a.SHA)
+
+	dlDir := filepath.Join(t.TempDir(), "dl")
+	err = s.Download(a, dlDir, file.DownloadOptions{BinaryName: "pi-test"})
+	assert.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(dlDir, "pi-test"))
+	assert.NoError(t, err)
+	assert.Equal(t, "binary", string(content))
+}
@@ -0,0 +1,175 @@
+package artifacts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/platform"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	presignExpiry   = 15 * time.Minute
+)
+
+// S3Source resolves objects in an S3 compatible bucket. Objects
+// are downloaded with a presigned URL using path style addressing
+// so the source works with MinIO. Anonymous requests are made
+// when no access key is set.
+type S3Source struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Key             string
+	AccessKeyID     string
+	SecretAccessKey string
+	Platform        platform.Platform
+}
+
+// Resolve renders the key template, or uses the s3://bucket/key
+// URL resolved by the server when it was pushed.
+func (s S3Source) Resolve(a config.Artifact, latest bool) (config.Artifact, error) {
+	a = resolveVersion(a, latest)
+
+	var key string
+	if !latest && a.ArchiveDownloadURL != "" {
+		u, err := url.Parse(a.ArchiveDownloadURL)
+		if err != nil {
+			return a, fmt.Errorf("parsing pushed url: %s", err)
+		}
+		if u.Scheme != "s3" || u.Host != s.Bucket {
+			return a, fmt.Errorf("pushed url %s is not an object of bucket s3://%s", a.ArchiveDownloadURL, s.Bucket)
+		}
+		key = strings.TrimPrefix(u.Path, "/")
+	} else {
+		rendered, err := renderTemplate(s.Key, a, s.Platform)
+		if err != nil {
+			return a, fmt.Errorf("rendering key template: %s", err)
+		}
+		key = rendered
+	}
+
+	u, err := s.objectURL(key, time.Now().UTC())
+	if err != nil {
+		return a, err
+	}
+	a.ArchiveDownloadURL = u
+	return a, nil
+}
+
+func (s S3Source) Download(a config.Artifact, dlDir string, opts file.DownloadOptions) error {
+	// the presigned URL carries the credentials
+	opts.Headers = map[string]string{}
+	return file.DownloadExtract(a.ArchiveDownloadURL, dlDir, opts)
+}
+
+func (s S3Source) region() string {
+	if s.Region == "" {
+		return defaultS3Region
+	}
+	return s.Region
+}
+
+func (s S3Source) objectURL(key string, now time.Time) (string, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region())
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing endpoint: %s", err)
+	}
+	u.Path = ""
+
+	path := fmt.Sprintf("/%s/%s", s.Bucket, strings.TrimPrefix(key, "/"))
+	if s.AccessKeyID == "" {
+		return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, uriEncode(path, false)), nil
+	}
+	return presign(u, path, s.region(), s.AccessKeyID, s.SecretAccessKey, now, presignExpiry), nil
+}
+
+// presign returns a GET URL signed with AWS signature version 4
+// passed as query parameters.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func presign(endpoint *url.URL, path, region, accessKeyID, secretAccessKey string, now time.Time, expiry time.Duration) string {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    fmt.Sprintf("%s/%s", accessKeyID, scope),
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       fmt.Sprintf("%d", int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = fmt.Sprintf("%s=%s", uriEncode(k, true), uriEncode(query[k], true))
+	}
+	canonicalQuery := strings.Join(params, "&")
+	canonicalPath := uriEncode(path, false)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		canonicalPath,
+		canonicalQuery,
+		fmt.Sprintf("host:%s\n", endpoint.Host),
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", endpoint.Scheme, endpoint.Host, canonicalPath, canonicalQuery, signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent encodes everything but unreserved characters,
+// slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package artifacts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseVersion(t *testing.T) {
+	v, ok := parseVersion("v1.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, version{Major: 1, Minor: 2, Patch: 3}, v)
+
+	v, ok = parseVersion("10.0.1-rc.1+build.5")
+	assert.True(t, ok)
+	assert.Equal(t, version{Major: 10, Minor: 0, Patch: 1, Prerelease: "rc.1"}, v)
+
+	for _, tag := range []string{"", "latest", "v1.2", "v1.2.3.4", "v1.x.3", "v1.2.3-"} {
+		_, ok = parseVersion(tag)
+		assert.False(t, ok, tag)
+	}
+}
+
+func Test_CompareVersion(t *testing.T) {
+	ordered := []string{
+		"v0.9.9",
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-alpha.beta",
+		"v1.0.0-beta.2",
+		"v1.0.0-beta.11",
+		"v1.0.0-rc.1",
+		"v1.0.0",
+		"v1.2.0",
+		"v1.10.0",
+		"v2.0.0",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		lower, _ := parseVersion(ordered[i])
+		higher, _ := parseVersion(ordered[i+1])
+		assert.Equal(t, -1, lower.Compare(higher), ordered[i])
+		assert.Equal(t, 1, higher.Compare(lower), ordered[i+1])
+		assert.Equal(t, 0, lower.Compare(lower))
+	}
+}
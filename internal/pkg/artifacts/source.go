@@ -0,0 +1,167 @@
+package artifacts
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/github"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/platform"
+)
+
+// Credentials read from the secret provider by the artifact sources
+const (
+	GHApiTokenKey        = "GH_API_TOKEN"
+	ArtifactTokenKey     = "ARTIFACT_TOKEN"
+	ArtifactUsernameKey  = "ARTIFACT_USERNAME"
+	ArtifactPasswordKey  = "ARTIFACT_PASSWORD"
+	S3AccessKeyIDKey     = "S3_ACCESS_KEY_ID"
+	S3SecretAccessKeyKey = "S3_SECRET_ACCESS_KEY"
+)
+
+var credentialKeys = []string{
+	GHApiTokenKey,
+	ArtifactTokenKey,
+	ArtifactUsernameKey,
+	ArtifactPasswordKey,
+	S3AccessKeyIDKey,
+	S3SecretAccessKeyKey,
+}
+
+// Source resolves where an artifact is downloaded from.
+type Source interface {
+	// Resolve returns the artifact with its download URL set. When
+	// latest is true the newest artifact available is selected.
+	Resolve(a config.Artifact, latest bool) (config.Artifact, error)
+	// Download fetches a resolved artifact into dlDir, setting
+	// the headers of opts needed to authenticate.
+	Download(a config.Artifact, dlDir string, opts file.DownloadOptions) error
+}
+
+// NewSource returns the Source configured for an app installed
+// on a host of the given platform. Github sources use the API at
+// githubAPIURL, or github.DefaultAPIURL when it is empty.
+func NewSource(s config.ArtifactSource, credentials map[string]string, p platform.Platform, githubAPIURL string) (Source, error) {
+	switch s.SourceType() {
+	case config.ArtifactSourceActions:
+		return ActionsSource{APIURL: githubAPIURL, GHApiToken: credentials[GHApiTokenKey]}, nil
+	case config.ArtifactSourceRelease:
+		return ReleaseSource{
+			APIURL:        githubAPIURL,
+			AssetPatterns: s.AssetPatterns,
+			GHApiToken:    credentials[GHApiTokenKey],
+			Platform:      p,
+		}, nil
+	case config.ArtifactSourceHTTP:
+		return HTTPSource{
+			URL:      s.URL,
+			Token:    credentials[ArtifactTokenKey],
+			Username: credentials[ArtifactUsernameKey],
+			Password: credentials[ArtifactPasswordKey],
+			Platform: p,
+		}, nil
+	case config.ArtifactSourceS3:
+		return S3Source{
+			Endpoint:        s.Endpoint,
+			Region:          s.Region,
+			Bucket:          s.Bucket,
+			Key:             s.Key,
+			AccessKeyID:     credentials[S3AccessKeyIDKey],
+			SecretAccessKey: credentials[S3SecretAccessKeyKey],
+			Platform:        p,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown artifact source %s", s.Type)
+}
+
+// Credentials returns the values used by artifact sources
+// out of the secrets read from the secret provider.
+func Credentials(secrets map[string]string) map[string]string {
+	c := map[string]string{}
+	for _, k := range credentialKeys {
+		if v, ok := secrets[k]; ok {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// ActionsSource resolves artifacts uploaded by Github Actions workflows.
+type ActionsSource struct {
+	// APIURL defaults to github.DefaultAPIURL
+	APIURL     string
+	GHApiToken string
+}
+
+func (s ActionsSource) Resolve(a config.Artifact, latest bool) (config.Artifact, error) {
+	url, err := github.GetDownloadURLWithRetries(githubAPIURL(s.APIURL), a, latest)
+	if err != nil {
+		return a, err
+	}
+	if latest {
+		a.SHA = "HEAD"
+	}
+	a.ArchiveDownloadURL = url
+	return a, nil
+}
+
+func (s ActionsSource) Download(a config.Artifact, dlDir string, opts file.DownloadOptions) error {
+	opts.Headers = map[string]string{
+		"Authorization": fmt.Sprintf("token %s", s.GHApiToken),
+	}
+	return file.DownloadExtract(a.ArchiveDownloadURL, dlDir, opts)
+}
+
+func githubAPIURL(url string) string {
+	if url == "" {
+		return github.DefaultAPIURL
+	}
+	return url
+}
+
+// templateData is available to URL and key templates
+type templateData struct {
+	SHA          string
+	Version      string
+	Name         string
+	RepoName     string
+	ManifestName string
+	OS           string
+	Arch         string
+	Variant      string
+}
+
+func renderTemplate(t string, a config.Artifact, p platform.Platform) (string, error) {
+	tmpl, err := template.New("source").Option("missingkey=error").Parse(t)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, templateData{
+		SHA:          a.SHA,
+		Version:      a.Version,
+		Name:         a.Name,
+		RepoName:     a.RepoName,
+		ManifestName: a.ManifestName,
+		OS:           p.OS,
+		Arch:         p.Arch,
+		Variant:      p.Variant,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// resolveVersion sets the SHA used to render templates of sources
+// without a listing API, where latest must be published as such.
+func resolveVersion(a config.Artifact, latest bool) config.Artifact {
+	if latest {
+		a.SHA = "latest"
+	} else if a.SHA == "" {
+		a.SHA = a.Version
+	}
+	return a
+}
@@ -0,0 +1,93 @@
+package artifacts
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+)
+
+// ParsePublicKeys parses PEM encoded ed25519 or ECDSA P-256 public
+// keys, the latter being the default key type of cosign.
+func ParsePublicKeys(keys []string) ([]crypto.PublicKey, error) {
+	parsed := []crypto.PublicKey{}
+	for _, k := range keys {
+		block, _ := pem.Decode([]byte(k))
+		if block == nil {
+			return nil, fmt.Errorf("public key is not PEM encoded")
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key: %s", err)
+		}
+		switch p := pub.(type) {
+		case ed25519.PublicKey:
+		case *ecdsa.PublicKey:
+			if p.Curve != elliptic.P256() {
+				return nil, fmt.Errorf("only P-256 ECDSA public keys are supported")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T, ed25519 or ECDSA P-256 keys are supported", pub)
+		}
+		parsed = append(parsed, pub)
+	}
+	return parsed, nil
+}
+
+// Verifier returns a function checking a downloaded artifact against
+// the digest and signature it was published with. When keys are
+// trusted a signature made with one of them is required.
+func Verifier(i config.Integrity, keys []crypto.PublicKey) func(path string) error {
+	return func(path string) error {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading artifact: %s", err)
+		}
+		return verify(content, i, keys)
+	}
+}
+
+func verify(content []byte, i config.Integrity, keys []crypto.PublicKey) error {
+	digest := sha256.Sum256(content)
+	if i.Digest != "" {
+		actual := hex.EncodeToString(digest[:])
+		if actual != i.SHA256() {
+			return fmt.Errorf("artifact integrity check failed: expected sha256 digest %s but downloaded artifact has digest %s", i.SHA256(), actual)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	if i.Signature == "" {
+		return fmt.Errorf("artifact integrity check failed: artifact is not signed but trusted keys are configured")
+	}
+	sig, err := base64.StdEncoding.DecodeString(i.Signature)
+	if err != nil {
+		return fmt.Errorf("artifact integrity check failed: decoding signature: %s", err)
+	}
+
+	for _, k := range keys {
+		switch pub := k.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(pub, content, sig) {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(pub, digest[:], sig) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("artifact integrity check failed: signature does not match any trusted key")
+}
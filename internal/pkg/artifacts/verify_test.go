@@ -0,0 +1,83 @@
+package artifacts
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func toPEM(t *testing.T, pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func Test_ParsePublicKeys(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	keys, err := ParsePublicKeys([]string{toPEM(t, edPub), toPEM(t, &ecKey.PublicKey)})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	_, err = ParsePublicKeys([]string{"ssh-ed25519 AAAA"})
+	assert.Equal(t, "public key is not PEM encoded", err.Error())
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	_, err = ParsePublicKeys([]string{toPEM(t, &p384.PublicKey)})
+	assert.Equal(t, "only P-256 ECDSA public keys are supported", err.Error())
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	_, err = ParsePublicKeys([]string{toPEM(t, &rsaKey.PublicKey)})
+	assert.Equal(t, "unsupported public key type *rsa.PublicKey, ed25519 or ECDSA P-256 keys are supported", err.Error())
+}
+
+func Test_Verify(t *testing.T) {
+	content := []byte("artifact")
+	digest := sha256.Sum256(content)
+	hexDigest := hex.EncodeToString(digest[:])
+
+	assert.NoError(t, verify(content, config.Integrity{}, nil))
+	assert.NoError(t, verify(content, config.Integrity{Digest: "sha256:" + hexDigest}, nil))
+
+	err := verify([]byte("tampered"), config.Integrity{Digest: hexDigest}, nil)
+	assert.Contains(t, err.Error(), "artifact integrity check failed: expected sha256 digest "+hexDigest)
+
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	keys := []crypto.PublicKey{edPub, &ecKey.PublicKey}
+
+	err = verify(content, config.Integrity{Digest: hexDigest}, keys)
+	assert.Equal(t, "artifact integrity check failed: artifact is not signed but trusted keys are configured", err.Error())
+
+	edSig := base64.StdEncoding.EncodeToString(ed25519.Sign(edPriv, content))
+	assert.NoError(t, verify(content, config.Integrity{Signature: edSig}, keys))
+
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	assert.NoError(t, err)
+	assert.NoError(t, verify(content, config.Integrity{Signature: base64.StdEncoding.EncodeToString(ecSig)}, keys))
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	otherSig := base64.StdEncoding.EncodeToString(ed25519.Sign(otherPriv, content))
+	err = verify(content, config.Integrity{Signature: otherSig}, keys)
+	assert.Equal(t, "artifact integrity check failed: signature does not match any trusted key", err.Error())
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -13,6 +15,12 @@ var DeployerConfigFile = fmt.Sprintf("%s/.pi-app-deployer.config.yaml", PiAppDep
 
 type DeployerConfig struct {
 	HerokuApp string `yaml:"herokuApp"`
+	// Labels describe this agent and are matched
+	// against the selector of pushes and service actions
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// TrustedKeys are PEM encoded public keys. When set, app
+	// artifacts must be signed by one of them to be installed.
+	TrustedKeys []string `yaml:"trustedKeys,omitempty"`
 	// TODO: should this really just be a manifest?
 	AppConfigs map[string]Config `yaml:"appConfigs"`
 	Path       string            `yaml:"path,omitempty"`
@@ -60,11 +68,69 @@ func (d *DeployerConfig) SetAppConfig(c Config) {
 	d.AppConfigs[configToKey(c)] = c
 }
 
+// SetLabels removes the labels keyed by remove from the agent and
+// adds labels, overwriting the value of labels that already exist.
+func (d *DeployerConfig) SetLabels(labels map[string]string, remove []string) {
+	for _, k := range remove {
+		delete(d.Labels, k)
+	}
+	if len(labels) == 0 {
+		return
+	}
+	if d.Labels == nil {
+		d.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		d.Labels[k] = v
+	}
+}
+
+// AddTrustedKey pins a public key, ignoring keys already pinned.
+func (d *DeployerConfig) AddTrustedKey(key string) {
+	for _, k := range d.TrustedKeys {
+		if k == key {
+			return
+		}
+	}
+	d.TrustedKeys = append(d.TrustedKeys, key)
+}
+
+func (d *DeployerConfig) GetAppConfig(c Config) (Config, bool) {
+	cfg, ok := d.AppConfigs[configToKey(c)]
+	return cfg, ok
+}
+
+func (d *DeployerConfig) RemoveAppConfig(c Config) {
+	delete(d.AppConfigs, configToKey(c))
+}
+
 func (d *DeployerConfig) ConfigExists(c Config) bool {
 	_, ok := d.AppConfigs[configToKey(c)]
 	return ok
 }
 
+// DiffAppConfigs returns the sorted keys of app configs
+// added, removed and changed between two deployer configs.
+func DiffAppConfigs(previous, next map[string]Config) (added, removed, changed []string) {
+	for k, n := range next {
+		p, ok := previous[k]
+		if !ok {
+			added = append(added, k)
+		} else if !reflect.DeepEqual(p, n) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range previous {
+		if _, ok := next[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
 func configToKey(c Config) string {
 	return strings.ReplaceAll(fmt.Sprintf("%s_%s", c.RepoName, c.ManifestName), "/", "_")
 }
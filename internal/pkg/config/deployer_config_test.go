@@ -184,6 +184,13 @@ func Test_ConfigExists(t *testing.T) {
 	exists = deployerConfig.ConfigExists(c3)
 	assert.False(t, exists, "Config should NOT exist in the app configs struct")
 
+	actual, ok := deployerConfig.GetAppConfig(Config{RepoName: c2.RepoName, ManifestName: c2.ManifestName})
+	assert.True(t, ok)
+	assert.Equal(t, c2, actual)
+
+	_, ok = deployerConfig.GetAppConfig(c3)
+	assert.False(t, ok)
+
 	assert.Equal(t, "pi-app-deployer", deployerConfig.HerokuApp)
 }
 
@@ -198,3 +205,76 @@ func Test_configToKey(t *testing.T) {
 	k := configToKey(c1)
 	assert.Equal(t, "andrewmarklloyd_pi-test_pi-test-arm", k)
 }
+
+func Test_SetLabels(t *testing.T) {
+	u, _ := uuid.NewUUID()
+	testConfigPath := fmt.Sprintf("/tmp/.pi-app-deployer.app.%s.yaml", u.String())
+
+	deployerConfig, err := NewDeployerConfig(testConfigPath, "testing")
+	assert.NoError(t, err)
+	deployerConfig.SetLabels(nil, nil)
+	assert.Nil(t, deployerConfig.Labels)
+
+	deployerConfig.SetLabels(map[string]string{"model": "pi4", "location": "garage"}, nil)
+	deployerConfig.SetLabels(map[string]string{"model": "pi3"}, nil)
+	err = deployerConfig.WriteDeployerConfig()
+	assert.NoError(t, err)
+
+	deployerConfig, err = NewDeployerConfig(testConfigPath, "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"model": "pi3", "location": "garage"}, deployerConfig.Labels)
+}
+
+func Test_SetLabelsRemove(t *testing.T) {
+	u, _ := uuid.NewUUID()
+	testConfigPath := fmt.Sprintf("/tmp/.pi-app-deployer.app.%s.yaml", u.String())
+
+	deployerConfig, err := NewDeployerConfig(testConfigPath, "testing")
+	assert.NoError(t, err)
+	deployerConfig.SetLabels(nil, []string{"model"})
+	assert.Nil(t, deployerConfig.Labels)
+
+	deployerConfig.SetLabels(map[string]string{"model": "pi4", "location": "garage"}, nil)
+	deployerConfig.SetLabels(map[string]string{"location": "shed"}, []string{"model", "location"})
+	err = deployerConfig.WriteDeployerConfig()
+	assert.NoError(t, err)
+
+	deployerConfig, err = NewDeployerConfig(testConfigPath, "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"location": "shed"}, deployerConfig.Labels)
+}
+
+func Test_RemoveAppConfig(t *testing.T) {
+	deployerConfig, err := NewDeployerConfig("/tmp/does-not-exist.yaml", "testing")
+	assert.NoError(t, err)
+
+	c := Config{RepoName: "andrewmarklloyd/pi-test", ManifestName: "pi-test-arm"}
+	deployerConfig.SetAppConfig(c)
+	assert.True(t, deployerConfig.ConfigExists(c))
+	deployerConfig.RemoveAppConfig(c)
+	assert.False(t, deployerConfig.ConfigExists(c))
+}
+
+func Test_DiffAppConfigs(t *testing.T) {
+	previous := map[string]Config{
+		"a": {ManifestName: "a"},
+		"b": {ManifestName: "b", LogForwarding: false},
+		"c": {ManifestName: "c"},
+	}
+	next := map[string]Config{
+		"b": {ManifestName: "b", LogForwarding: true},
+		"c": {ManifestName: "c"},
+		"e": {ManifestName: "e"},
+		"d": {ManifestName: "d"},
+	}
+
+	added, removed, changed := DiffAppConfigs(previous, next)
+	assert.Equal(t, []string{"d", "e"}, added)
+	assert.Equal(t, []string{"a"}, removed)
+	assert.Equal(t, []string{"b"}, changed)
+
+	added, removed, changed = DiffAppConfigs(next, next)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+	assert.Empty(t, changed)
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const digestPrefix = "sha256:"
+
+// Integrity is the expected content of an artifact, checked
+// by the agent before the artifact is extracted.
+type Integrity struct {
+	// Digest is the hex encoded SHA-256 of the downloaded
+	// file, optionally prefixed with sha256:
+	Digest string `json:"digest,omitempty"`
+	// Signature is a base64 encoded detached signature of the
+	// downloaded file made with one of the keys trusted by the agent
+	Signature string `json:"signature,omitempty"`
+}
+
+// SHA256 returns the hex encoded digest without its prefix.
+func (i Integrity) SHA256() string {
+	return strings.TrimPrefix(strings.ToLower(i.Digest), digestPrefix)
+}
+
+func (i Integrity) validate() []error {
+	var errs []error
+	if i.Digest != "" {
+		b, err := hex.DecodeString(i.SHA256())
+		if err != nil || len(b) != 32 {
+			errs = append(errs, fmt.Errorf("digest must be a hex encoded SHA-256 digest"))
+		}
+	}
+	if i.Signature != "" {
+		if _, err := base64.StdEncoding.DecodeString(i.Signature); err != nil {
+			errs = append(errs, fmt.Errorf("signature must be base64 encoded"))
+		}
+	}
+	return errs
+}
+
+func sortedKeys(m map[string]Integrity) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	RolloutStrategyCanary  = "canary"
+	RolloutStrategyBatches = "batches"
+
+	// RolloutWaveTimeout is how long a wave may take before
+	// the rollout is halted
+	RolloutWaveTimeout = 15 * time.Minute
+)
+
+// Rollout describes how a push is spread across hosts. The canary
+// strategy updates the canary hosts first and the remaining hosts
+// after, the batches strategy updates BatchSize hosts at a time.
+type Rollout struct {
+	Strategy string `json:"strategy"`
+	// Hosts is an explicit list of canary hosts
+	Hosts []string `json:"hosts,omitempty"`
+	// Percentage of hosts used as canaries when Hosts is empty
+	Percentage   int `json:"percentage,omitempty"`
+	BatchSize    int `json:"batchSize,omitempty"`
+	BatchWaitSec int `json:"batchWaitSec,omitempty"`
+}
+
+func (r Rollout) Validate() error {
+	var result error
+
+	switch r.Strategy {
+	case RolloutStrategyCanary:
+		if len(r.Hosts) == 0 && (r.Percentage <= 0 || r.Percentage > 100) {
+			result = multierror.Append(result, fmt.Errorf("rollout.hosts or a rollout.percentage between 1 and 100 is required for the %s strategy", RolloutStrategyCanary))
+		}
+	case RolloutStrategyBatches:
+		if r.BatchSize <= 0 {
+			result = multierror.Append(result, fmt.Errorf("rollout.batchSize must be greater than 0 for the %s strategy", RolloutStrategyBatches))
+		}
+	default:
+		result = multierror.Append(result, fmt.Errorf("rollout.strategy must be one of: %s or %s, but was %s", RolloutStrategyCanary, RolloutStrategyBatches, r.Strategy))
+	}
+
+	if r.BatchWaitSec < 0 {
+		result = multierror.Append(result, fmt.Errorf("rollout.batchWaitSec must not be negative"))
+	}
+
+	return result
+}
+
+// Waves splits the hosts into the groups that are updated
+// together, in the order they are updated.
+func (r Rollout) Waves(hosts []string) ([][]string, error) {
+	sorted := make([]string, len(hosts))
+	copy(sorted, hosts)
+	sort.Strings(sorted)
+
+	if len(sorted) == 0 {
+		return [][]string{}, nil
+	}
+
+	switch r.Strategy {
+	case RolloutStrategyCanary:
+		canaries := []string{}
+		if len(r.Hosts) > 0 {
+			for _, h := range r.Hosts {
+				if !contains(sorted, h) {
+					return nil, fmt.Errorf("canary host %s is not configured for this app", h)
+				}
+				if contains(canaries, h) {
+					continue
+				}
+				canaries = append(canaries, h)
+			}
+		} else {
+			n := (len(sorted)*r.Percentage + 99) / 100
+			if n < 1 {
+				n = 1
+			}
+			canaries = sorted[:n]
+		}
+
+		rest := []string{}
+		for _, h := range sorted {
+			if !contains(canaries, h) {
+				rest = append(rest, h)
+			}
+		}
+
+		waves := [][]string{canaries}
+		if len(rest) > 0 {
+			waves = append(waves, rest)
+		}
+		return waves, nil
+	case RolloutStrategyBatches:
+		waves := [][]string{}
+		for i := 0; i < len(sorted); i += r.BatchSize {
+			end := i + r.BatchSize
+			if end > len(sorted) {
+				end = len(sorted)
+			}
+			waves = append(waves, sorted[i:end])
+		}
+		return waves, nil
+	}
+
+	return nil, fmt.Errorf("unknown rollout strategy %s", r.Strategy)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RolloutWavesCanary(t *testing.T) {
+	hosts := []string{"pi-4", "pi-1", "pi-3", "pi-2"}
+
+	r := Rollout{Strategy: RolloutStrategyCanary, Hosts: []string{"pi-3"}}
+	waves, err := r.Waves(hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pi-3"}, {"pi-1", "pi-2", "pi-4"}}, waves)
+
+	r = Rollout{Strategy: RolloutStrategyCanary, Hosts: []string{"pi-3", "pi-1", "pi-3"}}
+	waves, err = r.Waves(hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pi-3", "pi-1"}, {"pi-2", "pi-4"}}, waves)
+
+	r = Rollout{Strategy: RolloutStrategyCanary, Percentage: 30}
+	waves, err = r.Waves(hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pi-1", "pi-2"}, {"pi-3", "pi-4"}}, waves)
+
+	r = Rollout{Strategy: RolloutStrategyCanary, Percentage: 100}
+	waves, err = r.Waves(hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pi-1", "pi-2", "pi-3", "pi-4"}}, waves)
+
+	r = Rollout{Strategy: RolloutStrategyCanary, Hosts: []string{"pi-5"}}
+	_, err = r.Waves(hosts)
+	assert.EqualError(t, err, "canary host pi-5 is not configured for this app")
+}
+
+func Test_RolloutWavesBatches(t *testing.T) {
+	hosts := []string{"pi-4", "pi-1", "pi-5", "pi-3", "pi-2"}
+
+	r := Rollout{Strategy: RolloutStrategyBatches, BatchSize: 2}
+	waves, err := r.Waves(hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pi-1", "pi-2"}, {"pi-3", "pi-4"}, {"pi-5"}}, waves)
+
+	waves, err = r.Waves([]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{}, waves)
+}
+
+func Test_ValidateRollout(t *testing.T) {
+	a := Artifact{
+		SHA:          "35341f353d050061e4af496bbcc95f4d6fd7ea79",
+		RepoName:     "andrewmarklloyd/pi-test",
+		Name:         "app_35341f353d050061e4af496bbcc95f4d6fd7ea79",
+		ManifestName: "pi-test",
+		Rollout:      &Rollout{Strategy: RolloutStrategyBatches, BatchSize: 1, BatchWaitSec: 30},
+	}
+	assert.NoError(t, a.Validate())
+
+	a.Rollout = &Rollout{Strategy: RolloutStrategyCanary}
+	expectedErr := `1 error occurred:\n\t* rollout.hosts or a rollout.percentage between 1 and 100 is required for the canary strategy\n\n`
+	assert.Equal(t, expectedErr, a.Validate().Error())
+
+	a.Rollout = &Rollout{Strategy: "all", BatchWaitSec: -1}
+	expectedErr = `2 errors occurred:\n\t* rollout.strategy must be one of: canary or batches, but was all\n\t* rollout.batchWaitSec must not be negative\n\n`
+	assert.Equal(t, expectedErr, a.Validate().Error())
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"text/template"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// ArtifactSourceActions downloads Github Actions workflow
+	// artifacts, the default when no source is configured
+	ArtifactSourceActions = "actions"
+	// ArtifactSourceRelease downloads assets attached to
+	// tagged Github Releases
+	ArtifactSourceRelease = "release"
+	// ArtifactSourceHTTP downloads from a templated HTTP(S) URL
+	ArtifactSourceHTTP = "http"
+	// ArtifactSourceS3 downloads objects from an S3 compatible
+	// bucket such as AWS S3 or MinIO
+	ArtifactSourceS3 = "s3"
+
+	// DefaultAssetPattern is the asset pattern key used
+	// when no pattern is set for the host platform
+	DefaultAssetPattern = "default"
+)
+
+// ArtifactSource selects where the artifacts of an app are downloaded from.
+type ArtifactSource struct {
+	Type string `yaml:"type,omitempty" json:"type,omitempty"`
+	// AssetPatterns maps a platform such as linux/arm/v6 or linux/arm64 to a glob
+	// matching the name of the release asset built for it.
+	AssetPatterns map[string]string `yaml:"assetPatterns,omitempty" json:"assetPatterns,omitempty"`
+	// URL is a template for the http source, for example
+	// https://artifacts.example.com/app/{{.SHA}}/app.tar.gz
+	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+	// Endpoint, Region, Bucket and Key locate objects of the s3 source.
+	// Key is a template like URL, Endpoint defaults to AWS S3.
+	Endpoint string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	Region   string `yaml:"region,omitempty" json:"region,omitempty"`
+	Bucket   string `yaml:"bucket,omitempty" json:"bucket,omitempty"`
+	Key      string `yaml:"key,omitempty" json:"key,omitempty"`
+	// ManifestFile is the path of a manifest on the host, required
+	// when artifacts are single binaries rather than archives.
+	ManifestFile string `yaml:"manifestFile,omitempty" json:"manifestFile,omitempty"`
+}
+
+// SourceType returns the configured source type, defaulting to actions.
+func (s ArtifactSource) SourceType() string {
+	if s.Type == "" {
+		return ArtifactSourceActions
+	}
+	return s.Type
+}
+
+func (s ArtifactSource) Validate() error {
+	var result error
+
+	sourceType := s.SourceType()
+	if sourceType != ArtifactSourceRelease && len(s.AssetPatterns) > 0 {
+		result = multierror.Append(result, fmt.Errorf("assetPatterns are only supported by the %s source", ArtifactSourceRelease))
+	}
+	if sourceType != ArtifactSourceHTTP && s.URL != "" {
+		result = multierror.Append(result, fmt.Errorf("url is only supported by the %s source", ArtifactSourceHTTP))
+	}
+	if sourceType != ArtifactSourceS3 && (s.Endpoint != "" || s.Region != "" || s.Bucket != "" || s.Key != "") {
+		result = multierror.Append(result, fmt.Errorf("endpoint, region, bucket and key are only supported by the %s source", ArtifactSourceS3))
+	}
+
+	switch sourceType {
+	case ArtifactSourceActions:
+		if s.ManifestFile != "" {
+			result = multierror.Append(result, fmt.Errorf("manifestFile is not supported by the %s source", ArtifactSourceActions))
+		}
+	case ArtifactSourceRelease:
+		if len(s.AssetPatterns) == 0 {
+			result = multierror.Append(result, fmt.Errorf("at least one asset pattern is required by the %s source", ArtifactSourceRelease))
+		}
+		for arch, pattern := range s.AssetPatterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				result = multierror.Append(result, fmt.Errorf("invalid asset pattern %s for %s: %s", pattern, arch, err))
+			}
+		}
+	case ArtifactSourceHTTP:
+		if s.URL == "" {
+			result = multierror.Append(result, fmt.Errorf("url is required by the %s source", ArtifactSourceHTTP))
+		} else if err := validateSourceTemplate(s.URL); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid url template: %s", err))
+		}
+	case ArtifactSourceS3:
+		if s.Bucket == "" {
+			result = multierror.Append(result, fmt.Errorf("bucket is required by the %s source", ArtifactSourceS3))
+		}
+		if s.Key == "" {
+			result = multierror.Append(result, fmt.Errorf("key is required by the %s source", ArtifactSourceS3))
+		} else if err := validateSourceTemplate(s.Key); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid key template: %s", err))
+		}
+		if s.Endpoint != "" {
+			if u, err := url.Parse(s.Endpoint); err != nil || u.Host == "" {
+				result = multierror.Append(result, fmt.Errorf("endpoint must be a URL such as https://minio.example.com:9000"))
+			}
+		}
+	default:
+		result = multierror.Append(result, fmt.Errorf("unknown artifact source %s", s.Type))
+	}
+
+	return toOnelineErr(result)
+}
+
+func validateSourceTemplate(t string) error {
+	_, err := template.New("source").Option("missingkey=error").Parse(t)
+	return err
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ValidateArtifactSource(t *testing.T) {
+	assert.NoError(t, ArtifactSource{}.Validate())
+	assert.Equal(t, ArtifactSourceActions, ArtifactSource{}.SourceType())
+
+	s := ArtifactSource{
+		Type: ArtifactSourceRelease,
+		AssetPatterns: map[string]string{
+			"linux/arm":         "app-*-linux-armv7.zip",
+			DefaultAssetPattern: "app-*.zip",
+		},
+	}
+	assert.NoError(t, s.Validate())
+
+	s = ArtifactSource{Type: ArtifactSourceRelease}
+	expectedErr := `1 error occurred:\n\t* at least one asset pattern is required by the release source\n\n`
+	assert.Equal(t, expectedErr, s.Validate().Error())
+
+	s = ArtifactSource{Type: ArtifactSourceRelease, AssetPatterns: map[string]string{"linux/arm": "app-[.zip"}}
+	expectedErr = `1 error occurred:\n\t* invalid asset pattern app-[.zip for linux/arm: syntax error in pattern\n\n`
+	assert.Equal(t, expectedErr, s.Validate().Error())
+
+	s = ArtifactSource{Type: "ftp"}
+	expectedErr = `1 error occurred:\n\t* unknown artifact source ftp\n\n`
+	assert.Equal(t, expectedErr, s.Validate().Error())
+
+	s = ArtifactSource{Type: ArtifactSourceHTTP, URL: "https://artifacts.example.com/sample-app/{{.SHA}}/sample-app.tar.gz"}
+	assert.NoError(t, s.Validate())
+
+	s = ArtifactSource{Type: ArtifactSourceHTTP, URL: "https://artifacts.example.com/{{.SHA}", Bucket: "apps"}
+	err := s.Validate()
+	assert.Contains(t, err.Error(), `2 errors occurred:\n\t* endpoint, region, bucket and key are only supported by the s3 source\n\t* invalid url template: `)
+
+	s = ArtifactSource{Type: ArtifactSourceS3, Endpoint: "https://minio.local:9000", Bucket: "apps", Key: "sample-app/{{.SHA}}", ManifestFile: "/etc/sample-app.yaml"}
+	assert.NoError(t, s.Validate())
+
+	s = ArtifactSource{Type: ArtifactSourceS3, Endpoint: "minio"}
+	expectedErr = `3 errors occurred:\n\t* bucket is required by the s3 source\n\t* key is required by the s3 source\n\t* endpoint must be a URL such as https://minio.example.com:9000\n\n`
+	assert.Equal(t, expectedErr, s.Validate().Error())
+}
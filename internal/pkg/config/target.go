@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Target selects the agents a message is meant for. An empty
+// Target matches every agent, otherwise the agent host must be
+// in Hosts, when set, and the agent labels must contain every
+// key and value of Selector, when set.
+type Target struct {
+	Hosts    []string          `json:"hosts,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// Matches returns true if an agent with the given host and
+// labels should act on the message.
+func (t Target) Matches(host string, labels map[string]string) bool {
+	if len(t.Hosts) > 0 && !contains(t.Hosts, host) {
+		return false
+	}
+	return MatchesSelector(t.Selector, labels)
+}
+
+// MatchesSelector returns true if labels contain every
+// key and value of the selector.
+func MatchesSelector(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateLabels checks label keys and values are usable
+// in a selector.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" {
+			return fmt.Errorf("label key must not be empty")
+		}
+		if strings.ContainsAny(k+v, " \t\n,") {
+			return fmt.Errorf("label %s=%s must not contain whitespace or commas", k, v)
+		}
+	}
+	return nil
+}
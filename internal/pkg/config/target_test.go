@@ -0,0 +1,34 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TargetMatches(t *testing.T) {
+	labels := map[string]string{"model": "pi4", "location": "garage"}
+
+	assert.True(t, Target{}.Matches("pi-1", labels))
+	assert.True(t, Target{}.Matches("pi-1", nil))
+
+	hosts := Target{Hosts: []string{"pi-1", "pi-2"}}
+	assert.True(t, hosts.Matches("pi-2", labels))
+	assert.False(t, hosts.Matches("pi-3", labels))
+
+	selector := Target{Selector: map[string]string{"model": "pi4"}}
+	assert.True(t, selector.Matches("pi-3", labels))
+	assert.False(t, selector.Matches("pi-3", map[string]string{"model": "zero"}))
+	assert.False(t, selector.Matches("pi-3", nil))
+
+	both := Target{Hosts: []string{"pi-1"}, Selector: map[string]string{"location": "garage"}}
+	assert.True(t, both.Matches("pi-1", labels))
+	assert.False(t, both.Matches("pi-2", labels))
+	assert.False(t, both.Matches("pi-1", map[string]string{"location": "attic"}))
+}
+
+func Test_ValidateLabels(t *testing.T) {
+	assert.NoError(t, ValidateLabels(map[string]string{"model": "pi4"}))
+	assert.EqualError(t, ValidateLabels(map[string]string{"": "pi4"}), "label key must not be empty")
+	assert.EqualError(t, ValidateLabels(map[string]string{"model": "pi 4"}), "label model=pi 4 must not contain whitespace or commas")
+}
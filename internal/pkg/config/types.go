@@ -18,20 +18,52 @@ const (
 	RepoPushStatusTopic = "repo/push/status"
 	AgentInventoryTopic = "agent/inventory"
 	ServiceActionTopic  = "service"
+	RollbackTopic       = "repo/rollback"
+	ConfigureTopic      = "repo/configure"
+	AppCommandTopic     = "repo/command"
+	// agents ask for the artifacts last pushed for their apps on
+	// DesiredStateRequestTopic, the server answers on the topic
+	// returned by DesiredStateTopic for the host
+	DesiredStateRequestTopic = "agent/desired/request"
+	desiredStateTopicPrefix  = "agent/desired/host"
 
 	StatusUnknown    = "UNKNOWN"
 	StatusInProgress = "IN_PROGRESS"
 	StatusErr        = "ERROR"
 	StatusSuccess    = "SUCCESS"
+	// StatusHealthCheckFailed is reported when an app was
+	// updated but did not pass its manifest health check
+	StatusHealthCheckFailed = "HEALTH_CHECK_FAILED"
+	// StatusHalted is reported when a rollout was stopped
+	// because a host failed to update
+	StatusHalted = "HALTED"
 
 	ServiceActionStart   = "START"
 	ServiceActionStop    = "STOP"
 	ServiceActionRestart = "RESTART"
 
+	AppCommandInstall   = "INSTALL"
+	AppCommandUninstall = "UNINSTALL"
+
 	InventoryTickerSchedule = 30 * time.Second
 	InventoryTickerTimeout  = 5 * time.Minute
 )
 
+// AgentPublishTopics are the topics agents publish to, the
+// other topics carry commands only published by the server.
+var AgentPublishTopics = []string{
+	RepoPushStatusTopic,
+	AgentInventoryTopic,
+	LogForwarderTopic,
+	DesiredStateRequestTopic,
+}
+
+// DesiredStateTopic is the topic the desired state of a host is
+// published on, so agents only receive their own.
+func DesiredStateTopic(host string) string {
+	return fmt.Sprintf("%s/%s", desiredStateTopicPrefix, host)
+}
+
 type Log struct {
 	Message string `json:"message"`
 	Config  Config `json:"config"`
@@ -39,17 +71,130 @@ type Log struct {
 }
 
 type AgentInventoryPayload struct {
+	RepoName     string            `json:"repoName"`
+	ManifestName string            `json:"manifestName"`
+	Host         string            `json:"host"`
+	Timestamp    int64             `json:"timestamp"`
+	Transient    bool              `json:"transient"`
+	Labels       map[string]string `json:"labels"`
+	// Platform is the os/arch/variant of the agent host
+	Platform string `json:"platform"`
+	// SHA is the version of the app installed on the host
+	SHA          string `json:"sha,omitempty"`
+	AgentVersion string `json:"agentVersion,omitempty"`
+}
+
+// AppID identifies an app by its repo and manifest.
+type AppID struct {
 	RepoName     string `json:"repoName"`
 	ManifestName string `json:"manifestName"`
-	Host         string `json:"host"`
-	Timestamp    int64  `json:"timestamp"`
-	Transient    bool   `json:"transient"`
+}
+
+// DesiredStateRequest asks for the artifacts last pushed for the
+// apps installed on an agent.
+type DesiredStateRequest struct {
+	Host string  `json:"host"`
+	Apps []AppID `json:"apps"`
+	// RequestedAt is the unix time in nanoseconds, as seen by the
+	// agent, it is sent back in the answer
+	RequestedAt int64 `json:"requestedAt"`
+}
+
+// DesiredStatePayload answers a DesiredStateRequest with the
+// artifacts pushed for the apps of the agent, apps never pushed
+// are left out.
+type DesiredStatePayload struct {
+	Host        string     `json:"host"`
+	RequestedAt int64      `json:"requestedAt"`
+	Artifacts   []Artifact `json:"artifacts"`
 }
 
 type ServiceActionPayload struct {
 	RepoName     string `json:"repoName"`
 	ManifestName string `json:"manifestName"`
 	Action       string `json:"action"`
+	CommandID    string `json:"commandId,omitempty"`
+	Target
+}
+
+type RollbackPayload struct {
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+	CommandID    string `json:"commandId,omitempty"`
+	// SHA is optional, the previously installed version
+	// kept on the agent is used when it is empty.
+	SHA string `json:"sha"`
+	// ArtifactName is optional, used when the SHA is not
+	// kept on the agent and must be downloaded again.
+	ArtifactName string `json:"artifactName"`
+	// Integrity is checked when the SHA is downloaded again
+	Integrity
+	Target
+}
+
+// ConfigurePayload changes the configuration of an installed
+// app. Fields left empty keep their current value.
+type ConfigurePayload struct {
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+	CommandID    string `json:"commandId,omitempty"`
+	// EnvVars are merged into the env vars of the app
+	EnvVars       map[string]string `json:"envVars,omitempty"`
+	AppUser       string            `json:"appUser,omitempty"`
+	LogForwarding *bool             `json:"logForwarding,omitempty"`
+	Target
+}
+
+// Apply returns the config of an app changed by the payload.
+func (p ConfigurePayload) Apply(c Config) Config {
+	envVars := map[string]string{}
+	for k, v := range c.EnvVars {
+		envVars[k] = v
+	}
+	for k, v := range p.EnvVars {
+		envVars[k] = v
+	}
+	c.EnvVars = envVars
+	if p.AppUser != "" {
+		c.AppUser = p.AppUser
+	}
+	if p.LogForwarding != nil {
+		c.LogForwarding = *p.LogForwarding
+	}
+	return c
+}
+
+// AppCommandPayload installs or uninstalls an app on the
+// agents it targets, which must be selected explicitly.
+type AppCommandPayload struct {
+	Action       string `json:"action"`
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+	CommandID    string `json:"commandId,omitempty"`
+	// the fields below are only used to install an app
+	AppUser       string            `json:"appUser,omitempty"`
+	LogForwarding bool              `json:"logForwarding,omitempty"`
+	EnvVars       map[string]string `json:"envVars,omitempty"`
+	Source        ArtifactSource    `json:"source,omitempty"`
+	Version       string            `json:"version,omitempty"`
+	Integrity
+	Target
+}
+
+// Config returns the config of the app to install.
+func (p AppCommandPayload) Config() Config {
+	appUser := p.AppUser
+	if appUser == "" {
+		appUser = "pi"
+	}
+	return Config{
+		RepoName:      p.RepoName,
+		ManifestName:  p.ManifestName,
+		AppUser:       appUser,
+		LogForwarding: p.LogForwarding,
+		EnvVars:       p.EnvVars,
+		Source:        p.Source,
+	}
 }
 
 type Config struct {
@@ -59,6 +204,7 @@ type Config struct {
 	LogForwarding bool              `yaml:"logForwarding"`
 	EnvVars       map[string]string `yaml:"envVars"`
 	Executable    string            `yaml:"executable"`
+	Source        ArtifactSource    `yaml:"source,omitempty"`
 }
 
 type DeployStatusPayload struct {
@@ -66,12 +212,34 @@ type DeployStatusPayload struct {
 	ManifestName string `json:"manifestName"`
 }
 
+type DeployHistoryPayload struct {
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+	Host         string `json:"host"`
+}
+
 type Artifact struct {
 	SHA                string `json:"sha"`
 	RepoName           string `json:"repoName"`
 	Name               string `json:"name"`
 	ArchiveDownloadURL string `json:"downloadURL"`
 	ManifestName       string `json:"manifestName"`
+	// CommandID is set by the server on each publish so agents
+	// handle a push delivered more than once only once.
+	CommandID string `json:"commandId,omitempty"`
+	// Version is the release tag of an artifact published
+	// as a Github Release asset rather than by a workflow.
+	Version string `json:"version,omitempty"`
+	// Source is the artifact source the artifact was published to,
+	// ArchiveDownloadURL may be set to the resolved URL for the
+	// http source or an s3://bucket/key URL for the s3 source.
+	Source string `json:"source,omitempty"`
+	Integrity
+	// Platforms holds the integrity of artifacts built for a platform,
+	// keyed by the platform named in the manifest.
+	Platforms map[string]Integrity `json:"platforms,omitempty"`
+	Target
+	Rollout *Rollout `json:"rollout,omitempty"`
 }
 
 func (a Artifact) Validate() error {
@@ -81,21 +249,64 @@ func (a Artifact) Validate() error {
 		result = multierror.Append(result, fmt.Errorf("repoName field is required"))
 	}
 
-	if a.Name == "" {
-		result = multierror.Append(result, fmt.Errorf("name field is required"))
-	}
+	switch a.SourceType() {
+	case ArtifactSourceActions:
+		if a.Name == "" {
+			result = multierror.Append(result, fmt.Errorf("name field is required"))
+		}
 
-	if a.SHA == "" {
-		result = multierror.Append(result, fmt.Errorf("sha field is required"))
+		if a.SHA == "" {
+			result = multierror.Append(result, fmt.Errorf("sha field is required"))
+		}
+	case ArtifactSourceRelease:
+		// release assets are resolved by the agent from the tag
+		if a.Version == "" && a.SHA == "" {
+			result = multierror.Append(result, fmt.Errorf("version field is required"))
+		}
+	case ArtifactSourceHTTP, ArtifactSourceS3:
+		if a.SHA == "" {
+			result = multierror.Append(result, fmt.Errorf("sha field is required"))
+		}
+	default:
+		result = multierror.Append(result, fmt.Errorf("unknown artifact source %s", a.Source))
 	}
 
 	if a.ManifestName == "" {
 		result = multierror.Append(result, fmt.Errorf("manifestName field is required"))
 	}
 
+	for _, err := range a.Integrity.validate() {
+		result = multierror.Append(result, err)
+	}
+
+	for _, p := range sortedKeys(a.Platforms) {
+		for _, err := range a.Platforms[p].validate() {
+			result = multierror.Append(result, fmt.Errorf("platforms.%s: %s", p, err))
+		}
+	}
+
+	if a.Rollout != nil {
+		if err := a.Rollout.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
 	return toOnelineErr(result)
 }
 
+// SourceType returns the artifact source the artifact was published
+// to. Pushes without a source are release assets when they carry a
+// version and Github Actions artifacts otherwise.
+func (a Artifact) SourceType() string {
+	if a.Source != "" {
+		return a.Source
+	}
+	if a.Version != "" {
+		return ArtifactSourceRelease
+	}
+	return ArtifactSourceActions
+}
+
 func (p DeployStatusPayload) Validate() error {
 	var result error
 
@@ -110,6 +321,20 @@ func (p DeployStatusPayload) Validate() error {
 	return toOnelineErr(result)
 }
 
+func (p DeployHistoryPayload) Validate() error {
+	var result error
+
+	if p.RepoName == "" {
+		result = multierror.Append(result, fmt.Errorf("repoName field is required"))
+	}
+
+	if p.ManifestName == "" {
+		result = multierror.Append(result, fmt.Errorf("manifestName field is required"))
+	}
+
+	return toOnelineErr(result)
+}
+
 func (p ServiceActionPayload) Validate() error {
 	var result error
 
@@ -132,6 +357,85 @@ func (p ServiceActionPayload) Validate() error {
 	return toOnelineErr(result)
 }
 
+func (p RollbackPayload) Validate() error {
+	var result error
+
+	if p.RepoName == "" {
+		result = multierror.Append(result, fmt.Errorf("repoName field is required"))
+	}
+
+	if p.ManifestName == "" {
+		result = multierror.Append(result, fmt.Errorf("manifestName field is required"))
+	}
+
+	if p.ArtifactName != "" && p.SHA == "" {
+		result = multierror.Append(result, fmt.Errorf("sha field is required when artifactName is set"))
+	}
+
+	// the SHA names the snapshot directory of the version
+	if strings.ContainsAny(p.SHA, `/\`) || strings.Contains(p.SHA, "..") {
+		result = multierror.Append(result, fmt.Errorf("sha field must not contain a path, but was %s", p.SHA))
+	}
+
+	for _, err := range p.Integrity.validate() {
+		result = multierror.Append(result, err)
+	}
+
+	return toOnelineErr(result)
+}
+
+func (p ConfigurePayload) Validate() error {
+	var result error
+
+	if p.RepoName == "" {
+		result = multierror.Append(result, fmt.Errorf("repoName field is required"))
+	}
+
+	if p.ManifestName == "" {
+		result = multierror.Append(result, fmt.Errorf("manifestName field is required"))
+	}
+
+	if len(p.EnvVars) == 0 && p.AppUser == "" && p.LogForwarding == nil {
+		result = multierror.Append(result, fmt.Errorf("one of envVars, appUser or logForwarding is required"))
+	}
+
+	return toOnelineErr(result)
+}
+
+func (p AppCommandPayload) Validate() error {
+	var result error
+
+	if p.RepoName == "" {
+		result = multierror.Append(result, fmt.Errorf("repoName field is required"))
+	}
+
+	if p.ManifestName == "" {
+		result = multierror.Append(result, fmt.Errorf("manifestName field is required"))
+	}
+
+	if len(p.Hosts) == 0 && len(p.Selector) == 0 {
+		result = multierror.Append(result, fmt.Errorf("hosts or selector field is required"))
+	}
+
+	switch p.Action {
+	case AppCommandInstall:
+		if err := p.Source.Validate(); err != nil {
+			result = multierror.Append(result, fmt.Errorf("source: %s", err))
+		}
+		if p.Version != "" && p.Source.SourceType() == ArtifactSourceActions {
+			result = multierror.Append(result, fmt.Errorf("version field is not supported by the %s artifact source", ArtifactSourceActions))
+		}
+		for _, err := range p.Integrity.validate() {
+			result = multierror.Append(result, err)
+		}
+	case AppCommandUninstall:
+	default:
+		result = multierror.Append(result, fmt.Errorf("action must be one of: %s or %s, but was %s", AppCommandInstall, AppCommandUninstall, p.Action))
+	}
+
+	return toOnelineErr(result)
+}
+
 func toOnelineErr(err error) error {
 	if err != nil {
 		errString := strings.ReplaceAll(err.Error(), "\t", `\t`)
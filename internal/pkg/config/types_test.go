@@ -25,6 +25,42 @@ func Test_ValidateArtifact(t *testing.T) {
 	err = invalidArtifact.Validate()
 	expectedErr := `4 errors occurred:\n\t* repoName field is required\n\t* name field is required\n\t* sha field is required\n\t* manifestName field is required\n\n`
 	assert.Equal(t, err.Error(), expectedErr)
+
+	releaseArtifact := Artifact{
+		RepoName:     "andrewmarklloyd/pi-test",
+		ManifestName: "pi-test",
+		Version:      "v1.2.3",
+	}
+	assert.NoError(t, releaseArtifact.Validate())
+
+	httpArtifact := Artifact{
+		RepoName:           "andrewmarklloyd/pi-test",
+		ManifestName:       "pi-test",
+		Source:             ArtifactSourceHTTP,
+		ArchiveDownloadURL: "https://artifacts.example.com/pi-test/35341f3/pi-test.tar.gz",
+	}
+	expectedErr = `1 error occurred:\n\t* sha field is required\n\n`
+	assert.Equal(t, expectedErr, httpArtifact.Validate().Error())
+	httpArtifact.SHA = sha
+	assert.NoError(t, httpArtifact.Validate())
+
+	httpArtifact.Digest = "sha256:9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"
+	httpArtifact.Signature = "c2lnbmF0dXJl"
+	assert.NoError(t, httpArtifact.Validate())
+	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", httpArtifact.SHA256())
+
+	httpArtifact.Digest = "md5:098f6bcd4621d373cade4e832627b4f6"
+	httpArtifact.Signature = "not base64!"
+	expectedErr = `2 errors occurred:\n\t* digest must be a hex encoded SHA-256 digest\n\t* signature must be base64 encoded\n\n`
+	assert.Equal(t, expectedErr, httpArtifact.Validate().Error())
+
+	httpArtifact.Integrity = Integrity{}
+	httpArtifact.Platforms = map[string]Integrity{
+		"linux/arm64":  {Digest: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+		"linux/arm/v6": {Digest: "abc"},
+	}
+	expectedErr = `1 error occurred:\n\t* platforms.linux/arm/v6: digest must be a hex encoded SHA-256 digest\n\n`
+	assert.Equal(t, expectedErr, httpArtifact.Validate().Error())
 }
 
 func Test_ValidateServicActionPayload(t *testing.T) {
@@ -54,3 +90,132 @@ func Test_ValidateServicActionPayload(t *testing.T) {
 	expectedErr = `3 errors occurred:\n\t* repoName field is required\n\t* manifestName field is required\n\t* action must be one of: START, STOP, or RESTART, but was restart\n\n`
 	assert.Equal(t, err.Error(), expectedErr)
 }
+
+func Test_ValidateRollbackPayload(t *testing.T) {
+	validPayload := RollbackPayload{
+		RepoName:     "andrewmarklloyd/test",
+		ManifestName: "test",
+	}
+
+	err := validPayload.Validate()
+	assert.NoError(t, err)
+
+	invalidPayload := RollbackPayload{}
+
+	err = invalidPayload.Validate()
+	assert.Error(t, err)
+	expectedErr := `2 errors occurred:\n\t* repoName field is required\n\t* manifestName field is required\n\n`
+	assert.Equal(t, err.Error(), expectedErr)
+
+	invalidPayload = RollbackPayload{
+		RepoName:     "andrewmarklloyd/test",
+		ManifestName: "test",
+		ArtifactName: "app_35341f353d050061e4af496bbcc95f4d6fd7ea79",
+	}
+
+	err = invalidPayload.Validate()
+	assert.Error(t, err)
+	expectedErr = `1 error occurred:\n\t* sha field is required when artifactName is set\n\n`
+	assert.Equal(t, err.Error(), expectedErr)
+
+	invalidPayload = RollbackPayload{
+		RepoName:     "andrewmarklloyd/test",
+		ManifestName: "test",
+		SHA:          "../../..",
+	}
+
+	err = invalidPayload.Validate()
+	assert.Error(t, err)
+	expectedErr = `1 error occurred:\n\t* sha field must not contain a path, but was ../../..\n\n`
+	assert.Equal(t, err.Error(), expectedErr)
+}
+
+func Test_ValidateConfigurePayload(t *testing.T) {
+	validPayload := ConfigurePayload{
+		RepoName:     "andrewmarklloyd/test",
+		ManifestName: "test",
+		AppUser:      "app",
+	}
+
+	err := validPayload.Validate()
+	assert.NoError(t, err)
+
+	invalidPayload := ConfigurePayload{}
+
+	err = invalidPayload.Validate()
+	assert.Error(t, err)
+	expectedErr := `3 errors occurred:\n\t* repoName field is required\n\t* manifestName field is required\n\t* one of envVars, appUser or logForwarding is required\n\n`
+	assert.Equal(t, err.Error(), expectedErr)
+}
+
+func Test_ConfigurePayloadApply(t *testing.T) {
+	cfg := Config{
+		RepoName:      "andrewmarklloyd/test",
+		ManifestName:  "test",
+		AppUser:       "pi",
+		LogForwarding: true,
+		EnvVars:       map[string]string{"HELLO": "world", "FOO": "bar"},
+	}
+
+	logForwarding := false
+	next := ConfigurePayload{
+		EnvVars:       map[string]string{"FOO": "baz"},
+		LogForwarding: &logForwarding,
+	}.Apply(cfg)
+
+	assert.Equal(t, "pi", next.AppUser)
+	assert.False(t, next.LogForwarding)
+	assert.Equal(t, map[string]string{"HELLO": "world", "FOO": "baz"}, next.EnvVars)
+	// the config passed in is left unchanged
+	assert.Equal(t, "bar", cfg.EnvVars["FOO"])
+}
+
+func Test_ValidateAppCommandPayload(t *testing.T) {
+	validPayload := AppCommandPayload{
+		Action:       AppCommandInstall,
+		RepoName:     "andrewmarklloyd/test",
+		ManifestName: "test",
+		Target:       Target{Hosts: []string{"pi-1"}},
+	}
+
+	err := validPayload.Validate()
+	assert.NoError(t, err)
+	assert.Equal(t, "pi", validPayload.Config().AppUser)
+
+	invalidPayload := AppCommandPayload{}
+
+	err = invalidPayload.Validate()
+	assert.Error(t, err)
+	expectedErr := `4 errors occurred:\n\t* repoName field is required\n\t* manifestName field is required\n\t* hosts or selector field is required\n\t* action must be one of: INSTALL or UNINSTALL, but was \n\n`
+	assert.Equal(t, err.Error(), expectedErr)
+
+	invalidPayload = AppCommandPayload{
+		Action:       AppCommandInstall,
+		RepoName:     "andrewmarklloyd/test",
+		ManifestName: "test",
+		Version:      "v1.0.0",
+		Target:       Target{Selector: map[string]string{"model": "pi4"}},
+	}
+
+	err = invalidPayload.Validate()
+	assert.Error(t, err)
+	expectedErr = `1 error occurred:\n\t* version field is not supported by the actions artifact source\n\n`
+	assert.Equal(t, err.Error(), expectedErr)
+}
+
+func Test_ValidateDeployHistoryPayload(t *testing.T) {
+	validPayload := DeployHistoryPayload{
+		RepoName:     "andrewmarklloyd/test",
+		ManifestName: "test",
+	}
+
+	err := validPayload.Validate()
+	assert.NoError(t, err)
+
+	invalidPayload := DeployHistoryPayload{Host: "host-1"}
+
+	err = invalidPayload.Validate()
+	assert.Error(t, err)
+	expectedErr := `2 errors occurred:\n\t* repoName field is required\n\t* manifestName field is required\n\n`
+	assert.Equal(t, err.Error(), expectedErr)
+}
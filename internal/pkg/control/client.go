@@ -0,0 +1,138 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+)
+
+// ErrNotRunning is returned when no agent is listening on the socket.
+var ErrNotRunning = errors.New("the pi-app-deployer-agent update command is not running")
+
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(path string) Client {
+	return Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (c Client) Install(req InstallRequest) (config.Config, error) {
+	var cfg config.Config
+	err := c.do("POST", "/install", req, &cfg)
+	return cfg, err
+}
+
+func (c Client) Uninstall(req AppRequest) error {
+	return c.do("POST", "/uninstall", req, nil)
+}
+
+func (c Client) Restart(req AppRequest) error {
+	return c.do("POST", "/restart", req, nil)
+}
+
+func (c Client) Configure(p config.ConfigurePayload) (config.Config, error) {
+	var cfg config.Config
+	err := c.do("POST", "/configure", p, &cfg)
+	return cfg, err
+}
+
+func (c Client) Rollback(p config.RollbackPayload) error {
+	return c.do("POST", "/rollback", p, nil)
+}
+
+func (c Client) Status() ([]AppStatus, error) {
+	var apps []AppStatus
+	err := c.do("GET", "/status", nil, &apps)
+	return apps, err
+}
+
+// Logs copies the logs of an app to w until the agent stops
+// sending them or ctx is cancelled.
+func (c Client) Logs(ctx context.Context, req LogsRequest, w io.Writer) error {
+	res, err := c.send(ctx, "POST", "/logs", req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, res.Body)
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("reading logs: %s", err)
+	}
+	return nil
+}
+
+func (c Client) do(method, path string, body, out interface{}) error {
+	res, err := c.send(context.Background(), method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("parsing response: %s", err)
+	}
+	return nil
+}
+
+func (c Client) send(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("marshalling request: %s", err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	// the host is ignored, requests are always sent to the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://agent"+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %s", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, ErrNotRunning
+		}
+		return nil, fmt.Errorf("sending request to agent: %s", err)
+	}
+	return res, nil
+}
+
+func checkResponse(res *http.Response) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	var e errorResponse
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+		return fmt.Errorf("unexpected status code from agent: %d", res.StatusCode)
+	}
+	return errors.New(e.Error)
+}
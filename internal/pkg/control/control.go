@@ -0,0 +1,73 @@
+// Package control is the API the update daemon serves on a Unix
+// socket so commands run on the host go through the daemon instead
+// of changing the deployer config and systemd units themselves.
+package control
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+)
+
+var SocketPath = fmt.Sprintf("%s/.agent.sock", config.PiAppDeployerDir)
+
+// InstallRequest installs a new app.
+type InstallRequest struct {
+	Config config.Config `json:"config"`
+	// Labels are added to the labels of the agent
+	Labels map[string]string `json:"labels,omitempty"`
+	// RemoveLabels are the keys of the labels removed from the agent
+	RemoveLabels []string `json:"removeLabels,omitempty"`
+	// TrustedKeys are PEM encoded public keys to pin
+	TrustedKeys []string `json:"trustedKeys,omitempty"`
+	// Version is the release to install, defaults to the latest one
+	Version   string           `json:"version,omitempty"`
+	Integrity config.Integrity `json:"integrity"`
+}
+
+// AppRequest identifies an installed app.
+type AppRequest struct {
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+}
+
+// LogsRequest reads the logs of an installed app.
+type LogsRequest struct {
+	AppRequest
+	// Lines is the number of past lines to show
+	Lines  int  `json:"lines"`
+	Follow bool `json:"follow"`
+}
+
+// AppStatus is the state of an installed app.
+type AppStatus struct {
+	RepoName     string `json:"repoName"`
+	ManifestName string `json:"manifestName"`
+	// SHA is the version currently installed
+	SHA           string `json:"sha"`
+	Executable    string `json:"executable"`
+	ActiveState   string `json:"activeState"`
+	SubState      string `json:"subState"`
+	Enabled       bool   `json:"enabled"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+	Restarts      int    `json:"restarts"`
+	LogForwarding bool   `json:"logForwarding"`
+}
+
+// Handler runs the requests received by the server. Requests are
+// passed to the handler one at a time, apart from reading logs.
+type Handler interface {
+	Install(req InstallRequest) (config.Config, error)
+	Uninstall(req AppRequest) error
+	Restart(req AppRequest) error
+	Configure(p config.ConfigurePayload) (config.Config, error)
+	Rollback(p config.RollbackPayload) error
+	Status() ([]AppStatus, error)
+	Logs(ctx context.Context, req LogsRequest, w io.Writer) error
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,185 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHandler struct {
+	installed   []InstallRequest
+	uninstalled []AppRequest
+	rolledBack  []config.RollbackPayload
+}
+
+func (f *fakeHandler) Install(req InstallRequest) (config.Config, error) {
+	f.installed = append(f.installed, req)
+	cfg := req.Config
+	cfg.Executable = "sample-app"
+	return cfg, nil
+}
+
+func (f *fakeHandler) Uninstall(req AppRequest) error {
+	f.uninstalled = append(f.uninstalled, req)
+	return nil
+}
+
+func (f *fakeHandler) Restart(req AppRequest) error {
+	return fmt.Errorf("app %s/%s is not installed", req.RepoName, req.ManifestName)
+}
+
+func (f *fakeHandler) Configure(p config.ConfigurePayload) (config.Config, error) {
+	return p.Apply(config.Config{
+		RepoName:     p.RepoName,
+		ManifestName: p.ManifestName,
+		AppUser:      "pi",
+	}), nil
+}
+
+func (f *fakeHandler) Rollback(p config.RollbackPayload) error {
+	f.rolledBack = append(f.rolledBack, p)
+	return nil
+}
+
+func (f *fakeHandler) Status() ([]AppStatus, error) {
+	return []AppStatus{{
+		RepoName:      "andrewmarklloyd/pi-test",
+		ManifestName:  "sample-app",
+		SHA:           "abc123",
+		ActiveState:   "active",
+		UptimeSeconds: 60,
+	}}, nil
+}
+
+func (f *fakeHandler) Logs(ctx context.Context, req LogsRequest, w io.Writer) error {
+	for i := 0; i < req.Lines; i++ {
+		fmt.Fprintf(w, "%s line %d\n", req.ManifestName, i)
+	}
+	return nil
+}
+
+func newTestServer(t *testing.T) (*fakeHandler, Client) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	h := &fakeHandler{}
+	s := NewServer(h)
+	assert.NoError(t, s.Listen(path))
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return h, NewClient(path)
+}
+
+func TestInstall(t *testing.T) {
+	h, c := newTestServer(t)
+
+	cfg, err := c.Install(InstallRequest{
+		Config:  config.Config{RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app"},
+		Labels:  map[string]string{"model": "pi4"},
+		Version: "v1.2.3",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "sample-app", cfg.Executable)
+	assert.Equal(t, 1, len(h.installed))
+	assert.Equal(t, "v1.2.3", h.installed[0].Version)
+	assert.Equal(t, map[string]string{"model": "pi4"}, h.installed[0].Labels)
+}
+
+func TestUninstall(t *testing.T) {
+	h, c := newTestServer(t)
+
+	req := AppRequest{RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app"}
+	assert.NoError(t, c.Uninstall(req))
+	assert.Equal(t, []AppRequest{req}, h.uninstalled)
+}
+
+func TestHandlerError(t *testing.T) {
+	_, c := newTestServer(t)
+
+	err := c.Restart(AppRequest{RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app"})
+	assert.EqualError(t, err, "app andrewmarklloyd/pi-test/sample-app is not installed")
+}
+
+func TestConfigure(t *testing.T) {
+	_, c := newTestServer(t)
+
+	logForwarding := true
+	cfg, err := c.Configure(config.ConfigurePayload{
+		RepoName:      "andrewmarklloyd/pi-test",
+		ManifestName:  "sample-app",
+		LogForwarding: &logForwarding,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "pi", cfg.AppUser)
+	assert.True(t, cfg.LogForwarding)
+}
+
+func TestRollback(t *testing.T) {
+	h, c := newTestServer(t)
+
+	p := config.RollbackPayload{RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app", SHA: "abc123"}
+	assert.NoError(t, c.Rollback(p))
+	assert.Equal(t, []config.RollbackPayload{p}, h.rolledBack)
+}
+
+func TestStatus(t *testing.T) {
+	_, c := newTestServer(t)
+
+	apps, err := c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(apps))
+	assert.Equal(t, "sample-app", apps[0].ManifestName)
+	assert.Equal(t, "abc123", apps[0].SHA)
+	assert.Equal(t, "active", apps[0].ActiveState)
+	assert.Equal(t, int64(60), apps[0].UptimeSeconds)
+	assert.False(t, apps[0].Enabled)
+}
+
+func TestLogs(t *testing.T) {
+	_, c := newTestServer(t)
+
+	var out bytes.Buffer
+	err := c.Logs(context.Background(), LogsRequest{
+		AppRequest: AppRequest{RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app"},
+		Lines:      2,
+	}, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "sample-app line 0\nsample-app line 1\n", out.String())
+}
+
+func TestListenPermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.sock")
+	// a socket left over by a previous agent is replaced
+	assert.NoError(t, os.WriteFile(path, nil, 0666))
+
+	s := NewServer(&fakeHandler{})
+	assert.NoError(t, s.Listen(path))
+	go s.Serve()
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	_, err = NewClient(path).Status()
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNotRunning(t *testing.T) {
+	c := NewClient(filepath.Join(t.TempDir(), "agent.sock"))
+
+	_, err := c.Status()
+	assert.Equal(t, ErrNotRunning, err)
+}
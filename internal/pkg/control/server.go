@@ -0,0 +1,207 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/gorilla/mux"
+)
+
+type Server struct {
+	handler Handler
+	// mu serializes the requests changing the state of the agent
+	mu       sync.Mutex
+	listener net.Listener
+	path     string
+}
+
+func NewServer(h Handler) *Server {
+	return &Server{handler: h}
+}
+
+// Listen opens the socket at path, replacing a socket left over by a
+// previous agent. Only root can connect to it: the socket is created
+// in a directory only root can enter and moved to path once its
+// permissions are set.
+func (s *Server) Listen(path string) error {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".")
+	if err != nil {
+		return fmt.Errorf("creating socket directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the names are kept short, socket paths are limited to 108 bytes
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return fmt.Errorf("listening on socket: %s", err)
+	}
+	// the socket is removed from path by Close
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("setting socket permissions: %s", err)
+	}
+	// renaming replaces the socket of a previous agent
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return fmt.Errorf("moving socket: %s", err)
+	}
+	s.listener = l
+	s.path = path
+	return nil
+}
+
+// Serve handles requests until the server is closed.
+func (s *Server) Serve() error {
+	err := http.Serve(s.listener, s.router())
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	// like the listener, a socket which is already gone is ignored
+	os.Remove(s.path)
+	return err
+}
+
+// Lock blocks requests changing the state of the agent, letting
+// the caller change it without racing with the requests.
+func (s *Server) Lock() {
+	s.mu.Lock()
+}
+
+func (s *Server) Unlock() {
+	s.mu.Unlock()
+}
+
+func (s *Server) router() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/install", s.handleInstall).Methods("POST")
+	router.HandleFunc("/uninstall", s.handleUninstall).Methods("POST")
+	router.HandleFunc("/restart", s.handleRestart).Methods("POST")
+	router.HandleFunc("/configure", s.handleConfigure).Methods("POST")
+	router.HandleFunc("/rollback", s.handleRollback).Methods("POST")
+	router.HandleFunc("/status", s.handleStatus).Methods("GET")
+	router.HandleFunc("/logs", s.handleLogs).Methods("POST")
+	return router
+}
+
+func (s *Server) handleInstall(w http.ResponseWriter, r *http.Request) {
+	var req InstallRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg, err := s.handler.Install(req)
+	respond(w, cfg, err)
+}
+
+func (s *Server) handleUninstall(w http.ResponseWriter, r *http.Request) {
+	var req AppRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	respond(w, struct{}{}, s.handler.Uninstall(req))
+}
+
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	var req AppRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	respond(w, struct{}{}, s.handler.Restart(req))
+}
+
+func (s *Server) handleConfigure(w http.ResponseWriter, r *http.Request) {
+	var p config.ConfigurePayload
+	if !decode(w, r, &p) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg, err := s.handler.Configure(p)
+	respond(w, cfg, err)
+}
+
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	var p config.RollbackPayload
+	if !decode(w, r, &p) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	respond(w, struct{}{}, s.handler.Rollback(p))
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	apps, err := s.handler.Status()
+	respond(w, apps, err)
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	var req LogsRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	err := s.handler.Logs(r.Context(), req, flushWriter{w})
+	if err != nil && r.Context().Err() == nil {
+		// the status was sent with the first line of logs,
+		// the error can only be appended to the output
+		fmt.Fprintf(w, "error reading logs: %s\n", err)
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, fmt.Sprintf("parsing request: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func respond(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, msg string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
+
+// flushWriter sends logs to the client as soon as they are written
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
@@ -4,13 +4,15 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/user"
+	"strconv"
 )
 
 const (
 	defaultUserID = 1000
 )
 
-func doCopyWithOwnership(src, dest string) error {
+func (h Host) doCopyWithOwnership(src, dest string) error {
 	source, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("opening source file: %s", err)
@@ -27,16 +29,16 @@ func doCopyWithOwnership(src, dest string) error {
 		return fmt.Errorf("copying source to destination file: %s", err)
 	}
 
-	err = os.Chown(dest, defaultUserID, defaultUserID)
+	err = h.chown(dest, defaultUserID, defaultUserID)
 	if err != nil {
 		return fmt.Errorf("changing ownership of file: %s", err)
 	}
 	return nil
 }
 
-func CopyWithOwnership(srcDestMap map[string]string) error {
+func (h Host) CopyWithOwnership(srcDestMap map[string]string) error {
 	for s, d := range srcDestMap {
-		err := doCopyWithOwnership(s, d)
+		err := h.doCopyWithOwnership(s, d)
 		if err != nil {
 			return err
 		}
@@ -60,3 +62,30 @@ func MoveFile(src, dest string) error {
 	}
 	return nil
 }
+
+// MakeOwnedDir creates a directory only accessible
+// by the given user.
+func (h Host) MakeOwnedDir(path, username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("looking up user %s: %s", username, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("parsing uid of user %s: %s", username, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("parsing gid of user %s: %s", username, err)
+	}
+
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		return fmt.Errorf("creating directory %s: %s", path, err)
+	}
+	err = h.chown(path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("changing ownership of directory %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+)
+
+// Host is the machine the agent manages. The zero value is the host
+// the agent runs on, tests keep the files of the host under a
+// temporary directory and replace the commands changing it.
+type Host struct {
+	// Root is prepended to the paths of the files managed on the host
+	Root string
+	// Systemctl runs systemctl and returns its combined output
+	Systemctl func(args ...string) (string, error)
+	// Chown changes the owner of the files installed on the host
+	Chown func(path string, uid, gid int) error
+}
+
+// Path returns the path of a file managed on the host.
+func (h Host) Path(path string) string {
+	return filepath.Join(h.Root, path)
+}
+
+// AppDir is the directory apps are installed in.
+func (h Host) AppDir() string {
+	return h.Path(config.PiAppDeployerDir)
+}
+
+// UnitFile is the systemd unit file of an app.
+func (h Host) UnitFile(name string) string {
+	return h.Path(fmt.Sprintf("%s/%s.service", systemDPath, name))
+}
+
+func (h Host) systemctl(args ...string) (string, error) {
+	if h.Systemctl != nil {
+		return h.Systemctl(args...)
+	}
+	cmd := exec.Command("systemctl", args...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func (h Host) chown(path string, uid, gid int) error {
+	if h.Chown != nil {
+		return h.Chown(path, uid, gid)
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -1,7 +1,10 @@
 package file
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,7 +13,22 @@ import (
 	"strings"
 )
 
-func DownloadExtract(url, dlDir, ghApiToken string) error {
+// DownloadOptions control how an artifact is downloaded and extracted.
+type DownloadOptions struct {
+	Headers map[string]string
+	// BinaryName is the name given to artifacts that are
+	// single binaries rather than archives.
+	BinaryName string
+	// Verify is called with the path of the downloaded
+	// artifact before anything is extracted.
+	Verify func(path string) error
+}
+
+// DownloadExtract downloads an artifact into dlDir. Zip and gzipped
+// tar archives are extracted, any other file is treated as a single
+// binary and saved as opts.BinaryName, which is then required. A
+// gzipped file that is not a tar archive is a compressed binary.
+func DownloadExtract(url, dlDir string, opts DownloadOptions) error {
 	err := os.RemoveAll(dlDir)
 	if err != nil {
 		return fmt.Errorf("removing download directory: %s", err)
@@ -20,28 +38,214 @@ func DownloadExtract(url, dlDir, ghApiToken string) error {
 		return fmt.Errorf("creating download directory: %s", err)
 	}
 
-	zip := fmt.Sprintf("%s/artifact.zip", dlDir)
-	out, err := os.Create(zip)
+	artifact := fmt.Sprintf("%s/.artifact", dlDir)
+	err = download(url, artifact, opts.Headers)
+	if err != nil {
+		return err
+	}
+
+	if opts.Verify != nil {
+		err = opts.Verify(artifact)
+		if err != nil {
+			return err
+		}
+	}
+
+	format, err := detectFormat(artifact)
+	if err != nil {
+		return fmt.Errorf("detecting artifact format: %s", err)
+	}
+
+	switch format {
+	case formatZip:
+		err = unzip(artifact, dlDir)
+	case formatTarGz:
+		err = untar(artifact, dlDir)
+	default:
+		if opts.BinaryName == "" {
+			return fmt.Errorf("artifact is not a zip or tar.gz archive and no binary name was provided")
+		}
+		if filepath.Base(opts.BinaryName) != opts.BinaryName {
+			return fmt.Errorf("illegal binary name: %s", opts.BinaryName)
+		}
+		binary := filepath.Join(dlDir, opts.BinaryName)
+		if format == formatGzip {
+			err = gunzip(artifact, binary)
+			if err != nil {
+				return fmt.Errorf("decompressing artifact: %s", err)
+			}
+			err = os.Remove(artifact)
+		} else {
+			err = os.Rename(artifact, binary)
+		}
+		if err != nil {
+			return err
+		}
+		return os.Chmod(binary, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(artifact)
+}
+
+func download(url, dest string, headers map[string]string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
 	defer out.Close()
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", ghApiToken))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading artifact, received status code: %d", resp.StatusCode)
+	}
+
 	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+const (
+	formatZip    = "zip"
+	formatTarGz  = "tar.gz"
+	formatGzip   = "gz"
+	formatBinary = "binary"
+)
+
+// tarMagicOffset is where the ustar magic of POSIX
+// and GNU tar headers starts.
+const tarMagicOffset = 257
+
+// detectFormat reads the magic bytes of a file since download
+// URLs do not reliably end with the archive extension.
+func detectFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return formatZip, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		tarHeader := make([]byte, tarMagicOffset+5)
+		n, err := io.ReadFull(gz, tarHeader)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return "", err
+		}
+		if n == len(tarHeader) && string(tarHeader[tarMagicOffset:]) == "ustar" {
+			return formatTarGz, nil
+		}
+		return formatGzip, nil
+	}
+	return formatBinary, nil
+}
 
+func gunzip(src, dest string) error {
+	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, gz)
+	return err
+}
+
+func untar(src, dest string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dest, hdr.Name)
+
+		// Check for directory traversal
+		if !strings.HasPrefix(path, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal file path: %s", path)
+		}
 
-	return unzip(zip, dlDir)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			// links and devices are not expected in app artifacts
+			continue
+		}
+	}
 }
 
 func unzip(src, dest string) error {
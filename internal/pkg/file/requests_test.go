@@ -0,0 +1,125 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var artifactFiles = map[string]string{
+	".pi-app-deployer.yaml": "name: sample-app\n",
+	"sample-app":            "#!/bin/sh\n",
+}
+
+func zipArtifact(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range artifactFiles {
+		f, err := w.Create(name)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func tarGzArtifact(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	for name, content := range artifactFiles {
+		err := w.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func gzArtifact(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func Test_DownloadExtract(t *testing.T) {
+	artifacts := map[string][]byte{
+		"/app.zip":    zipArtifact(t),
+		"/app.tar.gz": tarGzArtifact(t),
+		"/app":        []byte("\x7fELF binary"),
+		"/app.gz":     gzArtifact(t, "\x7fELF binary"),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		a, ok := artifacts[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(a)
+	}))
+	defer ts.Close()
+	opts := DownloadOptions{Headers: map[string]string{"Authorization": "Bearer secret"}}
+
+	for _, path := range []string{"/app.zip", "/app.tar.gz"} {
+		dlDir := filepath.Join(t.TempDir(), "dl")
+		err := DownloadExtract(ts.URL+path, dlDir, opts)
+		assert.NoError(t, err, path)
+		for name, content := range artifactFiles {
+			actual, err := os.ReadFile(filepath.Join(dlDir, name))
+			assert.NoError(t, err, path)
+			assert.Equal(t, content, string(actual), path)
+		}
+		_, err = os.Stat(filepath.Join(dlDir, ".artifact"))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	dlDir := filepath.Join(t.TempDir(), "dl")
+	binaryOpts := opts
+	binaryOpts.BinaryName = "sample-app"
+	err := DownloadExtract(ts.URL+"/app", dlDir, binaryOpts)
+	assert.NoError(t, err)
+	info, err := os.Stat(filepath.Join(dlDir, "sample-app"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// a gzipped binary is not mistaken for a tar archive
+	err = DownloadExtract(ts.URL+"/app.gz", dlDir, binaryOpts)
+	assert.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(dlDir, "sample-app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "\x7fELF binary", string(content))
+
+	err = DownloadExtract(ts.URL+"/app", dlDir, opts)
+	assert.Equal(t, "artifact is not a zip or tar.gz archive and no binary name was provided", err.Error())
+
+	err = DownloadExtract(ts.URL+"/app.zip", dlDir, DownloadOptions{})
+	assert.Equal(t, "downloading artifact, received status code: 401", err.Error())
+
+	verifyOpts := opts
+	verifyOpts.Verify = func(path string) error {
+		return fmt.Errorf("digest mismatch")
+	}
+	err = DownloadExtract(ts.URL+"/app.zip", dlDir, verifyOpts)
+	assert.Equal(t, "digest mismatch", err.Error())
+	_, err = os.Stat(filepath.Join(dlDir, "sample-app"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,266 @@
+package file
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	snapshotRetention = 3
+)
+
+// Snapshot is a copy of the files making up an installed
+// app, kept so the app can be restored if an update fails.
+type Snapshot struct {
+	ManifestName string
+	SHA          string
+	Dir          string
+}
+
+// Empty returns true when no app was installed at the time
+// the snapshot was requested, e.g. during a first install.
+func (s Snapshot) Empty() bool {
+	return s.Dir == ""
+}
+
+// CreateSnapshot copies the currently installed binary, run script,
+// env file, manifest and systemd unit for an app into a directory keyed by the
+// installed SHA. Only the most recent snapshots are kept.
+func (h Host) CreateSnapshot(manifestName, executable string) (Snapshot, error) {
+	return createSnapshot(h.AppDir(), h.Path(systemDPath), manifestName, executable)
+}
+
+// RestoreSnapshot copies the files of a snapshot back into place.
+// It is up to the caller to reload and restart the systemd unit.
+func (h Host) RestoreSnapshot(s Snapshot) error {
+	return restoreSnapshot(h.AppDir(), h.Path(systemDPath), s)
+}
+
+// FindSnapshot returns the snapshot kept for the given SHA.
+func (h Host) FindSnapshot(manifestName, sha string) (Snapshot, error) {
+	return findSnapshot(h.AppDir(), manifestName, sha)
+}
+
+// ListSnapshots returns the snapshots kept for an app, newest first.
+func (h Host) ListSnapshots(manifestName string) ([]Snapshot, error) {
+	return listSnapshots(h.AppDir(), manifestName)
+}
+
+// ReadAppVersion returns the APP_VERSION written to the
+// env file of an installed app.
+func (h Host) ReadAppVersion(manifestName string) (string, error) {
+	return readAppVersion(getServiceEnvFileNameByName(manifestName, h.AppDir()))
+}
+
+func createSnapshot(appDir, unitDir, manifestName, executable string) (Snapshot, error) {
+	envFile := getServiceEnvFileNameByName(manifestName, appDir)
+	sha, err := readAppVersion(envFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Snapshot{}, nil
+		}
+		return Snapshot{}, fmt.Errorf("reading installed app version: %s", err)
+	}
+
+	s := Snapshot{
+		ManifestName: manifestName,
+		SHA:          sha,
+		Dir:          filepath.Join(getSnapshotRoot(appDir, manifestName), sha),
+	}
+
+	err = os.RemoveAll(s.Dir)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("removing previous snapshot directory: %s", err)
+	}
+	err = os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("creating snapshot directory: %s", err)
+	}
+
+	for _, src := range snapshotFiles(appDir, unitDir, manifestName, executable) {
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		err := copyFile(src, filepath.Join(s.Dir, filepath.Base(src)))
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("copying %s to snapshot: %s", src, err)
+		}
+	}
+
+	err = pruneSnapshots(appDir, manifestName, snapshotRetention)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("pruning snapshots: %s", err)
+	}
+
+	return s, nil
+}
+
+func restoreSnapshot(appDir, unitDir string, s Snapshot) error {
+	if s.Empty() {
+		return fmt.Errorf("snapshot for %s is empty", s.ManifestName)
+	}
+
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return fmt.Errorf("reading snapshot directory: %s", err)
+	}
+
+	unitFile := fmt.Sprintf("%s.service", s.ManifestName)
+	for _, e := range entries {
+		dest := filepath.Join(appDir, e.Name())
+		if e.Name() == unitFile {
+			dest = filepath.Join(unitDir, e.Name())
+		}
+		err := copyFile(filepath.Join(s.Dir, e.Name()), dest)
+		if err != nil {
+			return fmt.Errorf("restoring %s: %s", dest, err)
+		}
+	}
+	return nil
+}
+
+func findSnapshot(appDir, manifestName, sha string) (Snapshot, error) {
+	root := getSnapshotRoot(appDir, manifestName)
+	dir := filepath.Join(root, sha)
+	if filepath.Dir(dir) != root {
+		return Snapshot{}, fmt.Errorf("SHA %s is not a snapshot of %s", sha, manifestName)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return Snapshot{}, fmt.Errorf("no snapshot found for %s at SHA %s", manifestName, sha)
+	}
+	return Snapshot{
+		ManifestName: manifestName,
+		SHA:          sha,
+		Dir:          dir,
+	}, nil
+}
+
+func listSnapshots(appDir, manifestName string) ([]Snapshot, error) {
+	root := getSnapshotRoot(appDir, manifestName)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Snapshot{}, nil
+		}
+		return nil, err
+	}
+
+	type entry struct {
+		snapshot Snapshot
+		modTime  int64
+	}
+	var found []entry
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, entry{
+			snapshot: Snapshot{
+				ManifestName: manifestName,
+				SHA:          e.Name(),
+				Dir:          filepath.Join(root, e.Name()),
+			},
+			modTime: info.ModTime().UnixNano(),
+		})
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].modTime > found[j].modTime
+	})
+
+	snapshots := make([]Snapshot, len(found))
+	for i, f := range found {
+		snapshots[i] = f.snapshot
+	}
+	return snapshots, nil
+}
+
+func pruneSnapshots(appDir, manifestName string, keep int) error {
+	snapshots, err := listSnapshots(appDir, manifestName)
+	if err != nil {
+		return err
+	}
+	for i, s := range snapshots {
+		if i < keep {
+			continue
+		}
+		if err := os.RemoveAll(s.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func snapshotFiles(appDir, unitDir, manifestName, executable string) []string {
+	files := []string{
+		getServiceEnvFileNameByName(manifestName, appDir),
+		getInstalledManifestFileName(manifestName, appDir),
+		// run scripts are only found on apps installed
+		// before units started the agent exec command
+		filepath.Join(appDir, fmt.Sprintf("run-%s.sh", manifestName)),
+		filepath.Join(unitDir, fmt.Sprintf("%s.service", manifestName)),
+	}
+	if executable != "" {
+		files = append(files, filepath.Join(appDir, executable))
+	}
+	return files
+}
+
+func readAppVersion(envFile string) (string, error) {
+	f, err := os.Open(envFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "APP_VERSION=") {
+			return strings.TrimPrefix(line, "APP_VERSION="), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("APP_VERSION not found in %s", envFile)
+}
+
+func copyFile(src, dest string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	destination, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	_, err = io.Copy(destination, source)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dest, info.Mode())
+}
+
+func getSnapshotRoot(appDir, manifestName string) string {
+	return filepath.Join(appDir, ".snapshots", manifestName)
+}
@@ -0,0 +1,106 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestApp(t *testing.T, appDir, unitDir, sha string) {
+	files := map[string]string{
+		filepath.Join(appDir, ".sample-app.env"):           fmt.Sprintf("HEROKU_API_KEY=abc\nAPP_VERSION=%s", sha),
+		filepath.Join(appDir, ".sample-app.manifest.yaml"): fmt.Sprintf("manifest %s", sha),
+		filepath.Join(appDir, "run-sample-app.sh"):         fmt.Sprintf("run %s", sha),
+		filepath.Join(appDir, "sample-app-agent"):          fmt.Sprintf("binary %s", sha),
+		filepath.Join(unitDir, "sample-app.service"):       fmt.Sprintf("unit %s", sha),
+	}
+	for p, c := range files {
+		assert.NoError(t, os.WriteFile(p, []byte(c), 0755))
+	}
+}
+
+func Test_SnapshotNotInstalled(t *testing.T) {
+	appDir := t.TempDir()
+	unitDir := t.TempDir()
+
+	s, err := createSnapshot(appDir, unitDir, "sample-app", "sample-app-agent")
+	assert.NoError(t, err)
+	assert.True(t, s.Empty())
+}
+
+func Test_SnapshotRestore(t *testing.T) {
+	appDir := t.TempDir()
+	unitDir := t.TempDir()
+
+	writeTestApp(t, appDir, unitDir, "abc123")
+	s, err := createSnapshot(appDir, unitDir, "sample-app", "sample-app-agent")
+	assert.NoError(t, err)
+	assert.False(t, s.Empty())
+	assert.Equal(t, "abc123", s.SHA)
+	assert.Equal(t, filepath.Join(appDir, ".snapshots", "sample-app", "abc123"), s.Dir)
+
+	writeTestApp(t, appDir, unitDir, "def456")
+	err = restoreSnapshot(appDir, unitDir, s)
+	assert.NoError(t, err)
+
+	b, err := os.ReadFile(filepath.Join(appDir, "sample-app-agent"))
+	assert.NoError(t, err)
+	assert.Equal(t, "binary abc123", string(b))
+
+	b, err = os.ReadFile(filepath.Join(unitDir, "sample-app.service"))
+	assert.NoError(t, err)
+	assert.Equal(t, "unit abc123", string(b))
+
+	info, err := os.Stat(filepath.Join(appDir, "sample-app-agent"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+
+	sha, err := readAppVersion(filepath.Join(appDir, ".sample-app.env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", sha)
+}
+
+func Test_SnapshotRetention(t *testing.T) {
+	appDir := t.TempDir()
+	unitDir := t.TempDir()
+
+	// snapshots are ordered by mtime, which can be equal when
+	// they are created within the resolution of the filesystem
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < snapshotRetention+2; i++ {
+		writeTestApp(t, appDir, unitDir, fmt.Sprintf("sha-%d", i))
+		s, err := createSnapshot(appDir, unitDir, "sample-app", "sample-app-agent")
+		assert.NoError(t, err)
+		mtime := start.Add(time.Duration(i) * time.Minute)
+		assert.NoError(t, os.Chtimes(s.Dir, mtime, mtime))
+	}
+
+	snapshots, err := listSnapshots(appDir, "sample-app")
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, snapshotRetention)
+
+	_, err = findSnapshot(appDir, "sample-app", "sha-0")
+	assert.Error(t, err)
+
+	s, err := findSnapshot(appDir, "sample-app", fmt.Sprintf("sha-%d", snapshotRetention+1))
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("sha-%d", snapshotRetention+1), s.SHA)
+}
+
+func Test_FindSnapshotOutsideRoot(t *testing.T) {
+	appDir := t.TempDir()
+	unitDir := t.TempDir()
+
+	writeTestApp(t, appDir, unitDir, "abc123")
+	_, err := createSnapshot(appDir, unitDir, "sample-app", "sample-app-agent")
+	assert.NoError(t, err)
+
+	for _, sha := range []string{"..", "../..", "abc123/..", "."} {
+		_, err = findSnapshot(appDir, "sample-app", sha)
+		assert.Error(t, err, sha)
+	}
+}
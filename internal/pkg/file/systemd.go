@@ -2,10 +2,15 @@ package file
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -18,28 +23,28 @@ type Syslog struct {
 	Error      error
 }
 
-func SetupSystemdUnits(unitName string) error {
-	output, err := runSystemctlCommand("daemon-reload")
+func (h Host) SetupSystemdUnits(unitName string) error {
+	output, err := h.systemctl("daemon-reload")
 	if err != nil {
 		return fmt.Errorf("running daemon-reload: %s, %s", err, output)
 	}
 
-	output, err = runSystemctlCommand("start", unitName)
+	output, err = h.systemctl("start", unitName)
 	if err != nil {
 		return fmt.Errorf("starting %s systemd unit: %s, %s", unitName, err, output)
 	}
 
-	output, err = runSystemctlCommand("enable", unitName)
+	output, err = h.systemctl("enable", unitName)
 	if err != nil {
 		return fmt.Errorf("enabling %s systemd unit: %s, %s", unitName, err, output)
 	}
 
-	output, err = runSystemctlCommand("start", "pi-app-deployer-agent")
+	output, err = h.systemctl("start", "pi-app-deployer-agent")
 	if err != nil {
 		return fmt.Errorf("starting pi-app-deployer-agent systemd unit: %s, %s", err, output)
 	}
 
-	output, err = runSystemctlCommand("enable", "pi-app-deployer-agent")
+	output, err = h.systemctl("enable", "pi-app-deployer-agent")
 	if err != nil {
 		return fmt.Errorf("enabling pi-app-deployer-agent systemd unit: %s, %s", err, output)
 	}
@@ -47,8 +52,8 @@ func SetupSystemdUnits(unitName string) error {
 	return nil
 }
 
-func StopSystemdUnit(unitName string) error {
-	output, err := runSystemctlCommand("stop", unitName)
+func (h Host) StopSystemdUnit(unitName string) error {
+	output, err := h.systemctl("stop", unitName)
 	if err != nil {
 		notLoadedErr := fmt.Sprintf("Failed to stop %s.service: Unit %s.service not loaded.\n", unitName, unitName)
 		if output == notLoadedErr {
@@ -59,24 +64,24 @@ func StopSystemdUnit(unitName string) error {
 	return nil
 }
 
-func StartSystemdUnit(unitName string) error {
-	output, err := runSystemctlCommand("start", unitName)
+func (h Host) StartSystemdUnit(unitName string) error {
+	output, err := h.systemctl("start", unitName)
 	if err != nil {
 		return fmt.Errorf("stopping systemd unit: %s: %s", err, output)
 	}
 	return nil
 }
 
-func RestartSystemdUnit(unitName string) error {
-	output, err := runSystemctlCommand("restart", unitName)
+func (h Host) RestartSystemdUnit(unitName string) error {
+	output, err := h.systemctl("restart", unitName)
 	if err != nil {
 		return fmt.Errorf("stopping systemd unit: %s: %s", err, output)
 	}
 	return nil
 }
 
-func SystemdUnitEnabled(unitName string) (bool, error) {
-	output, err := runSystemctlCommand("is-enabled", unitName)
+func (h Host) SystemdUnitEnabled(unitName string) (bool, error) {
+	output, err := h.systemctl("is-enabled", unitName)
 	if err != nil {
 		notInstalledErr := fmt.Sprintf("Failed to get unit file state for %s.service: No such file or directory\n", unitName)
 		if output == notInstalledErr {
@@ -91,54 +96,167 @@ func SystemdUnitEnabled(unitName string) (bool, error) {
 	return false, nil
 }
 
-func DaemonReload() error {
-	output, err := runSystemctlCommand("daemon-reload")
+// UnitState is the state of a systemd unit as reported by systemctl show.
+type UnitState struct {
+	ActiveState   string
+	SubState      string
+	UnitFileState string
+	// Uptime is how long the unit has been active
+	Uptime   time.Duration
+	Restarts int
+}
+
+func (u UnitState) Active() bool {
+	return u.ActiveState == "active"
+}
+
+func (u UnitState) Enabled() bool {
+	return u.UnitFileState == "enabled"
+}
+
+// GetSystemdUnitState returns the state of a unit. Units
+// that are not installed are reported as inactive.
+func (h Host) GetSystemdUnitState(unitName string) (UnitState, error) {
+	output, err := h.systemctl("show", unitName, "--property=ActiveState,SubState,UnitFileState,ActiveEnterTimestampMonotonic,NRestarts")
 	if err != nil {
-		return fmt.Errorf("running daemon-reload: %s, %s", err, output)
+		return UnitState{}, fmt.Errorf("showing systemd unit: %s: %s", err, output)
 	}
-	return nil
-}
 
-func runSystemctlCommand(args ...string) (string, error) {
-	cmd := exec.Command("systemctl", args...)
-	output, err := cmd.CombinedOutput()
+	uptime, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return UnitState{}, fmt.Errorf("reading system uptime: %s", err)
+	}
+	fields := strings.Fields(string(uptime))
+	if len(fields) == 0 {
+		return UnitState{}, fmt.Errorf("unexpected system uptime: %s", uptime)
+	}
+	since, err := strconv.ParseFloat(fields[0], 64)
 	if err != nil {
-		return string(output), err
+		return UnitState{}, fmt.Errorf("parsing system uptime: %s", err)
 	}
 
-	return string(output), nil
+	return parseUnitState(output, time.Duration(since*float64(time.Second)))
 }
 
-func TailSystemdLogs(systemdUnit string, ch chan Syslog) error {
-	cmd := exec.Command("journalctl", "-u", systemdUnit, "-f", "-n 0", "--output", "json")
+// parseUnitState parses the properties printed by systemctl show.
+// Units record when they became active in microseconds since boot.
+func parseUnitState(output string, sinceBoot time.Duration) (UnitState, error) {
+	var state UnitState
+	var activeSince time.Duration
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ActiveState":
+			state.ActiveState = kv[1]
+		case "SubState":
+			state.SubState = kv[1]
+		case "UnitFileState":
+			state.UnitFileState = kv[1]
+		case "ActiveEnterTimestampMonotonic":
+			usec, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return state, fmt.Errorf("parsing %s: %s", kv[0], err)
+			}
+			activeSince = time.Duration(usec) * time.Microsecond
+		case "NRestarts":
+			// only reported by newer systemd versions
+			if kv[1] == "" {
+				continue
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return state, fmt.Errorf("parsing %s: %s", kv[0], err)
+			}
+			state.Restarts = n
+		}
+	}
+
+	if state.Active() && activeSince > 0 && sinceBoot > activeSince {
+		state.Uptime = (sinceBoot - activeSince).Truncate(time.Second)
+	}
+	return state, nil
+}
+
+func (h Host) SystemdUnitActive(unitName string) (bool, error) {
+	output, err := h.systemctl("is-active", unitName)
+	if output == "active\n" {
+		return true, nil
+	}
+
+	// is-active exits non-zero for any state other than active
+	if _, ok := err.(*exec.ExitError); ok || err == nil {
+		return false, nil
+	}
+	return false, fmt.Errorf("checking if systemd unit is active: %s: %s", err, output)
+}
+
+func (h Host) DaemonReload() error {
+	output, err := h.systemctl("daemon-reload")
+	if err != nil {
+		return fmt.Errorf("running daemon-reload: %s, %s", err, output)
+	}
+	return nil
+}
+
+// TailSystemdLogs sends the logs of a unit to ch until ctx is
+// cancelled or journalctl exits. ch is closed when it returns.
+func TailSystemdLogs(ctx context.Context, systemdUnit string, ch chan Syslog) error {
+	defer close(ch)
+
+	cmd := exec.CommandContext(ctx, "journalctl", "-u", systemdUnit, "-f", "-n 0", "--output", "json")
 	cmdReader, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("creating command stdout pipe: %s", err)
 	}
 
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting command: %s", err)
+	}
+
+	var readErr error
 	scanner := bufio.NewScanner(cmdReader)
-	go func() {
-		for scanner.Scan() {
-			var s Syslog
-			if err := json.Unmarshal([]byte(scanner.Text()), &s); err != nil {
-				s.Error = fmt.Errorf("unmarshalling log: %s, original log text: %s", err, scanner.Text())
-				ch <- s
-				break
-			}
-			if s.Message != "" && s.Identifier != "systemd" && !strings.Contains(s.Message, "Logs begin at") {
-				ch <- s
-			}
+	for scanner.Scan() {
+		var s Syslog
+		if err := json.Unmarshal([]byte(scanner.Text()), &s); err != nil {
+			s.Error = fmt.Errorf("unmarshalling log: %s, original log text: %s", err, scanner.Text())
+			readErr = s.Error
+		} else if s.Message == "" || s.Identifier == "systemd" || strings.Contains(s.Message, "Logs begin at") {
+			continue
 		}
-	}()
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("starting command: %s", err)
+		select {
+		case ch <- s:
+		case <-ctx.Done():
+		}
+		if readErr != nil || ctx.Err() != nil {
+			break
+		}
 	}
 
-	if err := cmd.Wait(); err != nil {
-		close(ch)
+	// journalctl follows forever, stop it once reading has ended
+	cmd.Process.Kill()
+	if err := cmd.Wait(); err != nil && readErr == nil && ctx.Err() == nil {
 		return fmt.Errorf("waiting for command: %s", err)
 	}
 
+	return readErr
+}
+
+// WriteSystemdLogs writes the last lines logged by a unit to w. When
+// follow is set new lines are written until ctx is cancelled.
+func WriteSystemdLogs(ctx context.Context, systemdUnit string, lines int, follow bool, w io.Writer) error {
+	args := []string{"-u", systemdUnit, "-n", strconv.Itoa(lines), "--no-pager", "--output", "short-iso"}
+	if follow {
+		args = append(args, "-f")
+	}
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("running journalctl: %s", err)
+	}
 	return nil
 }
@@ -0,0 +1,50 @@
+package file
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUnitState(t *testing.T) {
+	output := `ActiveState=active
+SubState=running
+UnitFileState=enabled
+ActiveEnterTimestampMonotonic=5000000
+NRestarts=3
+`
+	state, err := parseUnitState(output, 65500*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, UnitState{
+		ActiveState:   "active",
+		SubState:      "running",
+		UnitFileState: "enabled",
+		Uptime:        60 * time.Second,
+		Restarts:      3,
+	}, state)
+	assert.True(t, state.Active())
+	assert.True(t, state.Enabled())
+}
+
+func TestParseUnitStateInactive(t *testing.T) {
+	output := `ActiveState=inactive
+SubState=dead
+UnitFileState=
+ActiveEnterTimestampMonotonic=0
+NRestarts=
+`
+	state, err := parseUnitState(output, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, UnitState{
+		ActiveState: "inactive",
+		SubState:    "dead",
+	}, state)
+	assert.False(t, state.Active())
+	assert.False(t, state.Enabled())
+}
+
+func TestParseUnitStateInvalid(t *testing.T) {
+	_, err := parseUnitState("NRestarts=many", time.Minute)
+	assert.EqualError(t, err, `parsing NRestarts: strconv.Atoi: parsing "many": invalid syntax`)
+}
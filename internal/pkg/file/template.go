@@ -14,9 +14,6 @@ import (
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
 )
 
-//go:embed templates/run.tmpl
-var runScriptTemplate string
-
 //go:embed templates/service.tmpl
 var serviceTemplate string
 
@@ -43,15 +40,6 @@ type DeployerTemplateData struct {
 	ExecStart        string
 }
 
-type RunScriptTemplateData struct {
-	EnvVarKeys    []string
-	AppVersion    string
-	ExecStart     string
-	HerokuAppName string
-	BinaryPath    string
-	NewLine       string
-}
-
 func EvalServiceTemplate(m manifest.Manifest, user string) (string, error) {
 	d := ServiceTemplateData{
 		Description:      m.Systemd.Unit.Description,
@@ -75,17 +63,6 @@ func EvalServiceTemplate(m manifest.Manifest, user string) (string, error) {
 	return evalTemplate(serviceTemplate, d)
 }
 
-func EvalRunScriptTemplate(m manifest.Manifest, version string) (string, error) {
-	d := RunScriptTemplateData{}
-	d.EnvVarKeys = m.Heroku.Env
-	d.AppVersion = version
-	d.ExecStart = getExecStartName(m, config.PiAppDeployerDir)
-	d.HerokuAppName = m.Heroku.App
-	d.NewLine = "\n"
-	d.BinaryPath = getBinaryPath(m, config.PiAppDeployerDir)
-	return evalTemplate(runScriptTemplate, d)
-}
-
 func EvalDeployerTemplate(herokuApp string) (string, error) {
 	d := DeployerTemplateData{
 		EnvironmentFile:  getDeployerEnvFileName(config.PiAppDeployerDir),
@@ -111,39 +88,46 @@ func evalTemplate(templateFile string, d interface{}) (string, error) {
 	return doc.String(), nil
 }
 
-func WriteServiceEnvFile(m manifest.Manifest, herokuAPIKey, version string, cfg config.Config, outpath string) error {
+func (h Host) WriteServiceEnvFile(m manifest.Manifest, providerEnv map[string]string, version string, cfg config.Config, outpath string) error {
 	if outpath == "" {
-		outpath = config.PiAppDeployerDir
+		outpath = h.AppDir()
 	}
-	envTemplate := `HEROKU_API_KEY=%s
-APP_VERSION=%s`
-	keys := mapToSortedKeys(cfg.EnvVars)
-	for _, k := range keys {
-		envTemplate += fmt.Sprintf("\n%s=%s", k, cfg.EnvVars[k])
+	lines := []string{}
+	for _, k := range mapToSortedKeys(providerEnv) {
+		lines = append(lines, fmt.Sprintf("%s=%s", k, providerEnv[k]))
+	}
+	lines = append(lines, fmt.Sprintf("APP_VERSION=%s", version))
+	for _, k := range mapToSortedKeys(cfg.EnvVars) {
+		lines = append(lines, fmt.Sprintf("%s=%s", k, cfg.EnvVars[k]))
 	}
 
-	err := os.WriteFile(getServiceEnvFileName(m, outpath), []byte(fmt.Sprintf(envTemplate, herokuAPIKey, version)), 0644)
+	// systemd reads the env file as root before starting the
+	// app as the app user, it is only readable by root
+	err := os.WriteFile(getServiceEnvFileName(m, outpath), []byte(strings.Join(lines, "\n")), 0600)
 	if err != nil {
 		return fmt.Errorf("writing service env file: %s", err)
 	}
 	return nil
 }
 
-func WriteDeployerEnvFile(herokuAPIKey string) error {
-	if herokuAPIKey == "" {
-		return fmt.Errorf("heroku api key must not be empty")
+func (h Host) WriteDeployerEnvFile(providerEnv map[string]string) error {
+	if len(providerEnv) == 0 {
+		return fmt.Errorf("secret provider env must not be empty")
 	}
 
-	envFileName := getDeployerEnvFileName(config.PiAppDeployerDir)
+	envFileName := getDeployerEnvFileName(h.AppDir())
 
 	if _, err := os.Stat(envFileName); errors.Is(err, os.ErrNotExist) {
-		content := fmt.Sprintf(`HEROKU_API_KEY=%s`, herokuAPIKey)
+		lines := []string{}
+		for _, k := range mapToSortedKeys(providerEnv) {
+			lines = append(lines, fmt.Sprintf("%s=%s", k, providerEnv[k]))
+		}
 		// this is only used for CI testing
 		envVar := os.Getenv("INVENTORY_TRANSIENT")
 		if envVar != "" {
-			content += fmt.Sprintf("\nINVENTORY_TRANSIENT=%s", "true")
+			lines = append(lines, fmt.Sprintf("INVENTORY_TRANSIENT=%s", "true"))
 		}
-		err := os.WriteFile(envFileName, []byte(content), 0644)
+		err := os.WriteFile(envFileName, []byte(strings.Join(lines, "\n")), 0600)
 		if err != nil {
 			return fmt.Errorf("writing deployer env file: %s", err)
 		}
@@ -152,6 +136,16 @@ func WriteDeployerEnvFile(herokuAPIKey string) error {
 	return nil
 }
 
+// ToShellExports renders values as shell export statements
+// that are safe to eval.
+func ToShellExports(values map[string]string) string {
+	exports := ""
+	for _, k := range mapToSortedKeys(values) {
+		exports += fmt.Sprintf("export %s='%s'\n", k, strings.ReplaceAll(values[k], "'", `'\''`))
+	}
+	return exports
+}
+
 func mapToSortedKeys(envVars map[string]string) []string {
 	var keys []string
 	for k := range envVars {
@@ -161,8 +155,15 @@ func mapToSortedKeys(envVars map[string]string) []string {
 	return keys
 }
 
+// getExecStartName returns the command of the app systemd unit. The
+// agent exec command resolves the app secrets and replaces itself
+// with the app binary.
 func getExecStartName(m manifest.Manifest, dir string) string {
-	return fmt.Sprintf("%s/run-%s.sh", dir, m.Name)
+	execStart := fmt.Sprintf("%s/pi-app-deployer-agent exec --manifestName %s --scope %s", dir, m.Name, m.Heroku.App)
+	for _, k := range m.Heroku.Env {
+		execStart += fmt.Sprintf(" --key %s", k)
+	}
+	return fmt.Sprintf("%s -- %s", execStart, getBinaryPath(m, dir))
 }
 
 func getDeployerExecStart(herokuApp string) string {
@@ -175,7 +176,21 @@ func getBinaryPath(m manifest.Manifest, dir string) string {
 }
 
 func getServiceEnvFileName(m manifest.Manifest, dir string) string {
-	return fmt.Sprintf("%s/.%s.env", dir, m.Name)
+	return getServiceEnvFileNameByName(m.Name, dir)
+}
+
+func getServiceEnvFileNameByName(manifestName, dir string) string {
+	return fmt.Sprintf("%s/.%s.env", dir, manifestName)
+}
+
+// InstalledManifestFile is the copy of the manifest kept for an
+// installed app, used to render its files again when it is configured.
+func (h Host) InstalledManifestFile(manifestName string) string {
+	return getInstalledManifestFileName(manifestName, h.AppDir())
+}
+
+func getInstalledManifestFileName(manifestName, dir string) string {
+	return fmt.Sprintf("%s/.%s.manifest.yaml", dir, manifestName)
 }
 
 func getDeployerEnvFileName(dir string) string {
@@ -28,7 +28,7 @@ WantedBy=multi-user.target
 
 [Service]
 EnvironmentFile=/usr/local/src/pi-app-deployer/.sample-app.env
-ExecStart=/usr/local/src/pi-app-deployer/run-sample-app.sh
+ExecStart=/usr/local/src/pi-app-deployer/pi-app-deployer-agent exec --manifestName sample-app --scope sample-app-test --key CLOUDMQTT_URL --key LOG_LEVEL -- /usr/local/src/pi-app-deployer/sample-app-agent
 WorkingDirectory=/usr/local/src/pi-app-deployer
 StandardOutput=inherit
 StandardError=inherit
@@ -65,48 +65,6 @@ User=root
 	assert.Equal(t, expectedServiceFile, serviceFile)
 }
 
-func Test_EvalRunScriptTemplate(t *testing.T) {
-	m, err := manifest.GetManifest("../../../test/templates/fully-defined-manifest.yaml", "sample-app")
-	assert.NoError(t, err)
-
-	runScriptFile, err := EvalRunScriptTemplate(m, "b1946ac92492d2347c6235b4d2611184")
-	assert.NoError(t, err)
-
-	expectedRunScriptFile := `#!/bin/bash
-
-export APP_VERSION=b1946ac92492d2347c6235b4d2611184
-
-
-if [[ -z ${HEROKU_API_KEY} ]]; then
-  echo "HEROKU_API_KEY env var not set, exiting now"
-  exit 1
-fi
-
-vars=$(curl -s -n https://api.heroku.com/apps/sample-app-test/config-vars \
-  -H "Accept: application/vnd.heroku+json; version=3" \
-  -H "Authorization: Bearer ${HEROKU_API_KEY}")
-
-export CLOUDMQTT_URL=$(echo $vars | jq -r '.CLOUDMQTT_URL')
-if [[ -z ${CLOUDMQTT_URL} || ${CLOUDMQTT_URL} == 'null' ]]; then
-  echo "CLOUDMQTT_URL env var not set, exiting now"
-  exit 1
-fi
-
-export LOG_LEVEL=$(echo $vars | jq -r '.LOG_LEVEL')
-if [[ -z ${LOG_LEVEL} || ${LOG_LEVEL} == 'null' ]]; then
-  echo "LOG_LEVEL env var not set, exiting now"
-  exit 1
-fi
-
-
-unset HEROKU_API_KEY
-
-/usr/local/src/pi-app-deployer/sample-app-agent
-`
-
-	assert.Equal(t, expectedRunScriptFile, runScriptFile)
-}
-
 func Test_Helpers(t *testing.T) {
 	expected := "/usr/local/src/pi-app-deployer/pi-app-deployer-agent update --herokuApp testing-app"
 	actual := getDeployerExecStart("testing-app")
@@ -115,6 +73,12 @@ func Test_Helpers(t *testing.T) {
 	expected = "/usr/local/src/pi-app-deployer/pi-app-deployer-agent update --herokuApp testing-app"
 	actual = getDeployerExecStart("testing-app")
 	assert.Equal(t, expected, actual)
+
+	m, err := manifest.GetManifest("../../../test/templates/minimally-defined-manifest.yaml", "sample-app")
+	assert.NoError(t, err)
+	expected = "/usr/local/src/pi-app-deployer/pi-app-deployer-agent exec --manifestName sample-app --scope sample-app-test -- /usr/local/src/pi-app-deployer/sample-app-agent"
+	actual = getExecStartName(m, config.PiAppDeployerDir)
+	assert.Equal(t, expected, actual)
 }
 
 func Test_WriteServiceEnvFile(t *testing.T) {
@@ -129,9 +93,17 @@ func Test_WriteServiceEnvFile(t *testing.T) {
 	cfg := config.Config{
 		EnvVars: envVars,
 	}
-	err = WriteServiceEnvFile(m, "abcdefg", "hijklmn", cfg, "/tmp")
+	err = Host{}.WriteServiceEnvFile(m, map[string]string{"HEROKU_API_KEY": "abcdefg"}, "hijklmn", cfg, "/tmp")
 	assert.NoError(t, err)
 	b, err := os.ReadFile("/tmp/.sample-app.env")
 	assert.NoError(t, err)
 	assert.Equal(t, "HEROKU_API_KEY=abcdefg\nAPP_VERSION=hijklmn\nEXTRA_CONFIG=foobar\nMY_CONFIG=testing", string(b))
 }
+
+func Test_ToShellExports(t *testing.T) {
+	exports := ToShellExports(map[string]string{
+		"LOG_LEVEL": "info",
+		"QUOTED":    "it's $HOME",
+	})
+	assert.Equal(t, "export LOG_LEVEL='info'\nexport QUOTED='it'\\''s $HOME'\n", exports)
+}
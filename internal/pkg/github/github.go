@@ -5,23 +5,27 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
 	"github.com/google/go-github/v42/github"
 )
 
+// DefaultAPIURL is the Github REST API
+const DefaultAPIURL = "https://api.github.com"
+
 var backoffSchedule = []time.Duration{
 	20 * time.Second,
 	30 * time.Second,
 	60 * time.Second,
 }
 
-func GetDownloadURLWithRetries(artifact config.Artifact, latest bool) (string, error) {
+func GetDownloadURLWithRetries(apiURL string, artifact config.Artifact, latest bool) (string, error) {
 	var err error
 	var url string
 	for _, backoff := range backoffSchedule {
-		url, err = getDownloadURL(artifact, latest)
+		url, err = getDownloadURL(apiURL, artifact, latest)
 		if url != "" {
 			return url, nil
 		}
@@ -34,8 +38,8 @@ func GetDownloadURLWithRetries(artifact config.Artifact, latest bool) (string, e
 	return "", fmt.Errorf("an unexpected event occurred, no url found and no error returned")
 }
 
-func getDownloadURL(artifact config.Artifact, latest bool) (string, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.github.com/repos/%s/actions/artifacts", artifact.RepoName), nil)
+func getDownloadURL(apiURL string, artifact config.Artifact, latest bool) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/actions/artifacts", apiURL, artifact.RepoName), nil)
 	if err != nil {
 		return "", err
 	}
@@ -72,5 +76,16 @@ func getDownloadURL(artifact config.Artifact, latest bool) (string, error) {
 		}
 	}
 
+	// artifact names conventionally end with the commit SHA,
+	// allowing lookup when only the SHA is known
+	if artifact.Name == "" && artifact.SHA != "" {
+		for _, a := range artifacts.Artifacts {
+			if strings.HasSuffix(a.GetName(), artifact.SHA) {
+				return a.GetArchiveDownloadURL(), nil
+			}
+		}
+		return "", fmt.Errorf("no artifact found matching sha %s", artifact.SHA)
+	}
+
 	return "", fmt.Errorf("no artifact found matching name %s", artifact.Name)
 }
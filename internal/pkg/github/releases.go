@@ -0,0 +1,63 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/go-github/v42/github"
+)
+
+// releasesPerPage is the largest page of releases the API returns
+const releasesPerPage = 100
+
+// GetReleases lists the releases of a repository, newest first.
+// The token is optional and only needed for private repositories.
+func GetReleases(apiURL, repoName, token string) ([]*github.RepositoryRelease, error) {
+	releases := []*github.RepositoryRelease{}
+	for page := 1; ; page++ {
+		r, err := getReleasesPage(apiURL, repoName, token, page)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, r...)
+		if len(r) < releasesPerPage {
+			return releases, nil
+		}
+	}
+}
+
+func getReleasesPage(apiURL, repoName, token string, page int) ([]*github.RepositoryRelease, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/releases?per_page=%d&page=%d", apiURL, repoName, releasesPerPage, page), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing releases, received status code: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	var releases []*github.RepositoryRelease
+	err = json.Unmarshal(body, &releases)
+	if err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
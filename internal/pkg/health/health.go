@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/manifest"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+)
+
+var pollInterval = 1 * time.Second
+
+type unitActiveFunc func(unitName string) (bool, error)
+
+// Verify runs the health check declared in a manifest against
+// an app that was just started. The returned error describes
+// the reason the check failed.
+func Verify(h file.Host, unitName string, hc manifest.HealthCheck) error {
+	return verify(unitName, hc, h.SystemdUnitActive)
+}
+
+func verify(unitName string, hc manifest.HealthCheck, isActive unitActiveFunc) error {
+	err := checkUnitActive(unitName, time.Duration(hc.ActiveSec)*time.Second, isActive)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(hc.TimeoutSec) * time.Second
+
+	if hc.HTTP != "" {
+		err := checkHTTP(hc.HTTP, timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hc.Command != "" {
+		err := checkCommand(hc.Command, timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkUnitActive(unitName string, d time.Duration, isActive unitActiveFunc) error {
+	deadline := time.Now().Add(d)
+	for {
+		active, err := isActive(unitName)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return fmt.Errorf("systemd unit %s is not active", unitName)
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func checkHTTP(url string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	deadline := time.Now().Add(timeout)
+
+	var lastErr error
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+			lastErr = fmt.Errorf("received status code %d", resp.StatusCode)
+		} else {
+			lastErr = err
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("http health check %s failed: %s", url, lastErr)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func checkCommand(command string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("health check command '%s' failed: %s, %s", command, err, string(output))
+	}
+	return nil
+}
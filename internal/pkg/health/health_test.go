@@ -0,0 +1,64 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	pollInterval = 10 * time.Millisecond
+}
+
+func alwaysActive(string) (bool, error) {
+	return true, nil
+}
+
+func Test_VerifyUnitActive(t *testing.T) {
+	err := verify("sample-app", manifest.HealthCheck{}, alwaysActive)
+	assert.NoError(t, err)
+
+	err = verify("sample-app", manifest.HealthCheck{}, func(string) (bool, error) {
+		return false, nil
+	})
+	assert.EqualError(t, err, "systemd unit sample-app is not active")
+
+	calls := 0
+	err = verify("sample-app", manifest.HealthCheck{ActiveSec: 1}, func(string) (bool, error) {
+		calls++
+		return calls < 3, nil
+	})
+	assert.EqualError(t, err, "systemd unit sample-app is not active")
+	assert.Equal(t, 3, calls)
+}
+
+func Test_VerifyHTTP(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer healthy.Close()
+
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	err := verify("sample-app", manifest.HealthCheck{HTTP: healthy.URL, TimeoutSec: 1}, alwaysActive)
+	assert.NoError(t, err)
+
+	err = verify("sample-app", manifest.HealthCheck{HTTP: unhealthy.URL, TimeoutSec: 1}, alwaysActive)
+	assert.EqualError(t, err, fmt.Sprintf("http health check %s failed: received status code 503", unhealthy.URL))
+}
+
+func Test_VerifyCommand(t *testing.T) {
+	err := verify("sample-app", manifest.HealthCheck{Command: "exit 0", TimeoutSec: 1}, alwaysActive)
+	assert.NoError(t, err)
+
+	err = verify("sample-app", manifest.HealthCheck{Command: "echo unhealthy && exit 1", TimeoutSec: 1}, alwaysActive)
+	assert.EqualError(t, err, "health check command 'echo unhealthy && exit 1' failed: exit status 1, unhealthy\n")
+}
@@ -0,0 +1,549 @@
+package mqtt
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	// sessionQueueSize bounds the messages kept for a client with a
+	// persistent session while it is offline, the oldest are dropped.
+	sessionQueueSize = 1000
+	// maxInflight is the number of QoS 1 messages sent to a client
+	// and not acknowledged yet.
+	maxInflight = 100
+	// outboundSize is the number of packets waiting to be written to
+	// a client, slower clients are disconnected.
+	outboundSize = 256
+	// connectTimeout is the time a client has to send CONNECT
+	connectTimeout = 10 * time.Second
+)
+
+// Broker is a minimal MQTT 3.1.1 broker the server can run instead
+// of relying on an external one. It supports QoS 0 and 1, persistent
+// sessions and the + and # wildcards. Retained messages and wills are
+// not supported, QoS 2 is downgraded to QoS 1.
+//
+// Sessions are only kept in memory: the subscriptions of offline
+// clients and the QoS 1 messages queued for them are lost when the
+// broker stops.
+type Broker struct {
+	// users are the accepted credentials, any client is accepted
+	// when it is nil
+	users map[string]string
+	// publishACL holds the topic filters a user may publish to,
+	// users without an entry may publish to any topic
+	publishACL map[string][]string
+	logf       func(format string, args ...interface{})
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	locals    map[*localTransport]bool
+	listeners []net.Listener
+	closed    bool
+}
+
+func NewBroker(users map[string]string, logf func(format string, args ...interface{})) *Broker {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	return &Broker{
+		users:      users,
+		publishACL: map[string][]string{},
+		logf:       logf,
+		sessions:   map[string]*session{},
+		locals:     map[*localTransport]bool{},
+	}
+}
+
+// RestrictPublish only lets the clients of user publish to topics
+// matching one of the filters, their other messages are acknowledged
+// and dropped. In-memory transports are not restricted.
+func (b *Broker) RestrictPublish(user string, filters []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishACL[user] = filters
+}
+
+// Serve accepts clients on l until the broker is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	b.listeners = append(b.listeners, l)
+	b.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go b.ServeConn(conn)
+	}
+}
+
+// Close stops the listeners and disconnects the clients. The
+// in-memory transports keep working.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, l := range b.listeners {
+		l.Close()
+	}
+	for _, s := range b.sessions {
+		if s.conn != nil {
+			s.conn.close()
+		}
+	}
+}
+
+// ServeConn runs the session of a client until it disconnects.
+func (b *Broker) ServeConn(rw io.ReadWriteCloser) {
+	defer rw.Close()
+
+	setReadDeadline(rw, time.Now().Add(connectTimeout))
+	p, err := packets.ReadPacket(rw)
+	if err != nil {
+		return
+	}
+	cp, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	code := cp.Validate()
+	if code == packets.Accepted && b.isClosed() {
+		code = packets.ErrRefusedServerUnavailable
+	}
+	if code == packets.Accepted && !b.authorized(cp) {
+		b.logf("refusing MQTT client %s: bad credentials for user %s", cp.ClientIdentifier, cp.Username)
+		code = packets.ErrRefusedNotAuthorised
+	}
+	if code != packets.Accepted {
+		connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		connack.ReturnCode = code
+		connack.Write(rw)
+		return
+	}
+	if cp.ClientIdentifier == "" {
+		u, _ := uuid.NewV4()
+		cp.ClientIdentifier = u.String()
+	}
+
+	c := newConn(rw)
+	defer c.close()
+	s := b.attach(cp, c)
+	defer b.detach(s, c)
+
+	keepalive := time.Duration(cp.Keepalive) * time.Second
+	for {
+		deadline := time.Time{}
+		if keepalive > 0 {
+			deadline = time.Now().Add(keepalive * 3 / 2)
+		}
+		setReadDeadline(rw, deadline)
+
+		p, err := packets.ReadPacket(rw)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.PublishPacket:
+			if b.mayPublish(cp.Username, p.TopicName) {
+				b.route(p.TopicName, p.Payload, p.Qos)
+			} else {
+				b.logf("dropping message of MQTT client %s: user %s may not publish to %s", cp.ClientIdentifier, cp.Username, p.TopicName)
+			}
+			switch p.Qos {
+			case 1:
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				c.send(puback)
+			case 2:
+				pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pubrec.MessageID = p.MessageID
+				c.send(pubrec)
+			}
+		case *packets.PubrelPacket:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.MessageID
+			c.send(pubcomp)
+		case *packets.PubackPacket:
+			b.acknowledge(s, p.MessageID)
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = b.subscribe(s, p.Topics, p.Qoss)
+			c.send(suback)
+		case *packets.UnsubscribePacket:
+			b.unsubscribe(s, p.Topics)
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.send(unsuback)
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+		default:
+			// DISCONNECT, or a packet a client must not send
+			return
+		}
+	}
+}
+
+func (b *Broker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+func (b *Broker) authorized(cp *packets.ConnectPacket) bool {
+	if b.users == nil {
+		return true
+	}
+	password, ok := b.users[cp.Username]
+	return ok && cp.UsernameFlag && cp.PasswordFlag && subtle.ConstantTimeCompare([]byte(password), cp.Password) == 1
+}
+
+func (b *Broker) mayPublish(user, topic string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	filters, ok := b.publishACL[user]
+	if !ok {
+		return true
+	}
+	for _, f := range filters {
+		if matchTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// attach connects a client to its session, taking it over from a
+// previous connection with the same client ID.
+func (b *Broker) attach(cp *packets.ConnectPacket, c *conn) *session {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.sessions[cp.ClientIdentifier]
+	if ok && s.conn != nil {
+		s.conn.close()
+	}
+	present := ok && !cp.CleanSession
+	if !present {
+		s = newSession(cp.ClientIdentifier)
+		b.sessions[s.id] = s
+	}
+	s.clean = cp.CleanSession
+	s.conn = c
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.SessionPresent = present
+	connack.ReturnCode = packets.Accepted
+	c.send(connack)
+	s.resend()
+	return s
+}
+
+func (b *Broker) detach(s *session, c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.conn != c {
+		// the session was taken over by a new connection
+		return
+	}
+	s.conn = nil
+	if s.clean && b.sessions[s.id] == s {
+		delete(b.sessions, s.id)
+	}
+}
+
+func (b *Broker) subscribe(s *session, topics []string, qoss []byte) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	codes := []byte{}
+	for i, topic := range topics {
+		if !validFilter(topic) {
+			codes = append(codes, 0x80)
+			continue
+		}
+		qos := qoss[i]
+		if qos > 1 {
+			qos = 1
+		}
+		s.subscriptions[topic] = qos
+		codes = append(codes, qos)
+	}
+	return codes
+}
+
+func (b *Broker) unsubscribe(s *session, topics []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, topic := range topics {
+		delete(s.subscriptions, topic)
+	}
+}
+
+func (b *Broker) acknowledge(s *session, id uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s.acknowledge(id)
+}
+
+// route delivers a message to the sessions and in-memory
+// transports subscribed to its topic.
+func (b *Broker) route(topic string, payload []byte, qos byte) {
+	if qos > 1 {
+		qos = 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.sessions {
+		granted, ok := s.match(topic)
+		if !ok {
+			continue
+		}
+		if granted < qos {
+			s.deliver(topic, payload, granted)
+		} else {
+			s.deliver(topic, payload, qos)
+		}
+	}
+	for l := range b.locals {
+		l.deliver(topic, string(payload))
+	}
+}
+
+func (b *Broker) addLocal(l *localTransport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.locals[l] = true
+}
+
+func (b *Broker) removeLocal(l *localTransport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.locals, l)
+}
+
+type message struct {
+	id      uint16
+	topic   string
+	payload []byte
+}
+
+// session is the state of a client, kept by the broker while the
+// client is offline when it asked for a persistent session. It is
+// only used with the lock of the broker held.
+type session struct {
+	id            string
+	clean         bool
+	subscriptions map[string]byte
+	conn          *conn
+	lastID        uint16
+	// inflight are the QoS 1 messages sent and not acknowledged
+	inflight []message
+	// queue are the QoS 1 messages waiting to be sent
+	queue []message
+}
+
+func newSession(id string) *session {
+	return &session{id: id, subscriptions: map[string]byte{}}
+}
+
+// match returns the highest QoS of the subscriptions matching a topic.
+func (s *session) match(topic string) (byte, bool) {
+	var qos byte
+	matched := false
+	for filter, q := range s.subscriptions {
+		if matchTopic(filter, topic) {
+			matched = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	return qos, matched
+}
+
+func (s *session) deliver(topic string, payload []byte, qos byte) {
+	if qos == 0 {
+		if s.conn != nil {
+			s.conn.send(publishPacket(message{topic: topic, payload: payload}, 0, false))
+		}
+		return
+	}
+	s.queue = append(s.queue, message{topic: topic, payload: payload})
+	if len(s.queue) > sessionQueueSize {
+		s.queue = s.queue[1:]
+	}
+	s.flush()
+}
+
+// flush sends the queued messages while the client has room for them.
+func (s *session) flush() {
+	if s.conn == nil {
+		return
+	}
+	for len(s.inflight) < maxInflight && len(s.queue) > 0 {
+		m := s.queue[0]
+		s.queue = s.queue[1:]
+		m.id = s.nextID()
+		s.inflight = append(s.inflight, m)
+		s.conn.send(publishPacket(m, 1, false))
+	}
+}
+
+// resend sends the messages not acknowledged on the previous
+// connection again, then the queued ones.
+func (s *session) resend() {
+	for _, m := range s.inflight {
+		s.conn.send(publishPacket(m, 1, true))
+	}
+	s.flush()
+}
+
+func (s *session) acknowledge(id uint16) {
+	for i, m := range s.inflight {
+		if m.id == id {
+			s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+			break
+		}
+	}
+	s.flush()
+}
+
+func (s *session) nextID() uint16 {
+	for {
+		s.lastID++
+		if s.lastID == 0 {
+			continue
+		}
+		inUse := false
+		for _, m := range s.inflight {
+			if m.id == s.lastID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return s.lastID
+		}
+	}
+}
+
+func publishPacket(m message, qos byte, dup bool) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = m.topic
+	p.Payload = m.payload
+	p.Qos = qos
+	p.Dup = dup
+	p.MessageID = m.id
+	return p
+}
+
+// conn writes the packets sent to a client from its own goroutine
+// so a slow client does not block the broker.
+type conn struct {
+	rw        io.ReadWriteCloser
+	out       chan packets.ControlPacket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(rw io.ReadWriteCloser) *conn {
+	c := &conn{
+		rw:   rw,
+		out:  make(chan packets.ControlPacket, outboundSize),
+		done: make(chan struct{}),
+	}
+	go c.write()
+	return c
+}
+
+func (c *conn) write() {
+	for {
+		select {
+		case p := <-c.out:
+			if err := p.Write(c.rw); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) send(p packets.ControlPacket) {
+	select {
+	case c.out <- p:
+	case <-c.done:
+	default:
+		// the client does not keep up, the messages not
+		// acknowledged are sent again when it reconnects
+		c.close()
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.rw.Close()
+	})
+}
+
+func setReadDeadline(rw io.ReadWriteCloser, t time.Time) {
+	if d, ok := rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		d.SetReadDeadline(t)
+	}
+}
+
+// matchTopic returns true if a topic matches a subscription filter.
+func matchTopic(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	parts := strings.Split(filter, "/")
+	for i, part := range parts {
+		if part == "#" && i != len(parts)-1 {
+			return false
+		}
+		if part != "#" && part != "+" && strings.ContainsAny(part, "#+") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package mqtt
+
+import "sync"
+
+// Deduper remembers the IDs of recently handled commands so a
+// command delivered again by the broker is only handled once.
+type Deduper struct {
+	mu   sync.Mutex
+	size int
+	ids  map[string]bool
+	// order is used to forget the oldest IDs first
+	order []string
+}
+
+func NewDeduper(size int) *Deduper {
+	return &Deduper{size: size, ids: map[string]bool{}}
+}
+
+// Seen records an ID and reports whether it was already recorded.
+// Commands without an ID are never considered seen.
+func (d *Deduper) Seen(id string) bool {
+	if id == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ids[id] {
+		return true
+	}
+	if len(d.order) == d.size {
+		delete(d.ids, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.ids[id] = true
+	d.order = append(d.order, id)
+	return false
+}
@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+)
+
+// localTransport is an in-memory transport exchanging messages
+// with the clients of a broker running in the same process.
+type localTransport struct {
+	broker *Broker
+
+	mu            sync.Mutex
+	subscriptions map[string]func(string)
+	pending       []delivery
+	connected     bool
+	wake          chan struct{}
+	done          chan struct{}
+}
+
+type delivery struct {
+	handler func(string)
+	message string
+}
+
+// Transport returns an in-memory transport connected to the broker.
+// Servers embedding the broker use it, and it lets the server and
+// agents run in one process without a network.
+func (b *Broker) Transport() Transport {
+	return &localTransport{
+		broker:        b,
+		subscriptions: map[string]func(string){},
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+func (l *localTransport) Connect() error {
+	if l.broker.isClosed() {
+		return fmt.Errorf("the broker is closed")
+	}
+	l.mu.Lock()
+	if l.connected {
+		l.mu.Unlock()
+		return nil
+	}
+	l.connected = true
+	l.done = make(chan struct{})
+	go l.run(l.done)
+	l.mu.Unlock()
+
+	l.broker.addLocal(l)
+	return nil
+}
+
+func (l *localTransport) Close() {
+	l.broker.removeLocal(l)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connected {
+		l.connected = false
+		l.pending = nil
+		close(l.done)
+	}
+}
+
+func (l *localTransport) IsConnected() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.connected
+}
+
+// Subscribe registers the handler of a topic, it can be called
+// before connecting.
+func (l *localTransport) Subscribe(topic string, handler func(string)) error {
+	if !validFilter(topic) {
+		return fmt.Errorf("invalid topic filter %s", topic)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscriptions[topic] = handler
+	return nil
+}
+
+// Publish sends a message to the broker, which is always reachable.
+func (l *localTransport) Publish(topic, message string) error {
+	l.broker.route(topic, []byte(message), 1)
+	return nil
+}
+
+// deliver queues a message routed by the broker, it must not block
+// as the lock of the broker is held.
+func (l *localTransport) deliver(topic, message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.connected {
+		return
+	}
+	for filter, handler := range l.subscriptions {
+		if matchTopic(filter, topic) {
+			l.pending = append(l.pending, delivery{handler: handler, message: message})
+		}
+	}
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run calls the handlers one message at a time, like the MQTT client.
+func (l *localTransport) run(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-l.wake:
+		}
+		for {
+			l.mu.Lock()
+			if len(l.pending) == 0 || !l.connected {
+				l.mu.Unlock()
+				break
+			}
+			d := l.pending[0]
+			l.pending = l.pending[1:]
+			l.mu.Unlock()
+			d.handler(d.message)
+		}
+	}
+}
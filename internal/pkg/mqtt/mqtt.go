@@ -1,33 +1,100 @@
 package mqtt
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gofrs/uuid"
 )
 
-type fn func(string)
+// outboxSize is the number of publishes kept while disconnected,
+// the oldest ones are dropped first.
+const outboxSize = 100
+
+// maxReconnectInterval caps the backoff between reconnect attempts.
+const maxReconnectInterval = time.Minute
+
+// DefaultQoS delivers messages at least once.
+const DefaultQoS byte = 1
+
+// ErrNotConnected is returned by Publish on clients without an
+// outbox while the connection to the broker is down.
+var ErrNotConnected = errors.New("not connected to the MQTT broker")
+
+// Options configure how messages are delivered.
+type Options struct {
+	// ClientID identifies the session kept by the broker, messages
+	// sent while the client is offline are delivered when it comes
+	// back with the same ID. A random ID and a clean session are
+	// used when it is empty.
+	ClientID string
+	QoS      byte
+	// Unbuffered makes Publish fail with ErrNotConnected while
+	// disconnected, instead of keeping the message in the outbox.
+	// A caller reporting that a message was sent needs it, a
+	// message in the outbox is lost if the process exits.
+	Unbuffered bool
+}
 
 type MqttClient struct {
 	client mqtt.Client
+	qos    byte
+	// mu orders subscriptions and publishes with the resubscribing
+	// and flushing done when the connection comes back
+	mu            *sync.Mutex
+	subscriptions map[string]func(string)
+	outbox        *outbox
+	unbuffered    bool
+	// handling calls handlers one message at a time, paho runs
+	// them concurrently as the order of messages does not matter
+	handling *sync.Mutex
 }
 
-// func NewMQTTClient(addr string, connectHandler func(client mqtt.Client), connectionLostHandler func(client mqtt.Client, err error)) MqttClient {
-func NewMQTTClient(addr string, connectHandler func(client mqtt.Client), connectionLostHandler func(client mqtt.Client, err error)) MqttClient {
+func NewMQTTClient(addr string, options Options, connectHandler func(client mqtt.Client), connectionLostHandler func(client mqtt.Client, err error)) MqttClient {
+	c := MqttClient{
+		qos:           options.QoS,
+		mu:            &sync.Mutex{},
+		subscriptions: map[string]func(string){},
+		outbox:        newOutbox(outboxSize),
+		unbuffered:    options.Unbuffered,
+		handling:      &sync.Mutex{},
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(addr)
-	var clientID string
-	u, _ := uuid.NewV4()
-	clientID = u.String()
+	clientID := options.ClientID
+	if clientID == "" {
+		u, _ := uuid.NewV4()
+		clientID = u.String()
+	} else {
+		opts.SetCleanSession(false)
+	}
 	opts.SetClientID(clientID)
-	opts.OnConnect = connectHandler
+	// messages of a resumed session can arrive before the topics
+	// are subscribed again, they are routed to the registered handlers
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		c.dispatch(msg)
+	})
+	// handlers publish and wait for the broker to acknowledge it,
+	// when order matters paho calls them from the goroutine reading
+	// the connection and the acknowledgement is never read
+	opts.SetOrderMatters(false)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxReconnectInterval)
+	opts.OnConnect = func(client mqtt.Client) {
+		c.restore()
+		if connectHandler != nil {
+			connectHandler(client)
+		}
+	}
 	opts.OnConnectionLost = connectionLostHandler
-	client := mqtt.NewClient(opts)
+	c.client = mqtt.NewClient(opts)
 
-	return MqttClient{
-		client,
-	}
+	return c
 }
 
 func (c MqttClient) Connect() error {
@@ -37,25 +104,124 @@ func (c MqttClient) Connect() error {
 	return nil
 }
 
-func (c MqttClient) Cleanup() {
+func (c MqttClient) Close() {
 	c.client.Disconnect(250)
 }
 
-func (c MqttClient) Subscribe(topic string, subscribeHandler fn) error {
-	var wg sync.WaitGroup
-	wg.Add(1)
+// IsConnected reports whether the client has a connection to the
+// broker, it is false while reconnecting.
+func (c MqttClient) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
 
-	if token := c.client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		subscribeHandler(string(msg.Payload()))
+// Subscribe registers the handler of a topic. Handlers are
+// subscribed again every time the client reconnects, they can
+// be registered before connecting.
+func (c MqttClient) Subscribe(topic string, subscribeHandler func(string)) error {
+	c.mu.Lock()
+	c.subscriptions[topic] = subscribeHandler
+	connected := c.client.IsConnectionOpen()
+	c.mu.Unlock()
+	if !connected {
+		return nil
+	}
+	return c.subscribe(topic, subscribeHandler)
+}
+
+// Publish sends a message, or keeps it until the client
+// reconnects when the connection is down. A kept message is
+// not sent yet though nil is returned, unless the client is
+// Unbuffered.
+func (c MqttClient) Publish(topic, message string) error {
+	c.mu.Lock()
+	if !c.client.IsConnectionOpen() {
+		if c.unbuffered {
+			c.mu.Unlock()
+			return ErrNotConnected
+		}
+		c.outbox.push(outboundMessage{topic: topic, payload: message})
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	return c.publish(topic, message)
+}
+
+// Pending returns the number of publishes waiting for the
+// connection to come back.
+func (c MqttClient) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outbox.len()
+}
+
+// restore subscribes the registered handlers and sends the
+// publishes buffered while the client was disconnected.
+func (c MqttClient) restore() {
+	// the lock is not held while waiting on the broker, it would
+	// block the delivery of messages to the default handler
+	c.mu.Lock()
+	subscriptions := map[string]func(string){}
+	for topic, handler := range c.subscriptions {
+		subscriptions[topic] = handler
+	}
+	pending := c.outbox.drain()
+	c.mu.Unlock()
+
+	for topic, handler := range subscriptions {
+		// errors are left to the next reconnect, which retries
+		// every subscription
+		c.subscribe(topic, handler)
+	}
+
+	for i, m := range pending {
+		if err := c.publish(m.topic, m.payload); err != nil {
+			c.mu.Lock()
+			c.outbox.requeue(pending[i:])
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c MqttClient) dispatch(msg mqtt.Message) {
+	c.mu.Lock()
+	handler, ok := c.subscriptions[msg.Topic()]
+	c.mu.Unlock()
+	if ok {
+		c.handle(handler, msg)
+	}
+}
+
+func (c MqttClient) handle(handler func(string), msg mqtt.Message) {
+	c.handling.Lock()
+	defer c.handling.Unlock()
+	handler(string(msg.Payload()))
+}
+
+func (c MqttClient) subscribe(topic string, subscribeHandler func(string)) error {
+	if token := c.client.Subscribe(topic, c.qos, func(client mqtt.Client, msg mqtt.Message) {
+		c.handle(subscribeHandler, msg)
 	}); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 	return nil
 }
 
-func (c MqttClient) Publish(topic, message string) error {
-	// TODO: look into QoS
-	token := c.client.Publish(topic, 0, false, message)
+func (c MqttClient) publish(topic, message string) error {
+	token := c.client.Publish(topic, c.qos, false, message)
 	token.Wait()
 	return token.Error()
 }
+
+// ParseQoS parses a QoS level, DefaultQoS is used when s is empty.
+func ParseQoS(s string) (byte, error) {
+	if s == "" {
+		return DefaultQoS, nil
+	}
+	qos, err := strconv.Atoi(s)
+	if err != nil || qos < 0 || qos > 2 {
+		return 0, fmt.Errorf("QoS must be 0, 1 or 2, got %s", s)
+	}
+	return byte(qos), nil
+}
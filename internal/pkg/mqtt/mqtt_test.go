@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxDropsOldest(t *testing.T) {
+	o := newOutbox(3)
+	for i := 0; i < 5; i++ {
+		o.push(outboundMessage{topic: "repo/push/status", payload: fmt.Sprint(i)})
+	}
+	assert.Equal(t, 3, o.len())
+
+	messages := o.drain()
+	assert.Equal(t, []string{"2", "3", "4"}, payloads(messages))
+	assert.Equal(t, 0, o.len())
+}
+
+func TestOutboxRequeue(t *testing.T) {
+	o := newOutbox(3)
+	o.push(outboundMessage{topic: "agent/inventory", payload: "new"})
+	o.requeue([]outboundMessage{
+		{topic: "agent/inventory", payload: "a"},
+		{topic: "agent/inventory", payload: "b"},
+		{topic: "agent/inventory", payload: "c"},
+	})
+	assert.Equal(t, []string{"b", "c", "new"}, payloads(o.drain()))
+}
+
+func TestPublishWhileDisconnected(t *testing.T) {
+	c := NewMQTTClient("tcp://127.0.0.1:1", Options{}, nil, nil)
+	assert.False(t, c.IsConnected())
+
+	assert.NoError(t, c.Publish("repo/push/status", "status"))
+	assert.NoError(t, c.Subscribe("repo/push", func(string) {}))
+	assert.Equal(t, 1, c.Pending())
+	assert.Equal(t, 1, len(c.subscriptions))
+}
+
+func TestUnbufferedPublishWhileDisconnected(t *testing.T) {
+	c := NewMQTTClient("tcp://127.0.0.1:1", Options{Unbuffered: true}, nil, nil)
+
+	assert.Equal(t, ErrNotConnected, c.Publish("repo/push", "push"))
+	assert.Equal(t, 0, c.Pending())
+}
+
+func payloads(messages []outboundMessage) []string {
+	var p []string
+	for _, m := range messages {
+		p = append(p, m.payload)
+	}
+	return p
+}
+
+func TestDeduper(t *testing.T) {
+	d := NewDeduper(2)
+	assert.False(t, d.Seen("a"))
+	assert.True(t, d.Seen("a"))
+	assert.False(t, d.Seen(""))
+	assert.False(t, d.Seen(""))
+
+	assert.False(t, d.Seen("b"))
+	assert.False(t, d.Seen("c"))
+	// a was forgotten to make room for c
+	assert.False(t, d.Seen("a"))
+	assert.True(t, d.Seen("c"))
+}
+
+func TestParseQoS(t *testing.T) {
+	qos, err := ParseQoS("")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultQoS, qos)
+
+	qos, err = ParseQoS("2")
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), qos)
+
+	_, err = ParseQoS("3")
+	assert.EqualError(t, err, "QoS must be 0, 1 or 2, got 3")
+}
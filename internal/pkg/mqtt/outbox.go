@@ -0,0 +1,44 @@
+package mqtt
+
+type outboundMessage struct {
+	topic   string
+	payload string
+}
+
+// outbox is a bounded queue of messages waiting to be published.
+type outbox struct {
+	size     int
+	messages []outboundMessage
+}
+
+func newOutbox(size int) *outbox {
+	return &outbox{size: size}
+}
+
+// push adds a message, dropping the oldest one when full.
+func (o *outbox) push(m outboundMessage) {
+	if len(o.messages) == o.size {
+		o.messages = o.messages[1:]
+	}
+	o.messages = append(o.messages, m)
+}
+
+// requeue puts back messages that could not be sent ahead of the
+// ones pushed since, keeping the newest when over the size.
+func (o *outbox) requeue(messages []outboundMessage) {
+	all := append(append([]outboundMessage{}, messages...), o.messages...)
+	if len(all) > o.size {
+		all = all[len(all)-o.size:]
+	}
+	o.messages = all
+}
+
+func (o *outbox) drain() []outboundMessage {
+	messages := o.messages
+	o.messages = nil
+	return messages
+}
+
+func (o *outbox) len() int {
+	return len(o.messages)
+}
@@ -0,0 +1,53 @@
+package mqtt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Transport carries the messages between the server and the agents.
+// It is implemented by MqttClient for an MQTT broker and by the
+// in-memory transport of a Broker.
+type Transport interface {
+	Connect() error
+	Close()
+	// Subscribe registers the handler of a topic, handlers are
+	// called one message at a time.
+	Subscribe(topic string, handler func(string)) error
+	Publish(topic, message string) error
+	IsConnected() bool
+}
+
+// BrokerURL returns the URL of a broker with the credentials of a
+// client, replacing the ones it may already have. URLs without a
+// scheme are mqtt:// URLs.
+func BrokerURL(rawURL, user, password string) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = fmt.Sprintf("mqtt://%s", rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// the error holds the URL, which can have credentials
+		return "", fmt.Errorf("parsing broker URL")
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("broker URL has no host")
+	}
+	u.User = url.UserPassword(user, password)
+	return u.String(), nil
+}
+
+// ParseUsers parses the credentials accepted by a Broker, written
+// as user:password pairs separated by commas.
+func ParseUsers(s string) (map[string]string, error) {
+	users := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("users must be user:password pairs separated by commas")
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, nil
+}
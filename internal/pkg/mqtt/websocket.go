@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebsocketHandler serves MQTT over websockets, letting agents
+// connect to a broker behind the HTTP port of the server.
+func (b *Broker) WebsocketHandler() http.Handler {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+		// clients are not browsers, they authenticate with
+		// their MQTT credentials
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader already responded with the error
+			return
+		}
+		b.ServeConn(&websocketConn{Conn: ws})
+	})
+}
+
+// websocketConn reads and writes MQTT packets as a stream over
+// binary websocket messages.
+type websocketConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	err := c.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
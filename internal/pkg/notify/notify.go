@@ -0,0 +1,142 @@
+package notify
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v2"
+)
+
+type sender interface {
+	accepts(eventType string) bool
+	send(e Event) error
+}
+
+// Deduper records the last event sent about each subject so servers
+// sharing it do not send the same notification.
+type Deduper interface {
+	// IsRepeat returns true when key was the last key recorded for
+	// the subject within window, otherwise it records key.
+	IsRepeat(subject, key string, window time.Duration) (bool, error)
+}
+
+type sent struct {
+	key string
+	at  time.Time
+}
+
+// Notifier sends events to every configured destination,
+// dropping repeats of the last event sent about a subject.
+type Notifier struct {
+	senders []sender
+	window  time.Duration
+	now     func() time.Time
+	// deduper is used instead of last when set
+	deduper Deduper
+
+	mu   sync.Mutex
+	last map[string]sent
+}
+
+// NewNotifierFromYaml parses the notifier config, an empty
+// config returns a notifier without destinations.
+func NewNotifierFromYaml(s string) (*Notifier, error) {
+	var c Config
+	if err := yaml.Unmarshal([]byte(s), &c); err != nil {
+		return nil, fmt.Errorf("unmarshalling notifier config: %s", err)
+	}
+	return NewNotifier(c)
+}
+
+func NewNotifier(c Config) (*Notifier, error) {
+	n := &Notifier{
+		window: defaultDedupeWindow,
+		now:    time.Now,
+		last:   map[string]sent{},
+	}
+
+	if c.DedupeWindow != "" {
+		d, err := time.ParseDuration(c.DedupeWindow)
+		if err != nil {
+			return nil, fmt.Errorf("parsing dedupeWindow: %s", err)
+		}
+		n.window = d
+	}
+
+	for i, w := range c.Webhooks {
+		if w.URL == "" {
+			return nil, fmt.Errorf("webhooks[%d]: url is required", i)
+		}
+		n.senders = append(n.senders, webhookSender{w})
+	}
+	for i, s := range c.Slack {
+		if s.WebhookURL == "" {
+			return nil, fmt.Errorf("slack[%d]: webhookURL is required", i)
+		}
+		n.senders = append(n.senders, slackSender{s})
+	}
+	for i, s := range c.SMTP {
+		if s.Host == "" || s.Port == 0 || s.From == "" || len(s.To) == 0 {
+			return nil, fmt.Errorf("smtp[%d]: host, port, from and to are required", i)
+		}
+		n.senders = append(n.senders, smtpSender{s})
+	}
+	return n, nil
+}
+
+// SetDeduper shares the events sent with other notifiers, the
+// events sent are only kept in memory otherwise.
+func (n *Notifier) SetDeduper(d Deduper) {
+	n.deduper = d
+}
+
+// Notify sends an event unless it repeats the last event sent
+// about the same subject within the dedupe window. Every
+// destination is tried, their errors are combined.
+func (n *Notifier) Notify(e Event) error {
+	if len(n.senders) == 0 {
+		return nil
+	}
+
+	var result error
+	repeat, err := n.isRepeat(e)
+	if err != nil {
+		// a repeat is better than a missed notification
+		result = multierror.Append(result, fmt.Errorf("checking for a repeated event: %s", err))
+	}
+	if repeat {
+		return nil
+	}
+	if e.Timestamp == 0 {
+		e.Timestamp = n.now().Unix()
+	}
+
+	for _, s := range n.senders {
+		if !s.accepts(e.Type) {
+			continue
+		}
+		if err := s.send(e); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+func (n *Notifier) isRepeat(e Event) (bool, error) {
+	if n.deduper != nil {
+		return n.deduper.IsRepeat(e.subject(), e.key(), n.window)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
+	last, ok := n.last[e.subject()]
+	if ok && last.key == e.key() && now.Sub(last.at) < n.window {
+		return true, nil
+	}
+	n.last[e.subject()] = sent{key: e.key(), at: now}
+	return false, nil
+}
@@ -0,0 +1,184 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	Filter
+	events []Event
+}
+
+func (r *recorder) send(e Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func newTestNotifier(senders ...sender) (*Notifier, *time.Time) {
+	now := time.Unix(1640995200, 0)
+	n := &Notifier{
+		senders: senders,
+		window:  time.Hour,
+		now:     func() time.Time { return now },
+		last:    map[string]sent{},
+	}
+	return n, &now
+}
+
+func Test_NotifyDedupe(t *testing.T) {
+	r := &recorder{}
+	n, now := newTestNotifier(r)
+
+	offline := Event{Type: EventAgentOffline, Host: "pi-1"}
+	online := Event{Type: EventAgentOnline, Host: "pi-1"}
+
+	assert.NoError(t, n.Notify(offline))
+	// repeats are dropped
+	assert.NoError(t, n.Notify(offline))
+	// other hosts are not affected
+	assert.NoError(t, n.Notify(Event{Type: EventAgentOffline, Host: "pi-2"}))
+	// a transition is always sent
+	assert.NoError(t, n.Notify(online))
+	assert.NoError(t, n.Notify(offline))
+
+	*now = now.Add(2 * time.Hour)
+	// repeats are sent again after the dedupe window
+	assert.NoError(t, n.Notify(offline))
+
+	types := []string{}
+	for _, e := range r.events {
+		types = append(types, e.Type+" "+e.Host)
+	}
+	assert.Equal(t, []string{
+		"AGENT_OFFLINE pi-1",
+		"AGENT_OFFLINE pi-2",
+		"AGENT_ONLINE pi-1",
+		"AGENT_OFFLINE pi-1",
+		"AGENT_OFFLINE pi-1",
+	}, types)
+	assert.Equal(t, int64(1640995200), r.events[0].Timestamp)
+}
+
+func Test_NotifyDeployDedupe(t *testing.T) {
+	r := &recorder{}
+	n, _ := newTestNotifier(r)
+
+	failure := Event{Type: EventDeployFailure, Host: "pi-1", RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app", SHA: "abc123", Error: "health check failed"}
+	assert.NoError(t, n.Notify(failure))
+	assert.NoError(t, n.Notify(failure))
+	// a new version failing is not a repeat
+	failure.SHA = "def456"
+	assert.NoError(t, n.Notify(failure))
+	assert.Equal(t, 2, len(r.events))
+}
+
+// sharedDeduper is the dedupe state shared by the notifiers of
+// several servers.
+type sharedDeduper map[string]string
+
+func (d sharedDeduper) IsRepeat(subject, key string, window time.Duration) (bool, error) {
+	if d[subject] == key {
+		return true, nil
+	}
+	d[subject] = key
+	return false, nil
+}
+
+func Test_NotifySharedDedupe(t *testing.T) {
+	r := &recorder{}
+	d := sharedDeduper{}
+	first, _ := newTestNotifier(r)
+	first.SetDeduper(d)
+	second, _ := newTestNotifier(r)
+	second.SetDeduper(d)
+
+	success := Event{Type: EventDeploySuccess, Host: "pi-1", RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app", SHA: "abc123"}
+	assert.NoError(t, first.Notify(success))
+	assert.NoError(t, second.Notify(success))
+	assert.Equal(t, 1, len(r.events))
+}
+
+func Test_NotifyFilter(t *testing.T) {
+	all := &recorder{}
+	failures := &recorder{Filter: Filter{Events: []string{EventDeployFailure}}}
+	n, _ := newTestNotifier(all, failures)
+
+	assert.NoError(t, n.Notify(Event{Type: EventDeploySuccess, Host: "pi-1", RepoName: "andrewmarklloyd/pi-test", ManifestName: "sample-app"}))
+	assert.Equal(t, 1, len(all.events))
+	assert.Equal(t, 0, len(failures.events))
+}
+
+func Test_Senders(t *testing.T) {
+	var bodies []string
+	var apiKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if r.URL.Path == "/webhook" {
+			apiKey = r.Header.Get("api-key")
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	n, err := NewNotifierFromYaml(`
+webhooks:
+- url: ` + srv.URL + `/webhook
+  headers:
+    api-key: secret
+slack:
+- webhookURL: ` + srv.URL + `/slack
+  events: [AGENT_OFFLINE]
+`)
+	assert.NoError(t, err)
+
+	err = n.Notify(Event{Type: EventAgentOffline, Host: "pi-1", Timestamp: 1640995200})
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", apiKey)
+
+	var e Event
+	assert.NoError(t, json.Unmarshal([]byte(bodies[0]), &e))
+	assert.Equal(t, Event{Type: EventAgentOffline, Host: "pi-1", Timestamp: 1640995200}, e)
+	assert.Equal(t, `{"text":"Agent pi-1 is offline"}`, bodies[1])
+
+	n, err = NewNotifier(Config{Slack: []SlackConfig{{WebhookURL: srv.URL + "/broken"}}})
+	assert.NoError(t, err)
+	err = n.Notify(Event{Type: EventAgentOnline, Host: "pi-1"})
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "unexpected status code 500"))
+	assert.False(t, strings.Contains(err.Error(), "/broken"))
+}
+
+func Test_NewNotifierInvalid(t *testing.T) {
+	_, err := NewNotifier(Config{DedupeWindow: "soon"})
+	assert.EqualError(t, err, `parsing dedupeWindow: time: invalid duration "soon"`)
+
+	_, err = NewNotifier(Config{SMTP: []SMTPConfig{{Host: "smtp.example.com"}}})
+	assert.EqualError(t, err, "smtp[0]: host, port, from and to are required")
+
+	n, err := NewNotifierFromYaml("")
+	assert.NoError(t, err)
+	assert.NoError(t, n.Notify(Event{Type: EventAgentOffline, Host: "pi-1"}))
+}
+
+func Test_EmailMessage(t *testing.T) {
+	msg := emailMessage("deployer@example.com", []string{"ops@example.com"}, Event{
+		Type:         EventDeployFailure,
+		Host:         "pi-1",
+		RepoName:     "andrewmarklloyd/pi-test",
+		ManifestName: "sample-app",
+		SHA:          "abc123",
+		Error:        "health check failed",
+	})
+	assert.Equal(t, "From: deployer@example.com\r\nTo: ops@example.com\r\nSubject: [pi-app-deployer] Failed to deploy andrewmarklloyd/pi-test/sample-app abc123 to pi-1\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nFailed to deploy andrewmarklloyd/pi-test/sample-app abc123 to pi-1: health check failed\r\n", string(msg))
+}
@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+type webhookSender struct {
+	WebhookConfig
+}
+
+func (w webhookSender) send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshalling event: %s", err)
+	}
+	return post(w.URL, w.Headers, body)
+}
+
+type slackSender struct {
+	SlackConfig
+}
+
+func (s slackSender) send(e Event) error {
+	body, err := json.Marshal(map[string]string{"text": e.Message()})
+	if err != nil {
+		return fmt.Errorf("marshalling slack message: %s", err)
+	}
+	return post(s.WebhookURL, nil, body)
+}
+
+type smtpSender struct {
+	SMTPConfig
+}
+
+func (s smtpSender) send(e Event) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	if err := smtp.SendMail(addr, auth, s.From, s.To, emailMessage(s.From, s.To, e)); err != nil {
+		return fmt.Errorf("sending email with %s: %s", addr, err)
+	}
+	return nil
+}
+
+// headerValue keeps values sent by agents from adding headers
+var headerValue = strings.NewReplacer("\r", " ", "\n", " ")
+
+func emailMessage(from string, to []string, e Event) []byte {
+	headers := []string{
+		fmt.Sprintf("From: %s", from),
+		fmt.Sprintf("To: %s", strings.Join(to, ", ")),
+		fmt.Sprintf("Subject: [pi-app-deployer] %s", headerValue.Replace(e.Title())),
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := e.Message()
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body + "\r\n")
+}
+
+func post(url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		// the url may hold a secret token, only keep the host
+		return fmt.Errorf("posting event to %s: %s", req.URL.Host, unwrapURLError(err))
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("posting event to %s: unexpected status code %d", req.URL.Host, res.StatusCode)
+	}
+	return nil
+}
+
+func unwrapURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	EventAgentOffline  = "AGENT_OFFLINE"
+	EventAgentOnline   = "AGENT_ONLINE"
+	EventDeploySuccess = "DEPLOY_SUCCESS"
+	EventDeployFailure = "DEPLOY_FAILURE"
+
+	defaultDedupeWindow = 1 * time.Hour
+)
+
+// Config is read from yaml, every destination
+// is sent the events it subscribes to.
+type Config struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	Slack    []SlackConfig   `yaml:"slack"`
+	SMTP     []SMTPConfig    `yaml:"smtp"`
+	// DedupeWindow is how long a repeat of the last event sent about
+	// a host or app is dropped, for example 30m. Defaults to 1h.
+	DedupeWindow string `yaml:"dedupeWindow"`
+}
+
+// Filter limits a destination to some event types,
+// all events are sent when it is empty.
+type Filter struct {
+	Events []string `yaml:"events"`
+}
+
+// WebhookConfig posts events as JSON.
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Filter  `yaml:",inline"`
+}
+
+// SlackConfig posts events to a Slack compatible incoming webhook.
+type SlackConfig struct {
+	WebhookURL string `yaml:"webhookURL"`
+	Filter     `yaml:",inline"`
+}
+
+// SMTPConfig sends events by email. Username and
+// Password are optional, PLAIN auth is used when set.
+type SMTPConfig struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Filter   `yaml:",inline"`
+}
+
+// Event is something worth alerting about. RepoName,
+// ManifestName and SHA are empty for agent events.
+type Event struct {
+	Type         string `json:"type"`
+	Host         string `json:"host"`
+	RepoName     string `json:"repoName,omitempty"`
+	ManifestName string `json:"manifestName,omitempty"`
+	SHA          string `json:"sha,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// Title is a one line summary of the event.
+func (e Event) Title() string {
+	switch e.Type {
+	case EventAgentOffline:
+		return fmt.Sprintf("Agent %s is offline", e.Host)
+	case EventAgentOnline:
+		return fmt.Sprintf("Agent %s is back online", e.Host)
+	case EventDeploySuccess:
+		return fmt.Sprintf("Deployed %s/%s %s to %s", e.RepoName, e.ManifestName, e.SHA, e.Host)
+	case EventDeployFailure:
+		return fmt.Sprintf("Failed to deploy %s/%s %s to %s", e.RepoName, e.ManifestName, e.SHA, e.Host)
+	}
+	return fmt.Sprintf("%s on %s", e.Type, e.Host)
+}
+
+// Message is the title followed by the error, if any.
+func (e Event) Message() string {
+	if e.Error == "" {
+		return e.Title()
+	}
+	return fmt.Sprintf("%s: %s", e.Title(), e.Error)
+}
+
+// subject is what the event is about, a host or an app on a host
+func (e Event) subject() string {
+	if e.RepoName == "" {
+		return e.Host
+	}
+	return fmt.Sprintf("%s/%s/%s", e.RepoName, e.ManifestName, e.Host)
+}
+
+// key identifies repeats of an event about the same subject
+func (e Event) key() string {
+	return fmt.Sprintf("%s/%s/%s", e.Type, e.SHA, e.Error)
+}
+
+func (f Filter) accepts(eventType string) bool {
+	if len(f.Events) == 0 {
+		return true
+	}
+	for _, e := range f.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
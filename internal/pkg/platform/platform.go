@@ -0,0 +1,85 @@
+package platform
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Platform identifies the binaries a host can run, written
+// as os/arch or os/arch/variant, e.g. linux/arm/v6 or linux/arm64.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Arch)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Arch, p.Variant)
+}
+
+// Parse parses a platform written as os/arch or os/arch/variant.
+func Parse(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, fmt.Errorf("platform %s must be written as os/arch or os/arch/variant", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, fmt.Errorf("platform %s must be written as os/arch or os/arch/variant", s)
+		}
+	}
+	p := Platform{OS: parts[0], Arch: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// Detect returns the platform of this host. The ARM variant
+// is read from the machine rather than the GOARM the agent
+// was built with, since agents are built for the oldest Pi.
+func Detect() Platform {
+	machine, err := exec.Command("uname", "-m").Output()
+	if err != nil {
+		machine = []byte{}
+	}
+	return detect(runtime.GOOS, runtime.GOARCH, strings.TrimSpace(string(machine)))
+}
+
+func detect(goos, goarch, machine string) Platform {
+	p := Platform{OS: goos, Arch: goarch}
+	if goarch != "arm" {
+		return p
+	}
+	switch {
+	case strings.HasPrefix(machine, "armv5"):
+		p.Variant = "v5"
+	case strings.HasPrefix(machine, "armv6"):
+		p.Variant = "v6"
+	case strings.HasPrefix(machine, "armv7"), strings.HasPrefix(machine, "armv8"), machine == "aarch64":
+		// 32 bit binaries on 64 bit ARM run as ARMv7
+		p.Variant = "v7"
+	}
+	return p
+}
+
+// Candidates returns the platforms whose binaries can run on
+// this platform, most specific first. ARM hosts can run
+// binaries built for older variants.
+func (p Platform) Candidates() []string {
+	base := fmt.Sprintf("%s/%s", p.OS, p.Arch)
+	candidates := []string{}
+	if p.Arch == "arm" && p.Variant != "" {
+		for v := p.Variant[1]; v >= '5'; v-- {
+			candidates = append(candidates, fmt.Sprintf("%s/v%c", base, v))
+		}
+	} else if p.Variant != "" {
+		candidates = append(candidates, p.String())
+	}
+	return append(candidates, base)
+}
@@ -0,0 +1,38 @@
+package platform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Detect(t *testing.T) {
+	assert.Equal(t, "linux/arm/v6", detect("linux", "arm", "armv6l").String())
+	assert.Equal(t, "linux/arm/v7", detect("linux", "arm", "armv7l").String())
+	assert.Equal(t, "linux/arm/v7", detect("linux", "arm", "aarch64").String())
+	assert.Equal(t, "linux/arm", detect("linux", "arm", "").String())
+	assert.Equal(t, "linux/arm64", detect("linux", "arm64", "aarch64").String())
+	assert.Equal(t, "linux/amd64", detect("linux", "amd64", "x86_64").String())
+}
+
+func Test_Parse(t *testing.T) {
+	p, err := Parse("linux/arm/v6")
+	assert.NoError(t, err)
+	assert.Equal(t, Platform{OS: "linux", Arch: "arm", Variant: "v6"}, p)
+
+	p, err = Parse("linux/arm64")
+	assert.NoError(t, err)
+	assert.Equal(t, Platform{OS: "linux", Arch: "arm64"}, p)
+
+	for _, s := range []string{"", "arm64", "linux//v7", "linux/arm/v7/extra"} {
+		_, err = Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_Candidates(t *testing.T) {
+	assert.Equal(t, []string{"linux/arm/v7", "linux/arm/v6", "linux/arm/v5", "linux/arm"}, Platform{OS: "linux", Arch: "arm", Variant: "v7"}.Candidates())
+	assert.Equal(t, []string{"linux/arm/v5", "linux/arm"}, Platform{OS: "linux", Arch: "arm", Variant: "v5"}.Candidates())
+	assert.Equal(t, []string{"linux/arm"}, Platform{OS: "linux", Arch: "arm"}.Candidates())
+	assert.Equal(t, []string{"linux/arm64"}, Platform{OS: "linux", Arch: "arm64"}.Candidates())
+}
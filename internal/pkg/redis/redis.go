@@ -16,6 +16,28 @@ import (
 const (
 	updateConditionStatusPrefix = config.RepoPushStatusTopic
 	agentInventoryPrefix        = config.AgentInventoryTopic
+	deployHistoryPrefix         = "deploy/history"
+	deployInProgressPrefix      = "deploy/inprogress"
+	rolloutPrefix               = "rollout"
+	rolloutLeasePrefix          = "lease/rollout"
+	desiredArtifactPrefix       = "desired"
+	rolledBackPrefix            = "rolledback"
+	notificationPrefix          = "notify/last"
+	agentLabelsPrefix           = "agent/labels"
+	agentPlatformPrefix         = "agent/platform"
+	// agentLastSeenKey is a sorted set of hosts scored by the
+	// unix time of their last inventory
+	agentLastSeenKey = "agent/lastseen"
+	// agentOfflineKey is the set of hosts found offline by the sweeper
+	agentOfflineKey  = "agent/offline"
+	sweeperLeaderKey = "agent/sweeper/leader"
+
+	// DeployHistoryLimit is the number of deployment records
+	// kept per repo, manifest and host.
+	DeployHistoryLimit = 50
+	// an in progress deployment not finished after this
+	// duration is dropped from the history
+	deployInProgressExpiration = 1 * time.Hour
 )
 
 type Redis struct {
@@ -25,10 +47,13 @@ type Redis struct {
 func NewRedisClient(redisURL string) (Redis, error) {
 	r := Redis{}
 	options, err := redis.ParseURL(redisURL)
-	options.TLSConfig.InsecureSkipVerify = true
 	if err != nil {
 		return r, err
 	}
+	// only rediss:// URLs use TLS
+	if options.TLSConfig != nil {
+		options.TLSConfig.InsecureSkipVerify = true
+	}
 	r.client = *redis.NewClient(options)
 
 	return r, nil
@@ -60,8 +85,8 @@ func (r *Redis) DeleteConditions(ctx context.Context, repoName, manifestName str
 	if err != nil {
 		return err
 	}
-	for k := range m {
-		_, err := r.client.Del(ctx, k).Result()
+	for host := range m {
+		_, err := r.client.Del(ctx, getWriteKey(repoName, manifestName, host)).Result()
 		if err != nil {
 			return err
 		}
@@ -84,16 +109,179 @@ func (r *Redis) WriteCondition(ctx context.Context, uc status.UpdateCondition) e
 	return nil
 }
 
+// inventoryRecord is the value of an agent inventory key. Agents
+// before it was introduced only wrote the timestamp.
+type inventoryRecord struct {
+	Timestamp    int64  `json:"timestamp"`
+	SHA          string `json:"sha,omitempty"`
+	AgentVersion string `json:"agentVersion,omitempty"`
+}
+
 func (r *Redis) WriteAgentInventory(ctx context.Context, c config.AgentInventoryPayload, expiration time.Duration) error {
 	key := getAgentInventoryWriteKey(c.RepoName, c.ManifestName, c.Host)
-	d := r.client.Set(ctx, key, c.Timestamp, expiration)
-	err := d.Err()
+	value, err := json.Marshal(inventoryRecord{
+		Timestamp:    c.Timestamp,
+		SHA:          c.SHA,
+		AgentVersion: c.AgentVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("marshalling json: %s", err)
+	}
+	d := r.client.Set(ctx, key, value, expiration)
+	err = d.Err()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// ReadAllAgentInventory returns the last inventory of
+// every app reported by every agent.
+func (r *Redis) ReadAllAgentInventory(ctx context.Context) ([]config.AgentInventoryPayload, error) {
+	inventory := []config.AgentInventoryPayload{}
+	keys := r.client.Keys(ctx, fmt.Sprintf("%s/*", agentInventoryPrefix)).Val()
+	for _, k := range keys {
+		p, ok := parseAgentInventoryKey(k)
+		if !ok {
+			continue
+		}
+		val, err := r.client.Get(ctx, k).Result()
+		if err == redis.Nil {
+			// expired since listing the keys
+			continue
+		}
+		if err != nil {
+			return inventory, err
+		}
+		record, err := parseInventoryRecord(val)
+		if err != nil {
+			return inventory, err
+		}
+		p.Timestamp = record.Timestamp
+		p.SHA = record.SHA
+		p.AgentVersion = record.AgentVersion
+		inventory = append(inventory, p)
+	}
+	return inventory, nil
+}
+
+// ReadCondition returns the last update condition of an app on a host.
+func (r *Redis) ReadCondition(ctx context.Context, repoName, manifestName, host string) (status.UpdateCondition, bool, error) {
+	var uc status.UpdateCondition
+	val, err := r.client.Get(ctx, getWriteKey(repoName, manifestName, host)).Result()
+	if err == redis.Nil {
+		return uc, false, nil
+	}
+	if err != nil {
+		return uc, false, err
+	}
+	err = json.Unmarshal([]byte(val), &uc)
+	return uc, err == nil, err
+}
+
+func (r *Redis) WriteAgentLabels(ctx context.Context, host string, labels map[string]string, expiration time.Duration) error {
+	value, err := json.Marshal(labels)
+	if err != nil {
+		return fmt.Errorf("marshalling json: %s", err)
+	}
+	return r.client.Set(ctx, getAgentLabelsKey(host), value, expiration).Err()
+}
+
+func (r *Redis) ReadAgentLabels(ctx context.Context, host string) (map[string]string, error) {
+	labels := map[string]string{}
+	val, err := r.client.Get(ctx, getAgentLabelsKey(host)).Result()
+	if err == redis.Nil {
+		return labels, nil
+	}
+	if err != nil {
+		return labels, err
+	}
+	err = json.Unmarshal([]byte(val), &labels)
+	return labels, err
+}
+
+func (r *Redis) WriteAgentPlatform(ctx context.Context, host, platform string, expiration time.Duration) error {
+	return r.client.Set(ctx, getAgentPlatformKey(host), platform, expiration).Err()
+}
+
+// ReadAgentPlatform returns an empty platform for agents
+// that have not reported one.
+func (r *Redis) ReadAgentPlatform(ctx context.Context, host string) (string, error) {
+	val, err := r.client.Get(ctx, getAgentPlatformKey(host)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return val, err
+}
+
+// WriteAgentLastSeen records that an inventory was received from a host.
+func (r *Redis) WriteAgentLastSeen(ctx context.Context, host string, t time.Time) error {
+	return r.client.ZAdd(ctx, agentLastSeenKey, &redis.Z{
+		Score:  float64(t.Unix()),
+		Member: host,
+	}).Err()
+}
+
+// acquireLeaderScript takes the leader key when it is free and
+// extends it when it is already held by the same id.
+var acquireLeaderScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+// AcquireSweeperLeadership returns true when id holds the sweeper
+// leadership for ttl. Leaders must call it again before ttl passes
+// to keep it, another server takes over when they stop.
+func (r *Redis) AcquireSweeperLeadership(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	n, err := acquireLeaderScript.Run(ctx, &r.client, []string{sweeperLeaderKey}, id, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// SweepAgents returns the hosts that went offline, with no inventory
+// since before now minus timeout, and the hosts that came back online
+// since the last sweep. Each transition is only returned once, even
+// when sweeps run concurrently.
+func (r *Redis) SweepAgents(ctx context.Context, now time.Time, timeout time.Duration) (offline, online []string, err error) {
+	cutoff := strconv.FormatInt(now.Add(-timeout).Unix(), 10)
+
+	stale, err := r.client.ZRangeByScore(ctx, agentLastSeenKey, &redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, host := range stale {
+		n, err := r.client.SAdd(ctx, agentOfflineKey, host).Result()
+		if err != nil {
+			return offline, online, err
+		}
+		if n == 1 {
+			offline = append(offline, host)
+		}
+	}
+
+	fresh, err := r.client.ZRangeByScore(ctx, agentLastSeenKey, &redis.ZRangeBy{Min: "(" + cutoff, Max: "+inf"}).Result()
+	if err != nil {
+		return offline, online, err
+	}
+	for _, host := range fresh {
+		n, err := r.client.SRem(ctx, agentOfflineKey, host).Result()
+		if err != nil {
+			return offline, online, err
+		}
+		if n == 1 {
+			online = append(online, host)
+		}
+	}
+	return offline, online, nil
+}
+
 func (r *Redis) ReadAgentInventory(ctx context.Context, repoName, manifestName string) (map[string]time.Time, error) {
 	agents := make(map[string]time.Time, 0)
 	readKey := getAgentInventoryReadKey(repoName, manifestName)
@@ -105,16 +293,275 @@ func (r *Redis) ReadAgentInventory(ctx context.Context, repoName, manifestName s
 		if err != nil {
 			return agents, err
 		}
-		n, err := strconv.ParseInt(val, 10, 64)
+		record, err := parseInventoryRecord(val)
 		if err != nil {
 			return agents, err
 		}
-		agents[host] = time.Unix(n, 0)
+		agents[host] = time.Unix(record.Timestamp, 0)
 	}
 
 	return agents, nil
 }
 
+// WriteDeploymentStart records the start of a deployment attempt
+// which is completed by a later call to WriteDeploymentResult.
+func (r *Redis) WriteDeploymentStart(ctx context.Context, uc status.UpdateCondition, t time.Time) error {
+	record := status.DeploymentRecord{
+		RepoName:     uc.RepoName,
+		ManifestName: uc.ManifestName,
+		Host:         uc.Host,
+		SHA:          uc.SHA,
+		ArtifactName: uc.ArtifactName,
+		StartedAt:    t.Unix(),
+		Status:       uc.Status,
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshalling json: %s", err)
+	}
+
+	key := getDeployInProgressKey(uc.RepoName, uc.ManifestName, uc.Host)
+	return r.client.Set(ctx, key, value, deployInProgressExpiration).Err()
+}
+
+// WriteDeploymentResult appends a finished deployment attempt to the
+// history, keeping at most DeployHistoryLimit records.
+func (r *Redis) WriteDeploymentResult(ctx context.Context, uc status.UpdateCondition, t time.Time) error {
+	inProgressKey := getDeployInProgressKey(uc.RepoName, uc.ManifestName, uc.Host)
+
+	var record status.DeploymentRecord
+	val, err := r.client.Get(ctx, inProgressKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if err == redis.Nil {
+		record.StartedAt = t.Unix()
+	} else {
+		if err := json.Unmarshal([]byte(val), &record); err != nil {
+			return fmt.Errorf("unmarshalling in progress deployment: %s", err)
+		}
+	}
+
+	record = toDeploymentRecord(record, uc, t)
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshalling json: %s", err)
+	}
+
+	historyKey := getDeployHistoryKey(uc.RepoName, uc.ManifestName, uc.Host)
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, historyKey, value)
+		pipe.LTrim(ctx, historyKey, 0, DeployHistoryLimit-1)
+		pipe.Del(ctx, inProgressKey)
+		return nil
+	})
+	return err
+}
+
+// ReadDeploymentHistory returns the deployment history of each host,
+// newest first. All hosts are returned when host is empty.
+func (r *Redis) ReadDeploymentHistory(ctx context.Context, repoName, manifestName, host string) (map[string][]status.DeploymentRecord, error) {
+	history := make(map[string][]status.DeploymentRecord)
+
+	var keys []string
+	if host != "" {
+		keys = []string{getDeployHistoryKey(repoName, manifestName, host)}
+	} else {
+		keys = r.client.Keys(ctx, getDeployHistoryReadKey(repoName, manifestName)).Val()
+	}
+
+	for _, k := range keys {
+		vals, err := r.client.LRange(ctx, k, 0, -1).Result()
+		if err != nil {
+			return history, err
+		}
+		if len(vals) == 0 {
+			continue
+		}
+		records := make([]status.DeploymentRecord, len(vals))
+		for i, v := range vals {
+			if err := json.Unmarshal([]byte(v), &records[i]); err != nil {
+				return history, err
+			}
+		}
+		history[records[0].Host] = records
+	}
+
+	return history, nil
+}
+
+func toDeploymentRecord(start status.DeploymentRecord, uc status.UpdateCondition, t time.Time) status.DeploymentRecord {
+	record := start
+	record.RepoName = uc.RepoName
+	record.ManifestName = uc.ManifestName
+	record.Host = uc.Host
+	if uc.SHA != "" {
+		record.SHA = uc.SHA
+	}
+	if uc.ArtifactName != "" {
+		record.ArtifactName = uc.ArtifactName
+	}
+	record.FinishedAt = t.Unix()
+	record.DurationSec = record.FinishedAt - record.StartedAt
+	record.Status = uc.Status
+	record.Error = uc.Error
+	record.RolledBack = uc.RolledBack
+	record.RunningSHA = uc.RunningSHA
+	return record
+}
+
+func (r *Redis) WriteRolloutStatus(ctx context.Context, rs status.RolloutStatus) error {
+	value, err := json.Marshal(rs)
+	if err != nil {
+		return fmt.Errorf("marshalling json: %s", err)
+	}
+	return r.client.Set(ctx, getRolloutKey(rs.RepoName, rs.ManifestName), value, 0).Err()
+}
+
+func (r *Redis) ReadRolloutStatus(ctx context.Context, repoName, manifestName string) (status.RolloutStatus, error) {
+	var rs status.RolloutStatus
+	val, err := r.client.Get(ctx, getRolloutKey(repoName, manifestName)).Result()
+	if err != nil {
+		return rs, err
+	}
+	err = json.Unmarshal([]byte(val), &rs)
+	return rs, err
+}
+
+// RenewRolloutLease marks the rollout of an app as running for ttl,
+// the server running it renews the lease until it finishes.
+func (r *Redis) RenewRolloutLease(ctx context.Context, repoName, manifestName, id string, ttl time.Duration) error {
+	return r.client.Set(ctx, getRolloutLeaseKey(repoName, manifestName), id, ttl).Err()
+}
+
+// releaseLeaseScript deletes a lease only when it is still held by the same id.
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// ReleaseRolloutLease drops the lease of a finished rollout, unless
+// it was taken over by a newer rollout of the app.
+func (r *Redis) ReleaseRolloutLease(ctx context.Context, repoName, manifestName, id string) error {
+	return releaseLeaseScript.Run(ctx, &r.client, []string{getRolloutLeaseKey(repoName, manifestName)}, id).Err()
+}
+
+// HaltInterruptedRollouts halts the rollouts left in progress without
+// a lease, their server stopped before finishing them. The halted
+// rollouts are returned.
+func (r *Redis) HaltInterruptedRollouts(ctx context.Context, reason string) ([]status.RolloutStatus, error) {
+	halted := []status.RolloutStatus{}
+	keys := r.client.Keys(ctx, fmt.Sprintf("%s/*", rolloutPrefix)).Val()
+	for _, k := range keys {
+		leaseKey := fmt.Sprintf("%s/%s", rolloutLeasePrefix, strings.TrimPrefix(k, rolloutPrefix+"/"))
+		// the rollout is not halted when it finished or
+		// renewed its lease since it was read
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			val, err := tx.Get(ctx, k).Result()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			var rs status.RolloutStatus
+			if err := json.Unmarshal([]byte(val), &rs); err != nil {
+				return fmt.Errorf("unmarshalling rollout status: %s", err)
+			}
+			if rs.Status != config.StatusInProgress {
+				return nil
+			}
+			n, err := tx.Exists(ctx, leaseKey).Result()
+			if err != nil || n > 0 {
+				return err
+			}
+
+			rs.Status = config.StatusHalted
+			rs.Error = reason
+			value, err := json.Marshal(rs)
+			if err != nil {
+				return fmt.Errorf("marshalling json: %s", err)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, k, value, 0)
+				return nil
+			})
+			if err == nil {
+				halted = append(halted, rs)
+			}
+			return err
+		}, k, leaseKey)
+		if err != nil && err != redis.TxFailedErr {
+			return halted, err
+		}
+	}
+	return halted, nil
+}
+
+// repeatScript returns 1 when the key is already the value of the
+// subject, otherwise it sets it with the window as TTL.
+var repeatScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return 1
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 0
+`)
+
+// IsRepeatNotification returns true when key is the last notification
+// sent about a subject within window, otherwise it records key. It is
+// atomic so a notification is sent once by all the servers.
+func (r *Redis) IsRepeatNotification(ctx context.Context, subject, key string, window time.Duration) (bool, error) {
+	n, err := repeatScript.Run(ctx, &r.client, []string{getNotificationKey(subject)}, key, window.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// WriteDesiredArtifact records the artifact last pushed for an app,
+// agents update to it when they missed the push.
+func (r *Redis) WriteDesiredArtifact(ctx context.Context, a config.Artifact) error {
+	value, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("marshalling json: %s", err)
+	}
+	return r.client.Set(ctx, getDesiredArtifactKey(a.RepoName, a.ManifestName), value, 0).Err()
+}
+
+func (r *Redis) ReadDesiredArtifact(ctx context.Context, repoName, manifestName string) (config.Artifact, bool, error) {
+	var a config.Artifact
+	val, err := r.client.Get(ctx, getDesiredArtifactKey(repoName, manifestName)).Result()
+	if err == redis.Nil {
+		return a, false, nil
+	}
+	if err != nil {
+		return a, false, err
+	}
+	err = json.Unmarshal([]byte(val), &a)
+	if err != nil {
+		return a, false, fmt.Errorf("unmarshalling json: %s", err)
+	}
+	return a, true, nil
+}
+
+// WriteRolledBackSHA records the desired SHA a host was rolled back
+// from, it does not update to it again.
+func (r *Redis) WriteRolledBackSHA(ctx context.Context, repoName, manifestName, host, sha string) error {
+	return r.client.Set(ctx, getRolledBackKey(repoName, manifestName, host), sha, 0).Err()
+}
+
+// ReadRolledBackSHA returns an empty SHA for hosts never rolled back.
+func (r *Redis) ReadRolledBackSHA(ctx context.Context, repoName, manifestName, host string) (string, error) {
+	val, err := r.client.Get(ctx, getRolledBackKey(repoName, manifestName, host)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return val, err
+}
+
 func (r *Redis) ReadAll(ctx context.Context) (map[string]string, error) {
 	state := make(map[string]string)
 	keys := r.client.Keys(ctx, fmt.Sprintf("%s/*", updateConditionStatusPrefix)).Val()
@@ -128,6 +575,32 @@ func (r *Redis) ReadAll(ctx context.Context) (map[string]string, error) {
 	return state, nil
 }
 
+func parseInventoryRecord(val string) (inventoryRecord, error) {
+	var record inventoryRecord
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		record.Timestamp = n
+		return record, nil
+	}
+	if err := json.Unmarshal([]byte(val), &record); err != nil {
+		return record, fmt.Errorf("parsing agent inventory: %s", err)
+	}
+	return record, nil
+}
+
+// parseAgentInventoryKey splits a key written by
+// getAgentInventoryWriteKey, repo names include the owner.
+func parseAgentInventoryKey(key string) (config.AgentInventoryPayload, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, agentInventoryPrefix+"/"), "/")
+	if len(parts) != 4 {
+		return config.AgentInventoryPayload{}, false
+	}
+	return config.AgentInventoryPayload{
+		RepoName:     fmt.Sprintf("%s/%s", parts[0], parts[1]),
+		ManifestName: parts[2],
+		Host:         parts[3],
+	}, true
+}
+
 func getWriteKey(repoName, manifestName, host string) string {
 	key := fmt.Sprintf("%s/%s/%s", repoName, manifestName, host)
 	return fmt.Sprintf("%s/%s", updateConditionStatusPrefix, key)
@@ -147,3 +620,47 @@ func getAgentInventoryReadKey(repoName, manifestName string) string {
 	key := fmt.Sprintf("%s/%s/*", repoName, manifestName)
 	return fmt.Sprintf("%s/%s", agentInventoryPrefix, key)
 }
+
+func getDeployHistoryKey(repoName, manifestName, host string) string {
+	key := fmt.Sprintf("%s/%s/%s", repoName, manifestName, host)
+	return fmt.Sprintf("%s/%s", deployHistoryPrefix, key)
+}
+
+func getDeployHistoryReadKey(repoName, manifestName string) string {
+	key := fmt.Sprintf("%s/%s/*", repoName, manifestName)
+	return fmt.Sprintf("%s/%s", deployHistoryPrefix, key)
+}
+
+func getDeployInProgressKey(repoName, manifestName, host string) string {
+	key := fmt.Sprintf("%s/%s/%s", repoName, manifestName, host)
+	return fmt.Sprintf("%s/%s", deployInProgressPrefix, key)
+}
+
+func getRolloutKey(repoName, manifestName string) string {
+	return fmt.Sprintf("%s/%s/%s", rolloutPrefix, repoName, manifestName)
+}
+
+func getRolloutLeaseKey(repoName, manifestName string) string {
+	return fmt.Sprintf("%s/%s/%s", rolloutLeasePrefix, repoName, manifestName)
+}
+
+func getDesiredArtifactKey(repoName, manifestName string) string {
+	return fmt.Sprintf("%s/%s/%s", desiredArtifactPrefix, repoName, manifestName)
+}
+
+func getRolledBackKey(repoName, manifestName, host string) string {
+	key := fmt.Sprintf("%s/%s/%s", repoName, manifestName, host)
+	return fmt.Sprintf("%s/%s", rolledBackPrefix, key)
+}
+
+func getNotificationKey(subject string) string {
+	return fmt.Sprintf("%s/%s", notificationPrefix, subject)
+}
+
+func getAgentLabelsKey(host string) string {
+	return fmt.Sprintf("%s/%s", agentLabelsPrefix, host)
+}
+
+func getAgentPlatformKey(host string) string {
+	return fmt.Sprintf("%s/%s", agentPlatformPrefix, host)
+}
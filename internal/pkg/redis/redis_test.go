@@ -1,11 +1,39 @@
 package redis
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
 	"github.com/stretchr/testify/assert"
 )
 
+func newTestRedis(t *testing.T) (Redis, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+	r, err := NewRedisClient("redis://" + m.Addr())
+	assert.NoError(t, err)
+	return r, m
+}
+
+func Test_NewRedisClient(t *testing.T) {
+	// plain redis:// URLs have no TLS config to change
+	r, err := NewRedisClient("redis://localhost:6379")
+	assert.NoError(t, err)
+	assert.Nil(t, r.client.Options().TLSConfig)
+
+	r, err = NewRedisClient("rediss://localhost:6379")
+	assert.NoError(t, err)
+	if assert.NotNil(t, r.client.Options().TLSConfig) {
+		assert.True(t, r.client.Options().TLSConfig.InsecureSkipVerify)
+	}
+
+	_, err = NewRedisClient("http://localhost:6379")
+	assert.Error(t, err)
+}
+
 func Test_Keys(t *testing.T) {
 	key := getAgentInventoryWriteKey("my-repo", "my-manifest", "host-1")
 	assert.Equal(t, "agent/inventory/my-repo/my-manifest/host-1", key)
@@ -18,4 +46,182 @@ func Test_Keys(t *testing.T) {
 
 	key = getAgentInventoryReadKey("my-repo", "my-manifest")
 	assert.Equal(t, "agent/inventory/my-repo/my-manifest/*", key)
+
+	key = getDeployHistoryKey("my-repo", "my-manifest", "host-1")
+	assert.Equal(t, "deploy/history/my-repo/my-manifest/host-1", key)
+
+	key = getDeployHistoryReadKey("my-repo", "my-manifest")
+	assert.Equal(t, "deploy/history/my-repo/my-manifest/*", key)
+
+	key = getDeployInProgressKey("my-repo", "my-manifest", "host-1")
+	assert.Equal(t, "deploy/inprogress/my-repo/my-manifest/host-1", key)
+
+	key = getRolloutKey("my-repo", "my-manifest")
+	assert.Equal(t, "rollout/my-repo/my-manifest", key)
+
+	key = getRolloutLeaseKey("my-repo", "my-manifest")
+	assert.Equal(t, "lease/rollout/my-repo/my-manifest", key)
+
+	key = getDesiredArtifactKey("my-repo", "my-manifest")
+	assert.Equal(t, "desired/my-repo/my-manifest", key)
+
+	key = getRolledBackKey("my-repo", "my-manifest", "host-1")
+	assert.Equal(t, "rolledback/my-repo/my-manifest/host-1", key)
+
+	key = getNotificationKey("my-repo/my-manifest/host-1")
+	assert.Equal(t, "notify/last/my-repo/my-manifest/host-1", key)
+
+	key = getAgentLabelsKey("host-1")
+	assert.Equal(t, "agent/labels/host-1", key)
+
+	key = getAgentPlatformKey("host-1")
+	assert.Equal(t, "agent/platform/host-1", key)
+}
+
+func Test_ToDeploymentRecord(t *testing.T) {
+	start := status.DeploymentRecord{
+		SHA:          "abc123",
+		ArtifactName: "app_abc123",
+		StartedAt:    100,
+		Status:       config.StatusInProgress,
+	}
+	uc := status.UpdateCondition{
+		RepoName:     "my-repo",
+		ManifestName: "my-manifest",
+		Host:         "host-1",
+		Status:       config.StatusErr,
+		Error:        "failed",
+		RolledBack:   true,
+		RunningSHA:   "def456",
+	}
+
+	record := toDeploymentRecord(start, uc, time.Unix(142, 0))
+	assert.Equal(t, status.DeploymentRecord{
+		RepoName:     "my-repo",
+		ManifestName: "my-manifest",
+		Host:         "host-1",
+		SHA:          "abc123",
+		ArtifactName: "app_abc123",
+		StartedAt:    100,
+		FinishedAt:   142,
+		DurationSec:  42,
+		Status:       config.StatusErr,
+		Error:        "failed",
+		RolledBack:   true,
+		RunningSHA:   "def456",
+	}, record)
+}
+
+func Test_ParseInventoryRecord(t *testing.T) {
+	record, err := parseInventoryRecord("1640995200")
+	assert.NoError(t, err)
+	assert.Equal(t, inventoryRecord{Timestamp: 1640995200}, record)
+
+	record, err = parseInventoryRecord(`{"timestamp":1640995200,"sha":"abc123","agentVersion":"v1.2.0"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, inventoryRecord{Timestamp: 1640995200, SHA: "abc123", AgentVersion: "v1.2.0"}, record)
+
+	_, err = parseInventoryRecord("not-a-record")
+	assert.Error(t, err)
+}
+
+func Test_ParseAgentInventoryKey(t *testing.T) {
+	p, ok := parseAgentInventoryKey(getAgentInventoryWriteKey("andrewmarklloyd/pi-test", "sample-app", "host-1"))
+	assert.True(t, ok)
+	assert.Equal(t, config.AgentInventoryPayload{
+		RepoName:     "andrewmarklloyd/pi-test",
+		ManifestName: "sample-app",
+		Host:         "host-1",
+	}, p)
+
+	_, ok = parseAgentInventoryKey("agent/inventory/my-repo/my-manifest/host-1")
+	assert.False(t, ok)
+}
+
+func Test_DeleteConditions(t *testing.T) {
+	r, _ := newTestRedis(t)
+	ctx := context.Background()
+	for _, uc := range []status.UpdateCondition{
+		{RepoName: "owner/repo", ManifestName: "app", Host: "host-1", Status: config.StatusSuccess},
+		{RepoName: "owner/repo", ManifestName: "app", Host: "host-2", Status: config.StatusErr},
+		{RepoName: "owner/repo", ManifestName: "other-app", Host: "host-1", Status: config.StatusSuccess},
+	} {
+		assert.NoError(t, r.WriteCondition(ctx, uc))
+	}
+
+	assert.NoError(t, r.DeleteConditions(ctx, "owner/repo", "app"))
+
+	conditions, err := r.ReadConditions(ctx, "owner/repo", "app")
+	assert.NoError(t, err)
+	assert.Empty(t, conditions)
+	conditions, err = r.ReadConditions(ctx, "owner/repo", "other-app")
+	assert.NoError(t, err)
+	assert.Len(t, conditions, 1)
+}
+
+func Test_HaltInterruptedRollouts(t *testing.T) {
+	r, _ := newTestRedis(t)
+	ctx := context.Background()
+	for _, rs := range []status.RolloutStatus{
+		{RepoName: "owner/repo", ManifestName: "leased", Status: config.StatusInProgress},
+		{RepoName: "owner/repo", ManifestName: "interrupted", Status: config.StatusInProgress},
+		{RepoName: "owner/repo", ManifestName: "finished", Status: config.StatusSuccess},
+	} {
+		assert.NoError(t, r.WriteRolloutStatus(ctx, rs))
+	}
+	assert.NoError(t, r.RenewRolloutLease(ctx, "owner/repo", "leased", "run-1", time.Minute))
+
+	halted, err := r.HaltInterruptedRollouts(ctx, "stopped")
+	assert.NoError(t, err)
+	assert.Len(t, halted, 1)
+	assert.Equal(t, "interrupted", halted[0].ManifestName)
+
+	expected := map[string]string{
+		"leased":      config.StatusInProgress,
+		"interrupted": config.StatusHalted,
+		"finished":    config.StatusSuccess,
+	}
+	for manifestName, s := range expected {
+		rs, err := r.ReadRolloutStatus(ctx, "owner/repo", manifestName)
+		assert.NoError(t, err)
+		assert.Equal(t, s, rs.Status, manifestName)
+	}
+
+	// a lease taken over by a newer rollout is kept
+	assert.NoError(t, r.ReleaseRolloutLease(ctx, "owner/repo", "leased", "run-0"))
+	halted, err = r.HaltInterruptedRollouts(ctx, "stopped")
+	assert.NoError(t, err)
+	assert.Empty(t, halted)
+
+	assert.NoError(t, r.ReleaseRolloutLease(ctx, "owner/repo", "leased", "run-1"))
+	halted, err = r.HaltInterruptedRollouts(ctx, "stopped")
+	assert.NoError(t, err)
+	assert.Len(t, halted, 1)
+}
+
+func Test_IsRepeatNotification(t *testing.T) {
+	r, m := newTestRedis(t)
+	ctx := context.Background()
+	subject := "owner/repo/app/host-1"
+
+	repeat, err := r.IsRepeatNotification(ctx, subject, "DEPLOY_SUCCESS/abc123/", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, repeat)
+	repeat, err = r.IsRepeatNotification(ctx, subject, "DEPLOY_SUCCESS/abc123/", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, repeat)
+
+	// repeats are sent again after the window
+	m.FastForward(2 * time.Hour)
+	repeat, err = r.IsRepeatNotification(ctx, subject, "DEPLOY_SUCCESS/abc123/", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, repeat)
+
+	// a transition is always sent
+	repeat, err = r.IsRepeatNotification(ctx, subject, "DEPLOY_FAILURE/def456/failed", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, repeat)
+	repeat, err = r.IsRepeatNotification(ctx, subject, "DEPLOY_SUCCESS/abc123/", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, repeat)
 }
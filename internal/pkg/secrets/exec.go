@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CacheDir returns the directory owned by the app user where
+// the last resolved secrets of an app installed in appDir are kept.
+func CacheDir(appDir, manifestName string) string {
+	return filepath.Join(appDir, ".cache", manifestName)
+}
+
+// ResolveWithCache resolves the given keys through the provider and
+// caches the values. When the provider can't be reached, for example
+// because the host is offline, the last cached values are returned.
+// A key missing from a reachable provider is always an error.
+func ResolveWithCache(p Provider, scope string, keys []string, cacheFile string) (map[string]string, bool, error) {
+	all, err := p.GetSecrets(scope)
+	if err == nil {
+		values, err := selectKeys(p, scope, all, keys)
+		if err != nil {
+			return nil, false, err
+		}
+		if cacheErr := writeCache(cacheFile, values); cacheErr != nil {
+			return values, false, fmt.Errorf("writing secrets cache: %s", cacheErr)
+		}
+		return values, false, nil
+	}
+
+	cached, cacheErr := readCache(cacheFile)
+	if cacheErr != nil {
+		return nil, false, fmt.Errorf("%s, no cached secrets available: %s", err, cacheErr)
+	}
+
+	for _, k := range keys {
+		if cached[k] == "" {
+			return nil, false, fmt.Errorf("%s, cached secrets are missing %s", err, k)
+		}
+	}
+	return cached, true, nil
+}
+
+// ExecEnv builds the environment of an app process from the
+// current environment, removing the provider configuration
+// and adding the resolved secrets.
+func ExecEnv(environ []string, values map[string]string) []string {
+	env := []string{}
+	for _, e := range environ {
+		name := strings.SplitN(e, "=", 2)[0]
+		if isProviderEnvVar(name) {
+			continue
+		}
+		if _, ok := values[name]; ok {
+			continue
+		}
+		env = append(env, e)
+	}
+	for k, v := range values {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return env
+}
+
+func isProviderEnvVar(name string) bool {
+	for _, n := range EnvVarNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func readCache(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	err = json.Unmarshal(b, &values)
+	return values, err
+}
+
+func writeCache(path string, values map[string]string) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp", path)
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
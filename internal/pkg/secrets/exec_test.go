@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProvider struct {
+	values map[string]string
+	err    error
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) GetSecrets(scope string) (map[string]string, error) {
+	return p.values, p.err
+}
+
+func (p *fakeProvider) Env() map[string]string {
+	return map[string]string{}
+}
+
+func Test_ResolveWithCache(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "secrets.json")
+	p := &fakeProvider{values: map[string]string{"LOG_LEVEL": "info", "OTHER": "unused"}}
+
+	_, _, err := ResolveWithCache(&fakeProvider{err: fmt.Errorf("offline")}, "my-app", []string{"LOG_LEVEL"}, cacheFile)
+	assert.Error(t, err)
+
+	values, cached, err := ResolveWithCache(p, "my-app", []string{"LOG_LEVEL"}, cacheFile)
+	assert.NoError(t, err)
+	assert.False(t, cached)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info"}, values)
+
+	values, cached, err = ResolveWithCache(&fakeProvider{err: fmt.Errorf("offline")}, "my-app", []string{"LOG_LEVEL"}, cacheFile)
+	assert.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info"}, values)
+
+	_, _, err = ResolveWithCache(&fakeProvider{err: fmt.Errorf("offline")}, "my-app", []string{"LOG_LEVEL", "PORT"}, cacheFile)
+	assert.EqualError(t, err, "offline, cached secrets are missing PORT")
+
+	// a key missing from a reachable provider is not replaced with cached values
+	_, _, err = ResolveWithCache(&fakeProvider{values: map[string]string{}}, "my-app", []string{"LOG_LEVEL"}, cacheFile)
+	assert.EqualError(t, err, "LOG_LEVEL not found in fake secrets for my-app")
+}
+
+func Test_ExecEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"HEROKU_API_KEY=secret",
+		"VAULT_TOKEN=secret",
+		"APP_VERSION=abc123",
+		"LOG_LEVEL=stale",
+	}
+	env := ExecEnv(environ, map[string]string{"LOG_LEVEL": "info"})
+	sort.Strings(env)
+	assert.Equal(t, []string{"APP_VERSION=abc123", "LOG_LEVEL=info", "PATH=/usr/bin"}, env)
+}
@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+)
+
+var DefaultSecretsFile = fmt.Sprintf("%s/.secrets.enc", config.PiAppDeployerDir)
+
+// FileProvider resolves secrets from a local file encrypted with
+// AES-256-GCM. The file holds the secrets of every scope.
+type FileProvider struct {
+	path string
+	key  []byte
+}
+
+// NewFileProvider creates a provider reading the file at path,
+// key is the base64 encoded 32 byte encryption key.
+func NewFileProvider(path, key string) (*FileProvider, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("decoding secrets key: %s", err)
+	}
+	if len(k) != 32 {
+		return nil, fmt.Errorf("secrets key must be 32 bytes, got %d", len(k))
+	}
+	return &FileProvider{
+		path: path,
+		key:  k,
+	}, nil
+}
+
+func (p *FileProvider) Name() string {
+	return ProviderFile
+}
+
+func (p *FileProvider) GetSecrets(scope string) (map[string]string, error) {
+	all, err := p.readAll()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := all[scope]
+	if !ok {
+		return nil, fmt.Errorf("no secrets found for %s in %s", scope, p.path)
+	}
+	return s, nil
+}
+
+func (p *FileProvider) Env() map[string]string {
+	return map[string]string{
+		ProviderEnvVar: ProviderFile,
+		"SECRETS_FILE": p.path,
+		"SECRETS_KEY":  base64.StdEncoding.EncodeToString(p.key),
+	}
+}
+
+// SetSecrets adds secrets to a scope, overwriting the
+// value of secrets that already exist.
+func (p *FileProvider) SetSecrets(scope string, secrets map[string]string) error {
+	all, err := p.readAll()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if all == nil {
+		all = map[string]map[string]string{}
+	}
+	if all[scope] == nil {
+		all[scope] = map[string]string{}
+	}
+	for k, v := range secrets {
+		all[scope][k] = v
+	}
+	return p.writeAll(all)
+}
+
+func (p *FileProvider) readAll() (map[string]map[string]string, error) {
+	b, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("decoding secrets file: %s", err)
+	}
+
+	gcm, err := p.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("secrets file is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting secrets file: %s", err)
+	}
+
+	var all map[string]map[string]string
+	err = json.Unmarshal(plaintext, &all)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling secrets file: %s", err)
+	}
+	return all, nil
+}
+
+func (p *FileProvider) writeAll(all map[string]map[string]string) error {
+	plaintext, err := json.Marshal(all)
+	if err != nil {
+		return fmt.Errorf("marshalling secrets: %s", err)
+	}
+
+	gcm, err := p.gcm()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("generating nonce: %s", err)
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	// apps resolve their secrets as the app user, the
+	// contents are only readable with the key
+	err = os.WriteFile(p.path, []byte(base64.StdEncoding.EncodeToString(ciphertext)), 0644)
+	if err != nil {
+		return fmt.Errorf("writing secrets file: %s", err)
+	}
+	return nil
+}
+
+func (p *FileProvider) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(p.key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,31 @@
+package secrets
+
+import (
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/heroku"
+)
+
+// HerokuProvider resolves secrets from the config
+// vars of the Heroku app named by the scope.
+type HerokuProvider struct {
+	client heroku.HerokuClient
+}
+
+func NewHerokuProvider(apiKey string) *HerokuProvider {
+	return &HerokuProvider{
+		client: heroku.NewHerokuClient(apiKey),
+	}
+}
+
+func (p *HerokuProvider) Name() string {
+	return ProviderHeroku
+}
+
+func (p *HerokuProvider) GetSecrets(scope string) (map[string]string, error) {
+	return p.client.GetEnvVars(scope)
+}
+
+func (p *HerokuProvider) Env() map[string]string {
+	return map[string]string{
+		"HEROKU_API_KEY": p.client.APIKey,
+	}
+}
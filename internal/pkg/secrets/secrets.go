@@ -0,0 +1,91 @@
+package secrets
+
+import (
+	"fmt"
+)
+
+const (
+	ProviderHeroku = "heroku"
+	ProviderFile   = "file"
+	ProviderVault  = "vault"
+
+	// ProviderEnvVar selects the provider, Heroku is
+	// used when it is not set
+	ProviderEnvVar = "SECRET_PROVIDER"
+)
+
+// EnvVarNames are all environment variables used to configure
+// a provider. They are removed before an app is started.
+var EnvVarNames = []string{
+	ProviderEnvVar,
+	"HEROKU_API_KEY",
+	"SECRETS_FILE",
+	"SECRETS_KEY",
+	"VAULT_ADDR",
+	"VAULT_TOKEN",
+	"VAULT_MOUNT",
+}
+
+// Provider resolves the secrets of a scope, such as the Heroku
+// app of a manifest or the bootstrap credentials of the agent.
+type Provider interface {
+	Name() string
+	GetSecrets(scope string) (map[string]string, error)
+	// Env returns the environment variables needed to
+	// create the provider again with NewProviderFromEnv.
+	Env() map[string]string
+}
+
+// NewProviderFromEnv creates the provider configured
+// through environment variables.
+func NewProviderFromEnv(getenv func(string) string) (Provider, error) {
+	switch getenv(ProviderEnvVar) {
+	case "", ProviderHeroku:
+		apiKey := getenv("HEROKU_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("HEROKU_API_KEY environment variable is required")
+		}
+		return NewHerokuProvider(apiKey), nil
+	case ProviderFile:
+		key := getenv("SECRETS_KEY")
+		if key == "" {
+			return nil, fmt.Errorf("SECRETS_KEY environment variable is required")
+		}
+		path := getenv("SECRETS_FILE")
+		if path == "" {
+			path = DefaultSecretsFile
+		}
+		return NewFileProvider(path, key)
+	case ProviderVault:
+		addr := getenv("VAULT_ADDR")
+		token := getenv("VAULT_TOKEN")
+		if addr == "" || token == "" {
+			return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN environment variables are required")
+		}
+		return NewVaultProvider(addr, token, getenv("VAULT_MOUNT")), nil
+	default:
+		return nil, fmt.Errorf("%s must be one of: %s, %s, or %s, but was %s", ProviderEnvVar, ProviderHeroku, ProviderFile, ProviderVault, getenv(ProviderEnvVar))
+	}
+}
+
+// GetRequired resolves the secrets of a scope and returns
+// only the given keys, failing if any of them is missing.
+func GetRequired(p Provider, scope string, keys []string) (map[string]string, error) {
+	all, err := p.GetSecrets(scope)
+	if err != nil {
+		return nil, err
+	}
+	return selectKeys(p, scope, all, keys)
+}
+
+func selectKeys(p Provider, scope string, all map[string]string, keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v, ok := all[k]
+		if !ok || v == "" {
+			return nil, fmt.Errorf("%s not found in %s secrets for %s", k, p.Name(), scope)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,121 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func envFunc(env map[string]string) func(string) string {
+	return func(k string) string {
+		return env[k]
+	}
+}
+
+func Test_NewProviderFromEnv(t *testing.T) {
+	p, err := NewProviderFromEnv(envFunc(map[string]string{"HEROKU_API_KEY": "abc"}))
+	assert.NoError(t, err)
+	assert.Equal(t, ProviderHeroku, p.Name())
+	assert.Equal(t, map[string]string{"HEROKU_API_KEY": "abc"}, p.Env())
+
+	_, err = NewProviderFromEnv(envFunc(map[string]string{}))
+	assert.EqualError(t, err, "HEROKU_API_KEY environment variable is required")
+
+	env := map[string]string{
+		ProviderEnvVar: ProviderVault,
+		"VAULT_ADDR":   "https://vault.local/",
+		"VAULT_TOKEN":  "token",
+	}
+	p, err = NewProviderFromEnv(envFunc(env))
+	assert.NoError(t, err)
+	assert.Equal(t, ProviderVault, p.Name())
+	assert.Equal(t, map[string]string{
+		ProviderEnvVar: ProviderVault,
+		"VAULT_ADDR":   "https://vault.local",
+		"VAULT_TOKEN":  "token",
+		"VAULT_MOUNT":  "secret",
+	}, p.Env())
+
+	// recreating a provider from its own env is the same provider
+	p2, err := NewProviderFromEnv(envFunc(p.Env()))
+	assert.NoError(t, err)
+	assert.Equal(t, p, p2)
+
+	_, err = NewProviderFromEnv(envFunc(map[string]string{ProviderEnvVar: "aws"}))
+	assert.EqualError(t, err, "SECRET_PROVIDER must be one of: heroku, file, or vault, but was aws")
+}
+
+func Test_FileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	p, err := NewFileProvider(path, testKey)
+	assert.NoError(t, err)
+
+	_, err = p.GetSecrets("my-app")
+	assert.Error(t, err)
+
+	err = p.SetSecrets("my-app", map[string]string{"LOG_LEVEL": "info", "CLOUDMQTT_URL": "mqtt://localhost"})
+	assert.NoError(t, err)
+	err = p.SetSecrets("my-app", map[string]string{"LOG_LEVEL": "debug"})
+	assert.NoError(t, err)
+	err = p.SetSecrets("other-app", map[string]string{"LOG_LEVEL": "warn"})
+	assert.NoError(t, err)
+
+	s, err := p.GetSecrets("my-app")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "debug", "CLOUDMQTT_URL": "mqtt://localhost"}, s)
+
+	_, err = p.GetSecrets("missing-app")
+	assert.EqualError(t, err, fmt.Sprintf("no secrets found for missing-app in %s", path))
+
+	wrongKey := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	wrong, err := NewFileProvider(path, wrongKey)
+	assert.NoError(t, err)
+	_, err = wrong.GetSecrets("my-app")
+	assert.EqualError(t, err, "decrypting secrets file: cipher: message authentication failed")
+
+	_, err = NewFileProvider(path, base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.EqualError(t, err, "secrets key must be 32 bytes, got 5")
+}
+
+func Test_VaultProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/my-app" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"data":{"LOG_LEVEL":"info","PORT":8080},"metadata":{"version":1}}}`)
+	}))
+	defer server.Close()
+
+	p := NewVaultProvider(server.URL, "token", "kv")
+	s, err := p.GetSecrets("my-app")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info", "PORT": "8080"}, s)
+
+	_, err = p.GetSecrets("missing-app")
+	assert.EqualError(t, err, `response from vault, received status code: 404, response: {"errors":[]}`)
+
+	values, err := GetRequired(p, "my-app", []string{"LOG_LEVEL"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"LOG_LEVEL": "info"}, values)
+
+	_, err = GetRequired(p, "my-app", []string{"LOG_LEVEL", "CLOUDMQTT_URL"})
+	assert.EqualError(t, err, "CLOUDMQTT_URL not found in vault secrets for my-app")
+
+	p = NewVaultProvider(server.URL, "wrong", "kv")
+	_, err = p.GetSecrets("my-app")
+	assert.EqualError(t, err, `response from vault, received status code: 403, response: {"errors":["permission denied"]}`)
+}
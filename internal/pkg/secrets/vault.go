@@ -0,0 +1,91 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const defaultVaultMount = "secret"
+
+// VaultProvider resolves secrets from a Vault KV version 2
+// secrets engine, or any HTTP service with the same API.
+// The scope is the path of the secret within the mount.
+type VaultProvider struct {
+	addr  string
+	token string
+	mount string
+}
+
+func NewVaultProvider(addr, token, mount string) *VaultProvider {
+	if mount == "" {
+		mount = defaultVaultMount
+	}
+	return &VaultProvider{
+		addr:  strings.TrimSuffix(addr, "/"),
+		token: token,
+		mount: strings.Trim(mount, "/"),
+	}
+}
+
+func (p *VaultProvider) Name() string {
+	return ProviderVault
+}
+
+type vaultResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+func (p *VaultProvider) GetSecrets(scope string) (map[string]string, error) {
+	url := fmt.Sprintf("%s/v1/%s/data/%s", p.addr, p.mount, strings.Trim(scope, "/"))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing request to vault: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body from vault: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response from vault, received status code: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	var v vaultResponse
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling response body from vault: %s", err)
+	}
+
+	secrets := make(map[string]string, len(v.Data.Data))
+	for k, val := range v.Data.Data {
+		if s, ok := val.(string); ok {
+			secrets[k] = s
+			continue
+		}
+		secrets[k] = fmt.Sprint(val)
+	}
+	return secrets, nil
+}
+
+func (p *VaultProvider) Env() map[string]string {
+	return map[string]string{
+		ProviderEnvVar: ProviderVault,
+		"VAULT_ADDR":   p.addr,
+		"VAULT_TOKEN":  p.token,
+		"VAULT_MOUNT":  p.mount,
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	gmux "github.com/gorilla/mux"
+)
+
+func handleAgents(w http.ResponseWriter, r *http.Request) {
+	agents, err := listAgents(r.Context(), "")
+	if err != nil {
+		logger.Errorf("listing agents: %s", err)
+		handleError(w, "Error listing agents", http.StatusInternalServerError)
+		return
+	}
+
+	agentsJson, err := json.Marshal(agents)
+	if err != nil {
+		logger.Errorf("marshalling agents: %s", err)
+		handleError(w, "Error marshalling agents", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, `{"request":"success","agents":%s}`, agentsJson)
+}
+
+func handleAgent(w http.ResponseWriter, r *http.Request) {
+	host := gmux.Vars(r)["host"]
+	agents, err := listAgents(r.Context(), host)
+	if err != nil {
+		logger.Errorf("listing agents: %s", err)
+		handleError(w, "Error listing agents", http.StatusInternalServerError)
+		return
+	}
+	if len(agents) == 0 {
+		handleError(w, fmt.Sprintf("Could not find agent for host: %s", host), http.StatusNotFound)
+		return
+	}
+
+	agentJson, err := json.Marshal(agents[0])
+	if err != nil {
+		logger.Errorf("marshalling agent: %s", err)
+		handleError(w, "Error marshalling agent", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, `{"request":"success","agent":%s}`, agentJson)
+}
+
+// listAgents builds the agents from their inventory sorted by
+// host. All hosts are returned when host is empty.
+func listAgents(ctx context.Context, host string) ([]status.Agent, error) {
+	inventory, err := redisClient.ReadAllAgentInventory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading agent inventory: %s", err)
+	}
+
+	byHost := map[string]*status.Agent{}
+	for _, p := range inventory {
+		if host != "" && p.Host != host {
+			continue
+		}
+		a, ok := byHost[p.Host]
+		if !ok {
+			a = &status.Agent{Host: p.Host, Apps: []status.AgentApp{}}
+			byHost[p.Host] = a
+		}
+		if p.Timestamp > a.LastSeen {
+			a.LastSeen = p.Timestamp
+			a.AgentVersion = p.AgentVersion
+		}
+
+		app := status.AgentApp{
+			RepoName:     p.RepoName,
+			ManifestName: p.ManifestName,
+			SHA:          p.SHA,
+			LastSeen:     p.Timestamp,
+			Status:       config.StatusUnknown,
+		}
+		uc, ok, err := redisClient.ReadCondition(ctx, p.RepoName, p.ManifestName, p.Host)
+		if err != nil {
+			return nil, fmt.Errorf("reading update condition: %s", err)
+		}
+		if ok {
+			app.Status = uc.Status
+			app.Error = uc.Error
+		}
+		a.Apps = append(a.Apps, app)
+	}
+
+	agents := []status.Agent{}
+	for h, a := range byHost {
+		a.Stale = time.Since(time.Unix(a.LastSeen, 0)) > config.InventoryTickerTimeout
+
+		a.Labels, err = redisClient.ReadAgentLabels(ctx, h)
+		if err != nil {
+			return nil, fmt.Errorf("reading agent labels: %s", err)
+		}
+		a.Platform, err = redisClient.ReadAgentPlatform(ctx, h)
+		if err != nil {
+			return nil, fmt.Errorf("reading agent platform: %s", err)
+		}
+
+		sort.Slice(a.Apps, func(i, j int) bool {
+			if a.Apps[i].RepoName != a.Apps[j].RepoName {
+				return a.Apps[i].RepoName < a.Apps[j].RepoName
+			}
+			return a.Apps[i].ManifestName < a.Apps[j].ManifestName
+		})
+		agents = append(agents, *a)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Host < agents[j].Host
+	})
+	return agents, nil
+}
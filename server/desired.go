@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+)
+
+// writeDesiredArtifact records the artifact agents reconcile to
+// when they missed a push.
+func writeDesiredArtifact(ctx context.Context, a config.Artifact) {
+	a.CommandID = ""
+	a.Rollout = nil
+	err := redisClient.WriteDesiredArtifact(ctx, a)
+	if err != nil {
+		logger.Errorf("writing desired artifact to redis: %s", err)
+	}
+}
+
+// recordRollback stops a host from updating back to the
+// artifact it was rolled back from. An update that failed and
+// was rolled back reports the SHA it failed to update to, a
+// requested rollback the SHA it rolled back to.
+func recordRollback(ctx context.Context, c status.UpdateCondition) {
+	sha := c.SHA
+	if sha == c.RunningSHA {
+		a, ok, err := redisClient.ReadDesiredArtifact(ctx, c.RepoName, c.ManifestName)
+		if err != nil {
+			logger.Errorf("reading desired artifact from redis: %s", err)
+			return
+		}
+		if !ok || a.SHA == c.RunningSHA {
+			return
+		}
+		sha = a.SHA
+	}
+	err := redisClient.WriteRolledBackSHA(ctx, c.RepoName, c.ManifestName, c.Host, sha)
+	if err != nil {
+		logger.Errorf("writing rolled back SHA to redis: %s", err)
+	}
+}
+
+// handleDesiredStateRequest answers an agent with the artifacts
+// last pushed for its apps.
+func handleDesiredStateRequest(message string) {
+	var req config.DesiredStateRequest
+	err := json.Unmarshal([]byte(message), &req)
+	if err != nil {
+		logger.Errorf("unmarshalling desired state request: %s", err)
+		return
+	}
+
+	p := config.DesiredStatePayload{
+		Host:        req.Host,
+		RequestedAt: req.RequestedAt,
+		Artifacts:   []config.Artifact{},
+	}
+	for _, app := range req.Apps {
+		a, ok, err := redisClient.ReadDesiredArtifact(context.Background(), app.RepoName, app.ManifestName)
+		if err != nil {
+			logger.Errorf("reading desired artifact from redis: %s", err)
+			return
+		}
+		if !ok {
+			continue
+		}
+		// a host rolled back from the artifact keeps its
+		// version until the app is pushed again
+		rolledBack, err := redisClient.ReadRolledBackSHA(context.Background(), app.RepoName, app.ManifestName, req.Host)
+		if err != nil {
+			logger.Errorf("reading rolled back SHA from redis: %s", err)
+			return
+		}
+		if rolledBack != a.SHA {
+			p.Artifacts = append(p.Artifacts, a)
+		}
+	}
+	if len(p.Artifacts) == 0 {
+		return
+	}
+
+	j, err := json.Marshal(p)
+	if err != nil {
+		logger.Errorf("marshalling desired state: %s", err)
+		return
+	}
+	err = messageClient.Publish(config.DesiredStateTopic(req.Host), string(j))
+	if err != nil {
+		logger.Errorf("publishing desired state: %s", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/mqtt"
+)
+
+const (
+	testHost         = "pi-1"
+	testRepoName     = "andrewmarklloyd/pi-test"
+	testManifestName = "pi-test"
+)
+
+// install installs the test app on testHost through the
+// server and waits for the agent to report it.
+func (h *harness) install() {
+	h.t.Helper()
+	code, body := h.do(http.MethodPost, "/install", config.AppCommandPayload{
+		RepoName:     testRepoName,
+		ManifestName: testManifestName,
+		AppUser:      h.appUser,
+		Target:       config.Target{Hosts: []string{testHost}},
+	})
+	assert.Equal(h.t, http.StatusOK, code, body)
+
+	h.waitFor("the app to be installed", func() bool {
+		app, ok := h.app(testHost, testRepoName, testManifestName)
+		return ok && app.Status == config.StatusSuccess
+	})
+}
+
+// push publishes an artifact built from a commit and sends
+// the push to the server, like the workflow of an app.
+func (h *harness) push(sha string) {
+	h.t.Helper()
+	name := h.github.publish(h.t, testRepoName, testManifestName, sha)
+	code, body := h.do(http.MethodPost, "/push", config.Artifact{
+		RepoName:     testRepoName,
+		ManifestName: testManifestName,
+		SHA:          sha,
+		Name:         name,
+	})
+	assert.Equal(h.t, http.StatusOK, code, body)
+}
+
+func TestInstallPushStatus(t *testing.T) {
+	h := newHarness(t)
+	h.github.publish(t, testRepoName, testManifestName, "aaaaaaa")
+	h.startAgent(testHost)
+
+	h.install()
+	assert.True(t, h.systemd.isActive(testManifestName))
+	assert.Contains(t, h.readHostFile("/etc/systemd/system/pi-test.service"), "pi-app-deployer-agent exec --manifestName pi-test")
+	assert.Contains(t, h.readHostFile(config.DeployerConfigFile), "repoName: andrewmarklloyd/pi-test")
+
+	h.push("bbbbbbb")
+	h.waitFor("the push to be deployed", func() bool {
+		successful, _ := h.deployStatus(testRepoName, testManifestName)
+		return successful[testHost].RunningSHA == "bbbbbbb"
+	})
+
+	successful, unsuccessful := h.deployStatus(testRepoName, testManifestName)
+	assert.Equal(t, config.StatusSuccess, successful[testHost].Status)
+	assert.Empty(t, unsuccessful)
+	assert.Contains(t, h.readHostFile("/usr/local/src/pi-app-deployer/.pi-test.env"), "APP_VERSION=bbbbbbb")
+	assert.Equal(t, "#!/bin/sh\necho bbbbbbb\n", h.readHostFile("/usr/local/src/pi-app-deployer/pi-test"))
+	assert.True(t, h.systemd.isActive(testManifestName))
+}
+
+func TestPushFailingHealthCheckRollsBack(t *testing.T) {
+	h := newHarness(t)
+	h.github.publish(t, testRepoName, testManifestName, "aaaaaaa")
+	h.startAgent(testHost)
+	h.install()
+	installed, _ := h.app(testHost, testRepoName, testManifestName)
+
+	h.systemd.fail(testManifestName)
+	h.push("bbbbbbb")
+	h.waitFor("the push to fail", func() bool {
+		_, unsuccessful := h.deployStatus(testRepoName, testManifestName)
+		return unsuccessful[testHost].Status == config.StatusHealthCheckFailed
+	})
+
+	_, unsuccessful := h.deployStatus(testRepoName, testManifestName)
+	c := unsuccessful[testHost]
+	assert.True(t, c.RolledBack)
+	assert.Equal(t, installed.SHA, c.RunningSHA)
+	assert.Contains(t, h.readHostFile("/usr/local/src/pi-app-deployer/.pi-test.env"), fmt.Sprintf("APP_VERSION=%s", installed.SHA))
+}
+
+func TestAgentCatchesUpOnMissedPush(t *testing.T) {
+	h := newHarness(t)
+	h.github.publish(t, testRepoName, testManifestName, "aaaaaaa")
+	stop := h.startAgent(testHost)
+	h.install()
+
+	// the local broker does not keep the push for the stopped agent,
+	// it asks the server for the last push once it is started again
+	stop()
+	h.push("bbbbbbb")
+	h.startAgent(testHost)
+
+	h.waitFor("the agent to update to the missed push", func() bool {
+		successful, _ := h.deployStatus(testRepoName, testManifestName)
+		return successful[testHost].RunningSHA == "bbbbbbb"
+	})
+	assert.Equal(t, "#!/bin/sh\necho bbbbbbb\n", h.readHostFile("/usr/local/src/pi-app-deployer/pi-test"))
+}
+
+func TestAgentKeepsRolledBackVersion(t *testing.T) {
+	h := newHarness(t)
+	h.github.publish(t, testRepoName, testManifestName, "aaaaaaa")
+	stop := h.startAgent(testHost)
+	h.install()
+	installed, _ := h.app(testHost, testRepoName, testManifestName)
+	h.push("bbbbbbb")
+	h.waitFor("the push to be deployed", func() bool {
+		successful, _ := h.deployStatus(testRepoName, testManifestName)
+		return successful[testHost].RunningSHA == "bbbbbbb"
+	})
+
+	code, body := h.do(http.MethodPost, "/rollback", config.RollbackPayload{
+		RepoName:     testRepoName,
+		ManifestName: testManifestName,
+	})
+	assert.Equal(t, http.StatusOK, code, body)
+	h.waitFor("the rollback", func() bool {
+		successful, _ := h.deployStatus(testRepoName, testManifestName)
+		return successful[testHost].RolledBack && successful[testHost].RunningSHA == installed.SHA
+	})
+
+	// the restarted agent does not update back to the
+	// artifact it was rolled back from, only to a new push
+	stop()
+	h.startAgent(testHost)
+	h.push("ccccccc")
+	h.waitFor("the next push to be deployed", func() bool {
+		successful, _ := h.deployStatus(testRepoName, testManifestName)
+		return successful[testHost].RunningSHA == "ccccccc"
+	})
+
+	history, err := redisClient.ReadDeploymentHistory(context.Background(), testRepoName, testManifestName, testHost)
+	assert.NoError(t, err)
+	records := history[testHost]
+	if assert.True(t, len(records) >= 2) {
+		assert.Equal(t, "ccccccc", records[0].SHA)
+		assert.True(t, records[1].RolledBack)
+	}
+}
+
+func TestAgentDoesNotRetryRolledBackVersion(t *testing.T) {
+	h := newHarness(t)
+	h.github.publish(t, testRepoName, testManifestName, "aaaaaaa")
+	stop := h.startAgent(testHost)
+	h.install()
+
+	h.systemd.fail(testManifestName)
+	h.push("bbbbbbb")
+	h.waitFor("the push to be rolled back", func() bool {
+		_, unsuccessful := h.deployStatus(testRepoName, testManifestName)
+		return unsuccessful[testHost].RolledBack
+	})
+
+	// the restarted agent asks the server for the last push, which
+	// must not send it the artifact the agent was rolled back from
+	stop()
+	h.startAgent(testHost)
+	time.Sleep(time.Second)
+	h.push("ccccccc")
+	h.waitFor("the next push to be tried", func() bool {
+		_, unsuccessful := h.deployStatus(testRepoName, testManifestName)
+		return unsuccessful[testHost].SHA == "ccccccc"
+	})
+
+	history, err := redisClient.ReadDeploymentHistory(context.Background(), testRepoName, testManifestName, testHost)
+	assert.NoError(t, err)
+	tried := 0
+	for _, r := range history[testHost] {
+		if r.SHA == "bbbbbbb" {
+			tried++
+		}
+	}
+	assert.Equal(t, 1, tried)
+}
+
+func TestRollbackOnlyRollsBackTargetedHosts(t *testing.T) {
+	h := newHarness(t)
+	h.github.publish(t, testRepoName, testManifestName, "aaaaaaa")
+	h.startAgent(testHost)
+	h.install()
+	h.push("bbbbbbb")
+	h.waitFor("the push to be deployed", func() bool {
+		successful, _ := h.deployStatus(testRepoName, testManifestName)
+		return successful[testHost].RunningSHA == "bbbbbbb"
+	})
+
+	code, body := h.do(http.MethodPost, "/rollback", config.RollbackPayload{
+		RepoName:     testRepoName,
+		ManifestName: testManifestName,
+		Target:       config.Target{Hosts: []string{"pi-2"}},
+	})
+	assert.Equal(t, http.StatusOK, code, body)
+	h.push("ccccccc")
+	h.waitFor("the next push to be deployed", func() bool {
+		successful, _ := h.deployStatus(testRepoName, testManifestName)
+		return successful[testHost].RunningSHA == "ccccccc"
+	})
+
+	history, err := redisClient.ReadDeploymentHistory(context.Background(), testRepoName, testManifestName, testHost)
+	assert.NoError(t, err)
+	for _, r := range history[testHost] {
+		assert.False(t, r.RolledBack, r.SHA)
+	}
+}
+
+func TestCommandsFailWhileDisconnected(t *testing.T) {
+	h := newHarness(t)
+	// the server is not connected to a broker
+	messageClient = mqtt.NewMQTTClient("tcp://127.0.0.1:1", mqtt.Options{Unbuffered: true}, nil, nil)
+
+	code, body := h.do(http.MethodPost, "/rollback", config.RollbackPayload{
+		RepoName:     testRepoName,
+		ManifestName: testManifestName,
+	})
+	assert.Equal(t, http.StatusServiceUnavailable, code, body)
+}
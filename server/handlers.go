@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +10,8 @@ import (
 
 	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/mqtt"
+	"github.com/google/uuid"
 )
 
 func handleRepoPush(w http.ResponseWriter, r *http.Request) {
@@ -35,8 +38,14 @@ func handleRepoPush(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// release tags are tracked as the SHA of the deployment
+	if a.SHA == "" {
+		a.SHA = a.Version
+	}
+
 	logger.Infof("Received new artifact published event for repository %s, manifest %s, SHA %s", a.RepoName, a.ManifestName, a.SHA)
 
+	a.CommandID = uuid.New().String()
 	j, err := json.Marshal(a)
 	if err != nil {
 		logger.Errorf("marshalling artifact: %s", err)
@@ -51,16 +60,81 @@ func handleRepoPush(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if a.Rollout != nil {
+		hosts, err := rolloutHosts(r.Context(), a, time.Now())
+		if err != nil {
+			logger.Errorf("listing rollout hosts: %s", err)
+			handleError(w, "error listing agents configured to update app", http.StatusInternalServerError)
+			return
+		}
+
+		rs, err := rollouts.start(a, hosts)
+		if err != nil {
+			logger.Errorf("starting rollout: %s", err)
+			handleError(w, fmt.Sprintf("error starting rollout: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		rolloutJson, err := json.Marshal(rs)
+		if err != nil {
+			logger.Errorf("marshalling rollout status: %s", err)
+			handleError(w, "error occurred marshalling json", http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintf(w, `{"request":"success","rollout":%s}`, rolloutJson)
+		return
+	}
+
+	// a push without a rollout replaces any running rollout
+	rollouts.cancel(a)
+
 	err = messageClient.Publish(config.RepoPushTopic, string(j))
 	if err != nil {
 		logger.Errorf("publishing to repo push topic: %s", err)
-		handleError(w, "Error publishing event", http.StatusInternalServerError)
+		handleError(w, "Error publishing event", publishErrorStatus(err))
 		return
 	}
+	writeDesiredArtifact(r.Context(), a)
 
 	fmt.Fprintf(w, `{"request":"success"}`)
 }
 
+func handleRolloutStatus(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := config.DeployStatusPayload{
+		RepoName:     q.Get("repoName"),
+		ManifestName: q.Get("manifestName"),
+	}
+
+	if err := p.Validate(); err != nil {
+		errs := fmt.Sprintf("error validating query parameters: %s", err.Error())
+		logger.Error(errs)
+		handleError(w, errs, http.StatusBadRequest)
+		return
+	}
+
+	rs, err := redisClient.ReadRolloutStatus(r.Context(), p.RepoName, p.ManifestName)
+	if err != nil {
+		logger.Errorf("getting rollout status from redis: %s. RepoName: %s, ManifestName: %s", err, p.RepoName, p.ManifestName)
+		if err.Error() == "redis: nil" {
+			handleError(w, fmt.Sprintf("Could not find rollout for RepoName: %s, ManifestName: %s", p.RepoName, p.ManifestName), http.StatusBadRequest)
+			return
+		}
+		handleError(w, "Error getting rollout status", http.StatusBadRequest)
+		return
+	}
+
+	rolloutJson, err := json.Marshal(rs)
+	if err != nil {
+		logger.Errorf("marshalling rollout status: %s", err)
+		handleError(w, "Error marshalling rollout status", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, `{"request":"success","rollout":%s}`, rolloutJson)
+}
+
 func handleDeployStatus(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -159,6 +233,38 @@ func handleDeployStatus(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, fmt.Sprintf(`{"request":"success","successfulHosts":%s,"unsuccessfulHosts":%s}`, successJson, unsuccessJson))
 }
 
+func handleDeployHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := config.DeployHistoryPayload{
+		RepoName:     q.Get("repoName"),
+		ManifestName: q.Get("manifestName"),
+		Host:         q.Get("host"),
+	}
+
+	if err := p.Validate(); err != nil {
+		errs := fmt.Sprintf("error validating query parameters: %s", err.Error())
+		logger.Error(errs)
+		handleError(w, errs, http.StatusBadRequest)
+		return
+	}
+
+	history, err := redisClient.ReadDeploymentHistory(r.Context(), p.RepoName, p.ManifestName, p.Host)
+	if err != nil {
+		logger.Errorf("reading deployment history from redis: %s. RepoName: %s, ManifestName: %s, Host: %s", err, p.RepoName, p.ManifestName, p.Host)
+		handleError(w, "Error getting deployment history", http.StatusInternalServerError)
+		return
+	}
+
+	historyJson, err := json.Marshal(history)
+	if err != nil {
+		logger.Errorf("marshalling deployment history: %s", err)
+		handleError(w, "Error marshalling deployment history", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, `{"request":"success","history":%s}`, historyJson)
+}
+
 func handleServicePost(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -182,6 +288,7 @@ func handleServicePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	payload.CommandID = uuid.New().String()
 	json, err := json.Marshal(payload)
 	if err != nil {
 		logger.Errorf("marshalling payload: %s", err)
@@ -192,16 +299,174 @@ func handleServicePost(w http.ResponseWriter, r *http.Request) {
 	err = messageClient.Publish(config.ServiceActionTopic, string(json))
 	if err != nil {
 		logger.Errorf("publishing to service action topic: %s", err)
-		handleError(w, "Error publishing event", http.StatusInternalServerError)
+		handleError(w, "Error publishing event", publishErrorStatus(err))
 		return
 	}
 	fmt.Fprintf(w, fmt.Sprintf(`{"request":"success"}`))
 }
 
+func handleRollback(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("reading request body: %s", err)
+		handleError(w, "error reading request body", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var p config.RollbackPayload
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		logger.Errorf("unmarshalling rollback payload: %s", err)
+		handleError(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+
+	if err := p.Validate(); err != nil {
+		errs := fmt.Sprintf("error validating payload: %s", err.Error())
+		logger.Error(errs)
+		handleError(w, errs, http.StatusBadRequest)
+		return
+	}
+
+	logger.Infof("Received rollback request for repository %s, manifest %s, SHA %s", p.RepoName, p.ManifestName, p.SHA)
+
+	p.CommandID = uuid.New().String()
+	j, err := json.Marshal(p)
+	if err != nil {
+		logger.Errorf("marshalling rollback payload: %s", err)
+		handleError(w, "error occurred marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	err = messageClient.Publish(config.RollbackTopic, string(j))
+	if err != nil {
+		logger.Errorf("publishing to rollback topic: %s", err)
+		handleError(w, "Error publishing event", publishErrorStatus(err))
+		return
+	}
+
+	fmt.Fprintf(w, `{"request":"success"}`)
+}
+
+func handleConfigure(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("reading request body: %s", err)
+		handleError(w, "error reading request body", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var p config.ConfigurePayload
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		logger.Errorf("unmarshalling configure payload: %s", err)
+		handleError(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+
+	if err := p.Validate(); err != nil {
+		errs := fmt.Sprintf("error validating payload: %s", err.Error())
+		logger.Error(errs)
+		handleError(w, errs, http.StatusBadRequest)
+		return
+	}
+
+	logger.Infof("Received configure request for repository %s, manifest %s", p.RepoName, p.ManifestName)
+
+	p.CommandID = uuid.New().String()
+	j, err := json.Marshal(p)
+	if err != nil {
+		logger.Errorf("marshalling configure payload: %s", err)
+		handleError(w, "error occurred marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	err = messageClient.Publish(config.ConfigureTopic, string(j))
+	if err != nil {
+		logger.Errorf("publishing to configure topic: %s", err)
+		handleError(w, "Error publishing event", publishErrorStatus(err))
+		return
+	}
+
+	fmt.Fprintf(w, `{"request":"success"}`)
+}
+
+func handleInstall(w http.ResponseWriter, r *http.Request) {
+	handleAppCommand(w, r, config.AppCommandInstall)
+}
+
+func handleUninstall(w http.ResponseWriter, r *http.Request) {
+	handleAppCommand(w, r, config.AppCommandUninstall)
+}
+
+func handleAppCommand(w http.ResponseWriter, r *http.Request, action string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("reading request body: %s", err)
+		handleError(w, "error reading request body", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var p config.AppCommandPayload
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		logger.Errorf("unmarshalling app command payload: %s", err)
+		handleError(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+	p.Action = action
+
+	if err := p.Validate(); err != nil {
+		errs := fmt.Sprintf("error validating payload: %s", err.Error())
+		logger.Error(errs)
+		handleError(w, errs, http.StatusBadRequest)
+		return
+	}
+
+	logger.Infof("Received %s request for repository %s, manifest %s, hosts %v, selector %v", action, p.RepoName, p.ManifestName, p.Hosts, p.Selector)
+
+	err = redisClient.DeleteConditions(r.Context(), p.RepoName, p.ManifestName)
+	if err != nil {
+		logger.Errorf("deleting conditions from redis: %s", err)
+		handleError(w, "Error clearing previous deploy status", http.StatusInternalServerError)
+		return
+	}
+
+	p.CommandID = uuid.New().String()
+	j, err := json.Marshal(p)
+	if err != nil {
+		logger.Errorf("marshalling app command payload: %s", err)
+		handleError(w, "error occurred marshalling json", http.StatusInternalServerError)
+		return
+	}
+
+	err = messageClient.Publish(config.AppCommandTopic, string(j))
+	if err != nil {
+		logger.Errorf("publishing to app command topic: %s", err)
+		handleError(w, "Error publishing event", publishErrorStatus(err))
+		return
+	}
+
+	fmt.Fprintf(w, `{"request":"success"}`)
+}
+
+// publishErrorStatus is the status code of a command that could not
+// be published, the request can be retried once the server is
+// connected to the broker again.
+func publishErrorStatus(err error) int {
+	if errors.Is(err, mqtt.ErrNotConnected) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 func handleError(w http.ResponseWriter, err string, statusCode int) {
 	http.Error(w, fmt.Sprintf(`{"request":"error","error":"%s"}`, err), statusCode)
 }
 
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, fmt.Sprintf(`{"version":"%s"}`, version))
+	fmt.Fprintf(w, fmt.Sprintf(`{"version":"%s","mqttConnected":%t}`, version, messageClient.IsConnected()))
 }
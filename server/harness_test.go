@@ -0,0 +1,415 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	gh "github.com/google/go-github/v42/github"
+	gmux "github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/cmd"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/file"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/logging"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/mqtt"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/notify"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/redis"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/secrets"
+)
+
+const (
+	testAPIKey    = "test-api-key"
+	testHerokuApp = "pi-app-deployer-test"
+	testGHToken   = "test-gh-token"
+
+	waitTimeout = 10 * time.Second
+	waitTick    = 50 * time.Millisecond
+)
+
+// harness runs the server and an agent in process. The agent talks to
+// the server through a local broker, reads its secrets from a fake
+// provider, downloads artifacts from a fake Github API, keeps the files
+// of the host under a temporary directory and starts its units with a
+// fake systemctl.
+type harness struct {
+	t       *testing.T
+	api     *httptest.Server
+	broker  *mqtt.Broker
+	github  *fakeGithub
+	systemd *fakeSystemd
+	host    file.Host
+	appUser string
+}
+
+func newHarness(t *testing.T) *harness {
+	u, err := user.Current()
+	assert.NoError(t, err)
+	h := &harness{
+		t:       t,
+		github:  newFakeGithub(t),
+		systemd: newFakeSystemd(),
+		appUser: u.Username,
+	}
+
+	h.host = file.Host{
+		Root:      t.TempDir(),
+		Systemctl: h.systemd.run,
+		// files are owned by the user running the tests
+		Chown: func(string, int, int) error { return nil },
+	}
+	for _, dir := range []string{config.PiAppDeployerDir, "/etc/systemd/system", "/tmp"} {
+		assert.NoError(t, os.MkdirAll(h.host.Path(dir), 0755))
+	}
+
+	apiKey := os.Getenv("PI_APP_DEPLOYER_API_KEY")
+	os.Setenv("PI_APP_DEPLOYER_API_KEY", testAPIKey)
+	t.Cleanup(func() { os.Setenv("PI_APP_DEPLOYER_API_KEY", apiKey) })
+
+	logger = zaptest.NewLogger(t).Sugar()
+	forwarderLogger = logger
+
+	r := miniredis.RunT(t)
+	redisClient, err = redis.NewRedisClient(fmt.Sprintf("redis://%s", r.Addr()))
+	assert.NoError(t, err)
+
+	notifier, err := notify.NewNotifier(notify.Config{})
+	assert.NoError(t, err)
+
+	h.broker = mqtt.NewBroker(nil, nil)
+	t.Cleanup(h.broker.Close)
+	messageClient = h.broker.Transport()
+	subscribe(logging.ConfigMap{}, notifications{notifier: notifier, logger: logger})
+	assert.NoError(t, messageClient.Connect())
+	t.Cleanup(messageClient.Close)
+
+	h.api = httptest.NewServer(newRouter())
+	t.Cleanup(h.api.Close)
+	return h
+}
+
+// startAgent runs the update daemon of a host until the returned
+// function or the test cleanup stops it. The agents share the files
+// of the host, only one can run at a time.
+func (h *harness) startAgent(host string) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.RunAgent(ctx, cmd.AgentOptions{
+			Host:         host,
+			HerokuApp:    testHerokuApp,
+			Secrets:      fakeSecrets{},
+			ConfigFile:   h.host.Path(config.DeployerConfigFile),
+			SocketPath:   h.host.Path(filepath.Join(config.PiAppDeployerDir, ".agent.sock")),
+			Transport:    h.broker.Transport(),
+			FileHost:     h.host,
+			GithubAPIURL: h.github.srv.URL,
+		})
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			assert.NoError(h.t, <-done)
+		})
+	}
+	h.t.Cleanup(stop)
+
+	// the agent publishes its inventory once it is connected
+	h.waitFor(fmt.Sprintf("agent %s to start", host), func() bool {
+		select {
+		case err := <-done:
+			done <- err
+			return true
+		default:
+		}
+		_, ok := h.agent(host)
+		return ok
+	})
+	return stop
+}
+
+// waitFor fails the test when condition is not met in time.
+func (h *harness) waitFor(what string, condition func() bool) {
+	h.t.Helper()
+	if !assert.Eventually(h.t, condition, waitTimeout, waitTick, "waiting for %s", what) {
+		h.t.FailNow()
+	}
+}
+
+// do sends an authenticated request to the server API and
+// returns the status code and body of the response.
+func (h *harness) do(method, path string, payload interface{}) (int, string) {
+	h.t.Helper()
+	var body bytes.Buffer
+	if payload != nil {
+		assert.NoError(h.t, json.NewEncoder(&body).Encode(payload))
+	}
+	req, err := http.NewRequest(method, h.api.URL+path, &body)
+	assert.NoError(h.t, err)
+	req.Header.Set("api-key", testAPIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(h.t, err) {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(h.t, err)
+	return resp.StatusCode, string(b)
+}
+
+// agent returns the agent of a host as listed by the server.
+func (h *harness) agent(host string) (status.Agent, bool) {
+	code, body := h.do(http.MethodGet, fmt.Sprintf("/agents/%s", host), nil)
+	if code != http.StatusOK {
+		return status.Agent{}, false
+	}
+	var resp struct {
+		Agent status.Agent `json:"agent"`
+	}
+	assert.NoError(h.t, json.Unmarshal([]byte(body), &resp))
+	return resp.Agent, true
+}
+
+// app returns an app of a host as listed by the server.
+func (h *harness) app(host, repoName, manifestName string) (status.AgentApp, bool) {
+	a, ok := h.agent(host)
+	if !ok {
+		return status.AgentApp{}, false
+	}
+	for _, app := range a.Apps {
+		if app.RepoName == repoName && app.ManifestName == manifestName {
+			return app, true
+		}
+	}
+	return status.AgentApp{}, false
+}
+
+// deployStatus returns the deploy status of an app by host.
+func (h *harness) deployStatus(repoName, manifestName string) (map[string]status.UpdateCondition, map[string]status.UpdateCondition) {
+	code, body := h.do(http.MethodGet, "/deploy/status", config.DeployStatusPayload{
+		RepoName:     repoName,
+		ManifestName: manifestName,
+	})
+	var resp struct {
+		SuccessfulHosts   map[string]status.UpdateCondition `json:"successfulHosts"`
+		UnsuccessfulHosts map[string]status.UpdateCondition `json:"unsuccessfulHosts"`
+	}
+	if code != http.StatusOK {
+		return resp.SuccessfulHosts, resp.UnsuccessfulHosts
+	}
+	assert.NoError(h.t, json.Unmarshal([]byte(body), &resp))
+	return resp.SuccessfulHosts, resp.UnsuccessfulHosts
+}
+
+// readHostFile returns the content of a file of the host.
+func (h *harness) readHostFile(path string) string {
+	b, err := os.ReadFile(h.host.Path(path))
+	assert.NoError(h.t, err)
+	return string(b)
+}
+
+// fakeSecrets is the secret provider of the agent.
+type fakeSecrets struct{}
+
+func (fakeSecrets) Name() string {
+	return "fake"
+}
+
+func (fakeSecrets) GetSecrets(scope string) (map[string]string, error) {
+	if scope != testHerokuApp {
+		return nil, fmt.Errorf("unknown scope %s", scope)
+	}
+	return map[string]string{
+		"GH_API_TOKEN":             testGHToken,
+		"CLOUDMQTT_AGENT_USER":     "agent",
+		"CLOUDMQTT_AGENT_PASSWORD": "secret",
+		// the agent is given the local broker instead
+		"CLOUDMQTT_URL": "mqtt://localhost:1883",
+	}, nil
+}
+
+// Env is written to the env files of apps, which are never run
+func (fakeSecrets) Env() map[string]string {
+	return map[string]string{secrets.ProviderEnvVar: "fake"}
+}
+
+// fakeGithub serves the workflow artifacts of repositories
+// like the Github Actions API.
+type fakeGithub struct {
+	srv *httptest.Server
+	mu  sync.Mutex
+	// artifacts are zip archives keyed by repository
+	// and name, listed newest first
+	artifacts map[string][]string
+	archives  map[string][]byte
+}
+
+func newFakeGithub(t *testing.T) *fakeGithub {
+	g := &fakeGithub{
+		artifacts: map[string][]string{},
+		archives:  map[string][]byte{},
+	}
+	router := gmux.NewRouter()
+	router.HandleFunc("/repos/{owner}/{repo}/actions/artifacts", g.handleList)
+	router.HandleFunc("/download/{owner}/{repo}/{name}", g.handleDownload)
+	g.srv = httptest.NewServer(router)
+	t.Cleanup(g.srv.Close)
+	return g
+}
+
+// publish uploads the artifact of an app built from a commit, the
+// executable prints the SHA of the commit.
+func (g *fakeGithub) publish(t *testing.T, repoName, manifestName, sha string) string {
+	// the shortest health check keeps deploys quick
+	m := fmt.Sprintf("name: %s\nexecutable: %s\nheroku:\n  app: %s\nhealthCheck:\n  activeSec: 1\n", manifestName, manifestName, testHerokuApp)
+	files := map[string]string{
+		".pi-app-deployer.yaml": m,
+		manifestName:            fmt.Sprintf("#!/bin/sh\necho %s\n", sha),
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := z.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, z.Close())
+
+	name := fmt.Sprintf("%s_%s", manifestName, sha)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.artifacts[repoName] = append([]string{name}, g.artifacts[repoName]...)
+	g.archives[fmt.Sprintf("%s/%s", repoName, name)] = buf.Bytes()
+	return name
+}
+
+func (g *fakeGithub) handleList(w http.ResponseWriter, r *http.Request) {
+	vars := gmux.Vars(r)
+	repoName := fmt.Sprintf("%s/%s", vars["owner"], vars["repo"])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	list := gh.ArtifactList{Artifacts: []*gh.Artifact{}}
+	for _, name := range g.artifacts[repoName] {
+		list.Artifacts = append(list.Artifacts, &gh.Artifact{
+			Name:               gh.String(name),
+			ArchiveDownloadURL: gh.String(fmt.Sprintf("%s/download/%s/%s", g.srv.URL, repoName, name)),
+		})
+	}
+	list.TotalCount = gh.Int64(int64(len(list.Artifacts)))
+	json.NewEncoder(w).Encode(list)
+}
+
+func (g *fakeGithub) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != fmt.Sprintf("token %s", testGHToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	vars := gmux.Vars(r)
+	g.mu.Lock()
+	archive, ok := g.archives[fmt.Sprintf("%s/%s/%s", vars["owner"], vars["repo"], vars["name"])]
+	g.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(archive)
+}
+
+// fakeSystemd keeps the state of units in place of systemctl.
+type fakeSystemd struct {
+	mu      sync.Mutex
+	active  map[string]bool
+	enabled map[string]bool
+	// failing units exit right after they are started
+	failing map[string]bool
+}
+
+func newFakeSystemd() *fakeSystemd {
+	return &fakeSystemd{
+		active:  map[string]bool{},
+		enabled: map[string]bool{},
+		failing: map[string]bool{},
+	}
+}
+
+func (s *fakeSystemd) run(args ...string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(args) == 0 {
+		return "", fmt.Errorf("no systemctl command")
+	}
+	if args[0] == "daemon-reload" {
+		return "", nil
+	}
+	if len(args) < 2 {
+		return "", fmt.Errorf("no unit given to systemctl %s", args[0])
+	}
+
+	unit := strings.TrimSuffix(args[1], ".service")
+	switch args[0] {
+	case "start", "restart":
+		s.active[unit] = !s.failing[unit]
+	case "stop":
+		s.active[unit] = false
+	case "enable":
+		s.enabled[unit] = true
+	case "is-active":
+		if s.active[unit] {
+			return "active\n", nil
+		}
+		return "inactive\n", nil
+	case "is-enabled":
+		if s.enabled[unit] {
+			return "enabled\n", nil
+		}
+		return "disabled\n", nil
+	case "show":
+		state, fileState := "inactive", "disabled"
+		if s.active[unit] {
+			state = "active"
+		}
+		if s.enabled[unit] {
+			fileState = "enabled"
+		}
+		return fmt.Sprintf("ActiveState=%s\nSubState=%s\nUnitFileState=%s\n", state, state, fileState), nil
+	default:
+		return "", fmt.Errorf("unexpected systemctl command: %s", strings.Join(args, " "))
+	}
+	return "", nil
+}
+
+func (s *fakeSystemd) isActive(unit string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[unit]
+}
+
+// fail makes a unit exit right after it is started.
+func (s *fakeSystemd) fail(unit string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing[unit] = true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/notify"
+)
+
+const (
+	sweepInterval = config.InventoryTickerSchedule
+	// a leader that stopped sweeping is replaced after this duration
+	sweeperLeadershipTTL = 3 * sweepInterval
+)
+
+// runLivenessSweeper reports agents going offline or coming back
+// online, and halts rollouts left behind by stopped servers. Every
+// server competes for the sweeper leadership kept in redis so
+// transitions are detected once across restarts and replicas.
+func runLivenessSweeper(ctx context.Context, id string, events notifications) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	leader := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ok, err := redisClient.AcquireSweeperLeadership(ctx, id, sweeperLeadershipTTL)
+		if err != nil {
+			logger.Errorf("acquiring liveness sweeper leadership: %s", err)
+			continue
+		}
+		if ok != leader {
+			logger.Infow("liveness sweeper leadership changed", "leader", ok, "id", id)
+			leader = ok
+		}
+		if !leader {
+			continue
+		}
+
+		offline, online, err := redisClient.SweepAgents(ctx, time.Now(), config.InventoryTickerTimeout)
+		for _, host := range offline {
+			logger.Errorf("Agent inventory timeout occurred for host: %s", host)
+			events.send(notify.Event{Type: notify.EventAgentOffline, Host: host})
+		}
+		for _, host := range online {
+			logger.Infof("Agent inventory received again for host: %s", host)
+			events.send(notify.Event{Type: notify.EventAgentOnline, Host: host})
+		}
+		if err != nil {
+			logger.Errorf("sweeping agent liveness: %s", err)
+		}
+
+		haltInterruptedRollouts(ctx)
+	}
+}
@@ -7,26 +7,26 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
-	mqttC "github.com/eclipse/paho.mqtt.golang"
 	"gopkg.in/yaml.v2"
 
 	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/logging"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/mqtt"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/notify"
 	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/redis"
 	"go.uber.org/zap"
 
+	"github.com/google/uuid"
 	gmux "github.com/gorilla/mux"
 )
 
 var logger *zap.SugaredLogger
 var forwarderLogger *zap.SugaredLogger
 
-var messageClient mqtt.MqttClient
+var messageClient mqtt.Transport
 var redisClient redis.Redis
 
 var version string
@@ -44,24 +44,9 @@ func main() {
 
 	srvAddr := fmt.Sprintf("0.0.0.0:%s", os.Getenv("PORT"))
 
-	user := os.Getenv("CLOUDMQTT_USER")
-	pw := os.Getenv("CLOUDMQTT_PASSWORD")
-	url := os.Getenv("CLOUDMQTT_URL")
-
-	if user == "" || pw == "" || url == "" {
-		logger.Fatal("CLOUDMQTT_USER CLOUDMQTT_PASSWORD CLOUDMQTT_URL env vars must be set")
-	}
-
-	mqttAddr := fmt.Sprintf("mqtt://%s:%s@%s", user, pw, strings.Split(url, "@")[1])
-
-	messageClient = mqtt.NewMQTTClient(mqttAddr, func(client mqttC.Client) {
-		logger.Info("Connected to MQTT server")
-	}, func(client mqttC.Client, err error) {
-		logger.Fatalf("Connection to MQTT server lost: %s", err)
-	})
-	err = messageClient.Connect()
+	messageClient, err = newTransport()
 	if err != nil {
-		logger.Fatalf("connecting to mqtt: %s", err)
+		logger.Fatalf("creating message transport: %s", err)
 	}
 
 	redisClient, err = redis.NewRedisClient(os.Getenv("REDIS_TLS_URL"))
@@ -76,6 +61,36 @@ func main() {
 		logger.Fatalf("unmarshalling log forwarder config %s", err)
 	}
 
+	notifier, err := notify.NewNotifierFromYaml(os.Getenv("NOTIFIER_CONFIG"))
+	if err != nil {
+		logger.Fatalf("creating notifier: %s", err)
+	}
+	// every server receives the update conditions
+	notifier.SetDeduper(redisDeduper{})
+
+	events := notifications{notifier: notifier, logger: logger}
+	subscribe(logCM, events)
+
+	// handlers are registered before connecting so messages queued
+	// in the session of the server are not dropped
+	err = messageClient.Connect()
+	if err != nil {
+		logger.Fatalf("connecting to mqtt: %s", err)
+	}
+
+	go runLivenessSweeper(context.Background(), uuid.New().String(), events)
+
+	srv := &http.Server{
+		Handler: newRouter(),
+		Addr:    srvAddr,
+	}
+
+	logger.Infof("server started on %s", srvAddr)
+	logger.Fatalf("error running web server: %s", srv.ListenAndServe())
+}
+
+// subscribe registers the handlers of the messages sent by agents.
+func subscribe(logCM logging.ConfigMap, events notifications) {
 	messageClient.Subscribe(config.LogForwarderTopic, func(message string) {
 		var log config.Log
 		err := json.Unmarshal([]byte(message), &log)
@@ -115,16 +130,41 @@ func main() {
 			"repoName", c.RepoName,
 			"manifestName", c.ManifestName,
 			"host", c.Host,
-			"error", c.Error)
+			"error", c.Error,
+			"rolledBack", c.RolledBack,
+			"runningSHA", c.RunningSHA)
 
 		err = redisClient.WriteCondition(context.Background(), c)
 		if err != nil {
 			logger.Errorf("writing condition message to redis: %s", err)
 			return
 		}
+
+		// a rollback is chosen over the pushed version, the host
+		// must not update back to it, whether the rollback was
+		// requested or followed a failed update
+		if c.RolledBack {
+			recordRollback(context.Background(), c)
+		}
+
+		switch c.Status {
+		case config.StatusSuccess:
+			events.send(notify.Event{Type: notify.EventDeploySuccess, Host: c.Host, RepoName: c.RepoName, ManifestName: c.ManifestName, SHA: c.SHA})
+		case config.StatusErr, config.StatusHealthCheckFailed:
+			events.send(notify.Event{Type: notify.EventDeployFailure, Host: c.Host, RepoName: c.RepoName, ManifestName: c.ManifestName, SHA: c.SHA, Error: c.Error})
+		}
+
+		if c.Status == config.StatusInProgress {
+			err = redisClient.WriteDeploymentStart(context.Background(), c, time.Now())
+		} else {
+			err = redisClient.WriteDeploymentResult(context.Background(), c, time.Now())
+		}
+		if err != nil {
+			logger.Errorf("writing deployment history to redis: %s", err)
+			return
+		}
 	})
 
-	var inventoryTimerMap map[string]*time.Timer = make(map[string]*time.Timer)
 	messageClient.Subscribe(config.AgentInventoryTopic, func(message string) {
 		p := config.AgentInventoryPayload{}
 		unmarshErr := json.Unmarshal([]byte(message), &p)
@@ -137,39 +177,57 @@ func main() {
 		if p.Transient {
 			expiration = 1 * time.Minute
 		}
-		err = redisClient.WriteAgentInventory(context.Background(), p, expiration)
+		err := redisClient.WriteAgentInventory(context.Background(), p, expiration)
 		if err != nil {
 			logger.Errorf("writing agent inventory to redis: %s", err)
 			return
 		}
 
+		err = redisClient.WriteAgentLabels(context.Background(), p.Host, p.Labels, expiration)
+		if err != nil {
+			logger.Errorf("writing agent labels to redis: %s", err)
+			return
+		}
+
+		err = redisClient.WriteAgentPlatform(context.Background(), p.Host, p.Platform, expiration)
+		if err != nil {
+			logger.Errorf("writing agent platform to redis: %s", err)
+			return
+		}
+
 		// there can be multiple manifest/repo per host. For
-		// timeout we're only interested in host, so last one wins.
+		// liveness we're only interested in host, so last one wins.
 		if !p.Transient {
-			currentTimer := inventoryTimerMap[p.Host]
-			if currentTimer != nil {
-				currentTimer.Stop()
+			err = redisClient.WriteAgentLastSeen(context.Background(), p.Host, time.Now())
+			if err != nil {
+				logger.Errorf("writing agent last seen time to redis: %s", err)
+				return
 			}
-			timer := time.AfterFunc(config.InventoryTickerTimeout, func() {
-				logger.Errorf("Agent inventory timeout occurred for host: %s", p.Host)
-			})
-			inventoryTimerMap[p.Host] = timer
 		}
 	})
 
+	messageClient.Subscribe(config.DesiredStateRequestTopic, handleDesiredStateRequest)
+}
+
+func newRouter() http.Handler {
 	router := gmux.NewRouter().StrictSlash(true)
 	router.Handle("/push", requireLogin(http.HandlerFunc(handleRepoPush))).Methods("POST")
+	router.Handle("/deploy/history", requireLogin(http.HandlerFunc(handleDeployHistory))).Methods("GET")
 	router.Handle("/deploy/status", requireLogin(http.HandlerFunc(handleDeployStatus))).Methods("GET")
+	router.Handle("/rollout/status", requireLogin(http.HandlerFunc(handleRolloutStatus))).Methods("GET")
+	router.Handle("/rollback", requireLogin(http.HandlerFunc(handleRollback))).Methods("POST")
 	router.Handle("/service", requireLogin(http.HandlerFunc(handleServicePost))).Methods("POST")
+	router.Handle("/configure", requireLogin(http.HandlerFunc(handleConfigure))).Methods("POST")
+	router.Handle("/install", requireLogin(http.HandlerFunc(handleInstall))).Methods("POST")
+	router.Handle("/uninstall", requireLogin(http.HandlerFunc(handleUninstall))).Methods("POST")
+	router.Handle("/agents", requireLogin(http.HandlerFunc(handleAgents))).Methods("GET")
+	router.Handle("/agents/{host}", requireLogin(http.HandlerFunc(handleAgent))).Methods("GET")
 	router.Handle("/health", requireLogin(http.HandlerFunc(handleHealthCheck))).Methods("GET")
-
-	srv := &http.Server{
-		Handler: router,
-		Addr:    srvAddr,
+	if broker != nil {
+		// agents authenticate with their MQTT credentials
+		router.Handle("/mqtt", broker.WebsocketHandler())
 	}
-
-	logger.Infof("server started on %s", srvAddr)
-	logger.Fatalf("error running web server: %s", srv.ListenAndServe())
+	return router
 }
 
 func requireLogin(next http.Handler) http.Handler {
@@ -195,3 +253,26 @@ func isAuthenticated(req *http.Request) bool {
 	}
 	return true
 }
+
+// redisDeduper shares the notifications sent with the other servers.
+type redisDeduper struct{}
+
+func (redisDeduper) IsRepeat(subject, key string, window time.Duration) (bool, error) {
+	return redisClient.IsRepeatNotification(context.Background(), subject, key, window)
+}
+
+// notifications sends the events of the server through its
+// notifier, logging the events which could not be sent.
+type notifications struct {
+	notifier *notify.Notifier
+	logger   *zap.SugaredLogger
+}
+
+// send sends an event without blocking the caller
+func (n notifications) send(e notify.Event) {
+	go func() {
+		if err := n.notifier.Notify(e); err != nil {
+			n.logger.Errorf("sending %s notification for host %s: %s", e.Type, e.Host, err)
+		}
+	}()
+}
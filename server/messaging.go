@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	mqttC "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/mqtt"
+)
+
+// broker is set when the server runs the MQTT broker itself
+var broker *mqtt.Broker
+
+// newTransport connects the server to the agents. The server runs
+// the broker when MQTT_BROKER_USERS is set, agents then connect to
+// /mqtt with websockets, or to MQTT_BROKER_ADDR when it is set.
+// Otherwise the broker of CLOUDMQTT_URL is used.
+//
+// The users of the broker may only publish to the topics of agents,
+// apart from MQTT_BROKER_SERVER_USER which may also send commands.
+// Sessions are kept in memory, commands queued for offline agents are
+// lost when the server restarts and agents catch up by asking for the
+// desired state of their apps.
+func newTransport() (mqtt.Transport, error) {
+	if users := os.Getenv("MQTT_BROKER_USERS"); users != "" {
+		u, err := mqtt.ParseUsers(users)
+		if err != nil {
+			return nil, fmt.Errorf("parsing MQTT_BROKER_USERS: %s", err)
+		}
+		broker = mqtt.NewBroker(u, logger.Infof)
+		serverUser := os.Getenv("MQTT_BROKER_SERVER_USER")
+		for user := range u {
+			if user != serverUser {
+				broker.RestrictPublish(user, config.AgentPublishTopics)
+			}
+		}
+
+		if addr := os.Getenv("MQTT_BROKER_ADDR"); addr != "" {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("listening for MQTT clients: %s", err)
+			}
+			go func() {
+				err := broker.Serve(l)
+				if err != nil {
+					logger.Errorf("serving MQTT clients: %s", err)
+				}
+			}()
+		}
+		return broker.Transport(), nil
+	}
+
+	user := os.Getenv("CLOUDMQTT_USER")
+	pw := os.Getenv("CLOUDMQTT_PASSWORD")
+	url := os.Getenv("CLOUDMQTT_URL")
+
+	if user == "" || pw == "" || url == "" {
+		return nil, fmt.Errorf("CLOUDMQTT_USER CLOUDMQTT_PASSWORD CLOUDMQTT_URL env vars must be set when MQTT_BROKER_USERS is not")
+	}
+
+	mqttAddr, err := mqtt.BrokerURL(url, user, pw)
+	if err != nil {
+		return nil, fmt.Errorf("CLOUDMQTT_URL: %s", err)
+	}
+
+	qos, err := mqtt.ParseQoS(os.Getenv("MQTT_QOS"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing MQTT_QOS: %s", err)
+	}
+	// MQTT_CLIENT_ID keeps the session of the server across restarts,
+	// each server instance needs its own. Commands are not buffered
+	// while disconnected, the API would report them as sent.
+	mqttOptions := mqtt.Options{
+		ClientID:   os.Getenv("MQTT_CLIENT_ID"),
+		QoS:        qos,
+		Unbuffered: true,
+	}
+	return mqtt.NewMQTTClient(mqttAddr, mqttOptions, func(client mqttC.Client) {
+		logger.Info("Connected to MQTT server")
+	}, func(client mqttC.Client, err error) {
+		logger.Errorf("Connection to MQTT server lost, reconnecting: %s", err)
+	}), nil
+}
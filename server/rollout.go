@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/api/v1/status"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/google/uuid"
+)
+
+var (
+	rolloutPollInterval = 5 * time.Second
+	// rolloutLeaseTTL is how long a rollout stays in progress after
+	// the server running it stopped renewing its lease
+	rolloutLeaseTTL = time.Minute
+)
+
+// rolloutManager runs staged rollouts, at most
+// one per repo and manifest at a time.
+type rolloutManager struct {
+	mu   sync.Mutex
+	runs map[string]*rolloutRun
+}
+
+// rolloutRun is a rollout running in the background.
+type rolloutRun struct {
+	id     string
+	cancel context.CancelFunc
+}
+
+var rollouts = rolloutManager{
+	runs: map[string]*rolloutRun{},
+}
+
+// rolloutHosts returns the hosts targeted by a push. Hosts which
+// have not sent their inventory within InventoryTickerTimeout are
+// left out, a rollout would wait for them until the wave times out.
+func rolloutHosts(ctx context.Context, a config.Artifact, now time.Time) ([]string, error) {
+	agents, err := redisClient.ReadAgentInventory(ctx, a.RepoName, a.ManifestName)
+	if err != nil {
+		return nil, fmt.Errorf("reading agent inventory: %s", err)
+	}
+
+	hosts := []string{}
+	for host, lastSeen := range agents {
+		if now.Sub(lastSeen) > config.InventoryTickerTimeout {
+			continue
+		}
+		labels, err := redisClient.ReadAgentLabels(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("reading agent labels: %s", err)
+		}
+		if a.Matches(host, labels) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// start plans the waves of a rollout and runs them in the
+// background, replacing any rollout already running for the app.
+func (m *rolloutManager) start(a config.Artifact, hosts []string) (status.RolloutStatus, error) {
+	waves, err := a.Rollout.Waves(hosts)
+	if err != nil {
+		return status.RolloutStatus{}, err
+	}
+	if len(waves) == 0 {
+		return status.RolloutStatus{}, fmt.Errorf("no agents are configured for this app")
+	}
+
+	rs := status.RolloutStatus{
+		RepoName:     a.RepoName,
+		ManifestName: a.ManifestName,
+		SHA:          a.SHA,
+		Strategy:     a.Rollout.Strategy,
+		Status:       config.StatusInProgress,
+		Waves:        waves,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &rolloutRun{id: uuid.New().String(), cancel: cancel}
+
+	// the lease is taken first so the rollout is
+	// never seen in progress without one
+	err = redisClient.RenewRolloutLease(context.Background(), a.RepoName, a.ManifestName, r.id, rolloutLeaseTTL)
+	if err != nil {
+		cancel()
+		return rs, fmt.Errorf("renewing rollout lease: %s", err)
+	}
+	err = redisClient.WriteRolloutStatus(context.Background(), rs)
+	if err != nil {
+		cancel()
+		return rs, fmt.Errorf("writing rollout status: %s", err)
+	}
+
+	m.mu.Lock()
+	if previous, ok := m.runs[rolloutKey(a)]; ok {
+		previous.cancel()
+	}
+	m.runs[rolloutKey(a)] = r
+	m.mu.Unlock()
+
+	go m.renewLease(ctx, a, r)
+	go func() {
+		defer m.finish(a, r)
+		m.run(ctx, a, rs)
+	}()
+	return rs, nil
+}
+
+// cancel stops the rollout running for an app, if any.
+func (m *rolloutManager) cancel(a config.Artifact) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.runs[rolloutKey(a)]; ok {
+		r.cancel()
+		delete(m.runs, rolloutKey(a))
+	}
+}
+
+// finish forgets a rollout that returned, unless it
+// was already replaced by a newer one, and releases its lease.
+func (m *rolloutManager) finish(a config.Artifact, r *rolloutRun) {
+	r.cancel()
+	m.mu.Lock()
+	if m.runs[rolloutKey(a)] == r {
+		delete(m.runs, rolloutKey(a))
+	}
+	m.mu.Unlock()
+
+	err := redisClient.ReleaseRolloutLease(context.Background(), a.RepoName, a.ManifestName, r.id)
+	if err != nil {
+		logger.Errorf("releasing rollout lease: %s", err)
+	}
+}
+
+// renewLease keeps the rollout in progress until ctx is done.
+func (m *rolloutManager) renewLease(ctx context.Context, a config.Artifact, r *rolloutRun) {
+	ticker := time.NewTicker(rolloutLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := redisClient.RenewRolloutLease(ctx, a.RepoName, a.ManifestName, r.id, rolloutLeaseTTL)
+		if err != nil && ctx.Err() == nil {
+			logger.Errorf("renewing rollout lease: %s", err)
+		}
+	}
+}
+
+// haltInterruptedRollouts halts the rollouts whose server
+// stopped before finishing them, they are never resumed.
+func haltInterruptedRollouts(ctx context.Context) {
+	halted, err := redisClient.HaltInterruptedRollouts(ctx, "the server running the rollout stopped, push again to restart it")
+	for _, rs := range halted {
+		logger.Errorf("Halted interrupted rollout for repository %s, manifest %s, SHA %s", rs.RepoName, rs.ManifestName, rs.SHA)
+	}
+	if err != nil {
+		logger.Errorf("halting interrupted rollouts: %s", err)
+	}
+}
+
+func (m *rolloutManager) run(ctx context.Context, a config.Artifact, rs status.RolloutStatus) {
+	// agents only reconcile to the artifact once their wave started
+	desired := a
+	desired.Hosts = []string{}
+	for i, wave := range rs.Waves {
+		rs.CurrentWave = i
+		m.writeStatus(ctx, rs)
+
+		logger.Infof("Starting rollout wave %d/%d for repository %s, manifest %s, SHA %s on hosts %s", i+1, len(rs.Waves), a.RepoName, a.ManifestName, a.SHA, wave)
+		err := publishToHosts(a, wave)
+		if err == nil && ctx.Err() == nil {
+			desired.Hosts = append(desired.Hosts, wave...)
+			writeDesiredArtifact(ctx, desired)
+		}
+		if err == nil {
+			err = waitForWave(ctx, a, wave)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Infof("Rollout for repository %s, manifest %s, SHA %s was replaced by a newer push", a.RepoName, a.ManifestName, a.SHA)
+				return
+			}
+			logger.Errorf("Halting rollout for repository %s, manifest %s, SHA %s: %s", a.RepoName, a.ManifestName, a.SHA, err)
+			rs.Status = config.StatusHalted
+			rs.Error = err.Error()
+			m.writeStatus(ctx, rs)
+			return
+		}
+
+		if i < len(rs.Waves)-1 && a.Rollout.BatchWaitSec > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(a.Rollout.BatchWaitSec) * time.Second):
+			}
+		}
+	}
+
+	logger.Infof("Rollout completed for repository %s, manifest %s, SHA %s", a.RepoName, a.ManifestName, a.SHA)
+	rs.Status = config.StatusSuccess
+	m.writeStatus(ctx, rs)
+	if ctx.Err() == nil {
+		writeDesiredArtifact(ctx, a)
+	}
+}
+
+func (m *rolloutManager) writeStatus(ctx context.Context, rs status.RolloutStatus) {
+	if ctx.Err() != nil {
+		return
+	}
+	err := redisClient.WriteRolloutStatus(context.Background(), rs)
+	if err != nil {
+		logger.Errorf("writing rollout status to redis: %s", err)
+	}
+}
+
+func publishToHosts(a config.Artifact, hosts []string) error {
+	a.Hosts = hosts
+	a.Rollout = nil
+	// each wave is a command of its own
+	a.CommandID = uuid.New().String()
+	j, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("marshalling artifact: %s", err)
+	}
+
+	err = messageClient.Publish(config.RepoPushTopic, string(j))
+	if err != nil {
+		return fmt.Errorf("publishing to repo push topic: %s", err)
+	}
+	return nil
+}
+
+// waitForWave blocks until every host of a wave reports a final
+// update condition, returning an error if any host did not succeed.
+func waitForWave(ctx context.Context, a config.Artifact, hosts []string) error {
+	timeout := time.After(config.RolloutWaveTimeout)
+	ticker := time.NewTicker(rolloutPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("timed out after %s waiting for hosts %s to update", config.RolloutWaveTimeout, hosts)
+		case <-ticker.C:
+		}
+
+		conditions, err := redisClient.ReadConditions(ctx, a.RepoName, a.ManifestName)
+		if err != nil {
+			logger.Errorf("reading conditions from redis: %s", err)
+			continue
+		}
+
+		pending := 0
+		for _, h := range hosts {
+			// conditions of other commands, like configuring
+			// the app, do not carry the SHA of the push
+			c, ok := conditions[h]
+			if !ok || c.Status == config.StatusInProgress || c.SHA != a.SHA {
+				pending++
+				continue
+			}
+			if c.Status != config.StatusSuccess {
+				return fmt.Errorf("host %s reported %s: %s", h, c.Status, c.Error)
+			}
+		}
+
+		if pending == 0 {
+			return nil
+		}
+	}
+}
+
+func rolloutKey(a config.Artifact) string {
+	return strings.Join([]string{a.RepoName, a.ManifestName}, "/")
+}
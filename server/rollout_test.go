@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/config"
+	"github.com/andrewmarklloyd/pi-app-deployer/internal/pkg/redis"
+)
+
+func TestRolloutHostsLeavesOutStaleHosts(t *testing.T) {
+	r := miniredis.RunT(t)
+	var err error
+	redisClient, err = redis.NewRedisClient(fmt.Sprintf("redis://%s", r.Addr()))
+	assert.NoError(t, err)
+
+	now := time.Now()
+	lastSeen := map[string]time.Time{
+		"pi-1": now,
+		"pi-2": now.Add(-config.InventoryTickerTimeout - time.Minute),
+	}
+	for host, t0 := range lastSeen {
+		err := redisClient.WriteAgentInventory(context.Background(), config.AgentInventoryPayload{
+			RepoName:     testRepoName,
+			ManifestName: testManifestName,
+			Host:         host,
+			Timestamp:    t0.Unix(),
+		}, 0)
+		assert.NoError(t, err)
+	}
+
+	a := config.Artifact{
+		RepoName:     testRepoName,
+		ManifestName: testManifestName,
+		Rollout:      &config.Rollout{Strategy: config.RolloutStrategyBatches, BatchSize: 1},
+	}
+	hosts, err := rolloutHosts(context.Background(), a, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pi-1"}, hosts)
+
+	waves, err := a.Rollout.Waves(hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"pi-1"}}, waves)
+}